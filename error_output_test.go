@@ -0,0 +1,89 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/tern/v2/migrate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMigrationPgError(t *testing.T) (migrate.MigrationPgError, migrate.ErrorLineExtract) {
+	t.Helper()
+
+	sql := "select 1;\nselect * from missing_table;\n"
+	mgErr := migrate.MigrationPgError{
+		MigrationName: "001_broken.sql",
+		Sql:           sql,
+		PgError: &pgconn.PgError{
+			Severity: "ERROR",
+			Code:     "42P01",
+			Message:  `relation "missing_table" does not exist`,
+			Position: 25,
+		},
+	}
+	ele, err := migrate.ExtractErrorLine(sql, int(mgErr.Position))
+	require.NoError(t, err)
+	return mgErr, ele
+}
+
+func TestWriteMigrationPgErrorWithoutColor(t *testing.T) {
+	mgErr, ele := testMigrationPgError(t)
+
+	var buf bytes.Buffer
+	writeMigrationPgError(&buf, mgErr, ele, false)
+
+	expected := `001_broken.sql: ERROR: relation "missing_table" does not exist (SQLSTATE 42P01)` + "\n" +
+		"LINE 2: select * from missing_table;\n" +
+		"                      ^\n"
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestWriteMigrationPgErrorWithColor(t *testing.T) {
+	mgErr, ele := testMigrationPgError(t)
+
+	var buf bytes.Buffer
+	writeMigrationPgError(&buf, mgErr, ele, true)
+
+	expected := ansiBoldRed + `001_broken.sql: ERROR: relation "missing_table" does not exist (SQLSTATE 42P01)` + ansiReset + "\n" +
+		"LINE 2: select * from " + ansiBoldRed + "m" + ansiReset + "issing_table;\n" +
+		"                      " + ansiBoldRed + "^" + ansiReset + "\n"
+	assert.Equal(t, expected, buf.String())
+}
+
+func TestColorEnabledNotTerminal(t *testing.T) {
+	f, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	require.NoError(t, err)
+	defer f.Close()
+
+	t.Setenv("NO_COLOR", "")
+	assert.False(t, colorEnabled(f), "regular file")
+
+	devNull, err := os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+	require.NoError(t, err)
+	defer devNull.Close()
+	assert.False(t, colorEnabled(devNull), "null device")
+}
+
+func TestColorEnabledTerminal(t *testing.T) {
+	t.Setenv("NO_COLOR", "")
+
+	devTTY, err := os.OpenFile("/dev/tty", os.O_WRONLY, 0)
+	if err != nil {
+		t.Skip("no terminal available")
+	}
+	defer devTTY.Close()
+	assert.True(t, colorEnabled(devTTY))
+
+	t.Setenv("NO_COLOR", "1")
+	assert.False(t, colorEnabled(devTTY), "NO_COLOR")
+	t.Setenv("NO_COLOR", "")
+
+	cliOptions.noColor = true
+	defer func() { cliOptions.noColor = false }()
+	assert.False(t, colorEnabled(devTTY), "--no-color")
+}
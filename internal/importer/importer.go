@@ -0,0 +1,263 @@
+// Package importer converts migrations from other migration tools into the tern migration format.
+package importer
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migration is a migration read from another migration tool.
+type Migration struct {
+	Version   int64  // Version in the source migration tool. It may be a timestamp.
+	Name      string // Name without the version and extension.
+	UpSQL     string
+	DownSQL   string
+	DisableTx bool
+}
+
+var (
+	golangMigratePattern = regexp.MustCompile(`\A(\d+)_(.+)\.(up|down)\.sql\z`)
+	gooseSQLPattern      = regexp.MustCompile(`\A(\d+)_(.+)\.sql\z`)
+	gooseGoPattern       = regexp.MustCompile(`\A(\d+)_(.+)\.go\z`)
+	gooseAnnotation      = regexp.MustCompile(`\A--\s*\+goose\s+(.+?)\s*\z`)
+)
+
+// ReadGolangMigrate reads the golang-migrate migrations in fsys. golang-migrate stores each migration in a pair of
+// VERSION_NAME.up.sql and VERSION_NAME.down.sql files. The returned warnings describe anything that could not be
+// converted exactly.
+func ReadGolangMigrate(fsys fs.FS) ([]*Migration, []string, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var warnings []string
+	migrationsByVersion := make(map[int64]*Migration)
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		matches := golangMigratePattern.FindStringSubmatch(e.Name())
+		if matches == nil {
+			warnings = append(warnings, fmt.Sprintf("ignoring %s: not a golang-migrate migration file", e.Name()))
+			continue
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+
+		m, present := migrationsByVersion[version]
+		if !present {
+			m = &Migration{Version: version, Name: matches[2]}
+			migrationsByVersion[version] = m
+		} else if m.Name != matches[2] {
+			return nil, nil, fmt.Errorf("duplicate migration version %d: %s and %s", version, m.Name, matches[2])
+		}
+
+		body, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if matches[3] == "up" {
+			m.UpSQL = strings.TrimSpace(string(body))
+		} else {
+			m.DownSQL = strings.TrimSpace(string(body))
+		}
+	}
+
+	migrations := sortMigrations(migrationsByVersion)
+	for _, m := range migrations {
+		if m.UpSQL == "" {
+			warnings = append(warnings, fmt.Sprintf("migration %d_%s has no up SQL", m.Version, m.Name))
+		}
+	}
+	warnings = append(warnings, checkTemplateSyntax(migrations)...)
+
+	return migrations, warnings, nil
+}
+
+// ReadGoose reads the goose migrations in fsys. goose stores each migration in a single VERSION_NAME.sql file with
+// -- +goose Up and -- +goose Down annotations. Go migrations cannot be converted and are skipped with a warning.
+func ReadGoose(fsys fs.FS) ([]*Migration, []string, error) {
+	entries, err := fs.ReadDir(fsys, ".")
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var warnings []string
+	migrationsByVersion := make(map[int64]*Migration)
+
+	for _, e := range entries {
+		if e.IsDir() {
+			continue
+		}
+
+		if gooseGoPattern.MatchString(e.Name()) {
+			warnings = append(warnings, fmt.Sprintf("skipping %s: Go migrations are not supported by tern", e.Name()))
+			continue
+		}
+
+		matches := gooseSQLPattern.FindStringSubmatch(e.Name())
+		if matches == nil {
+			warnings = append(warnings, fmt.Sprintf("ignoring %s: not a goose migration file", e.Name()))
+			continue
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+
+		if m, present := migrationsByVersion[version]; present {
+			return nil, nil, fmt.Errorf("duplicate migration version %d: %s and %s", version, m.Name, matches[2])
+		}
+
+		body, err := fs.ReadFile(fsys, e.Name())
+		if err != nil {
+			return nil, nil, err
+		}
+
+		m, parseWarnings, err := parseGoose(string(body))
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %w", e.Name(), err)
+		}
+		for _, w := range parseWarnings {
+			warnings = append(warnings, fmt.Sprintf("%s: %s", e.Name(), w))
+		}
+
+		m.Version = version
+		m.Name = matches[2]
+		migrationsByVersion[version] = m
+	}
+
+	migrations := sortMigrations(migrationsByVersion)
+	warnings = append(warnings, checkTemplateSyntax(migrations)...)
+
+	return migrations, warnings, nil
+}
+
+func parseGoose(body string) (*Migration, []string, error) {
+	m := &Migration{}
+	var warnings []string
+	var up, down strings.Builder
+	var current *strings.Builder
+	foundUp := false
+
+	for _, line := range strings.SplitAfter(body, "\n") {
+		matches := gooseAnnotation.FindStringSubmatch(strings.TrimSpace(line))
+		if matches == nil {
+			if current != nil {
+				current.WriteString(line)
+			}
+			continue
+		}
+
+		switch annotation := matches[1]; strings.ToLower(annotation) {
+		case "up":
+			current = &up
+			foundUp = true
+		case "down":
+			current = &down
+		case "statementbegin", "statementend":
+			// tern executes each migration as a whole so statement boundaries do not need to be marked.
+		case "no transaction":
+			m.DisableTx = true
+		default:
+			warnings = append(warnings, fmt.Sprintf("unsupported annotation %q was removed", annotation))
+		}
+	}
+
+	if !foundUp {
+		return nil, nil, fmt.Errorf("missing -- +goose Up annotation")
+	}
+
+	m.UpSQL = strings.TrimSpace(up.String())
+	m.DownSQL = strings.TrimSpace(down.String())
+
+	return m, warnings, nil
+}
+
+func sortMigrations(migrationsByVersion map[int64]*Migration) []*Migration {
+	migrations := make([]*Migration, 0, len(migrationsByVersion))
+	for _, m := range migrationsByVersion {
+		migrations = append(migrations, m)
+	}
+	sort.Slice(migrations, func(i, j int) bool { return migrations[i].Version < migrations[j].Version })
+	return migrations
+}
+
+// checkTemplateSyntax warns about migrations that contain "{{". tern evaluates migrations as templates so these will
+// likely need to be escaped.
+func checkTemplateSyntax(migrations []*Migration) []string {
+	var warnings []string
+	for _, m := range migrations {
+		if strings.Contains(m.UpSQL, "{{") || strings.Contains(m.DownSQL, "{{") {
+			warnings = append(warnings, fmt.Sprintf("migration %d_%s contains \"{{\" which tern will interpret as a template action", m.Version, m.Name))
+		}
+	}
+	return warnings
+}
+
+// Format returns m in the tern migration file format.
+func Format(m *Migration) string {
+	var sb strings.Builder
+	disableTx := ""
+	if m.DisableTx {
+		disableTx = "---- tern: disable-tx ----\n"
+	}
+
+	sb.WriteString(disableTx)
+	sb.WriteString(m.UpSQL)
+	sb.WriteString("\n")
+
+	if m.DownSQL != "" {
+		sb.WriteString("\n---- create above / drop below ----\n\n")
+		sb.WriteString(disableTx)
+		sb.WriteString(m.DownSQL)
+		sb.WriteString("\n")
+	}
+
+	return sb.String()
+}
+
+// Write writes migrations to dir in the tern format. Migrations are renumbered sequentially starting with 1 in their
+// original order. It returns the names of the files written. Existing files are never overwritten.
+func Write(dir string, migrations []*Migration) ([]string, error) {
+	err := os.MkdirAll(dir, os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+
+	var filenames []string
+	for i, m := range migrations {
+		filename := fmt.Sprintf("%03d_%s.sql", i+1, m.Name)
+		f, err := os.OpenFile(filepath.Join(dir, filename), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o666)
+		if err != nil {
+			return filenames, err
+		}
+
+		_, err = f.WriteString(Format(m))
+		closeErr := f.Close()
+		if err != nil {
+			return filenames, err
+		}
+		if closeErr != nil {
+			return filenames, closeErr
+		}
+
+		filenames = append(filenames, filename)
+	}
+
+	return filenames, nil
+}
@@ -0,0 +1,94 @@
+package importer_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/jackc/tern/v2/internal/importer"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReadGolangMigrate(t *testing.T) {
+	migrations, warnings, err := importer.ReadGolangMigrate(os.DirFS("testdata/golang-migrate"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"ignoring README.md: not a golang-migrate migration file"}, warnings)
+
+	require.Len(t, migrations, 2)
+
+	assert.EqualValues(t, 20230101120000, migrations[0].Version)
+	assert.Equal(t, "create_users", migrations[0].Name)
+	assert.Equal(t, "create table users(id serial primary key);", migrations[0].UpSQL)
+	assert.Equal(t, "drop table users;", migrations[0].DownSQL)
+
+	assert.EqualValues(t, 20230102120000, migrations[1].Version)
+	assert.Equal(t, "add_index", migrations[1].Name)
+	assert.Equal(t, "create index concurrently users_id_idx on users(id);", migrations[1].UpSQL)
+	assert.Equal(t, "", migrations[1].DownSQL)
+}
+
+func TestReadGoose(t *testing.T) {
+	migrations, warnings, err := importer.ReadGoose(os.DirFS("testdata/goose"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"skipping 00004_seed.go: Go migrations are not supported by tern"}, warnings)
+
+	require.Len(t, migrations, 3)
+
+	assert.EqualValues(t, 1, migrations[0].Version)
+	assert.Equal(t, "create_users", migrations[0].Name)
+	assert.Equal(t, "create table users(id serial primary key);", migrations[0].UpSQL)
+	assert.Equal(t, "drop table users;", migrations[0].DownSQL)
+	assert.False(t, migrations[0].DisableTx)
+
+	assert.EqualValues(t, 2, migrations[1].Version)
+	assert.Equal(t, "add_function", migrations[1].Name)
+	assert.Equal(t, "create function one() returns int language sql as $$ select 1 $$;", migrations[1].UpSQL)
+	assert.Equal(t, "drop function one();", migrations[1].DownSQL)
+
+	assert.EqualValues(t, 3, migrations[2].Version)
+	assert.Equal(t, "add_index", migrations[2].Name)
+	assert.Equal(t, "create index concurrently users_id_idx on users(id);", migrations[2].UpSQL)
+	assert.Equal(t, "", migrations[2].DownSQL)
+	assert.True(t, migrations[2].DisableTx)
+}
+
+func TestReadGooseUnsupportedAnnotation(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "001_envsub.sql"), []byte("-- +goose ENVSUB ON\n-- +goose Up\nselect 1;\n"), 0o644)
+	require.NoError(t, err)
+
+	migrations, warnings, err := importer.ReadGoose(os.DirFS(dir))
+	require.NoError(t, err)
+	require.Len(t, migrations, 1)
+	assert.Equal(t, []string{`001_envsub.sql: unsupported annotation "ENVSUB ON" was removed`}, warnings)
+}
+
+func TestFormat(t *testing.T) {
+	assert.Equal(t, "create table t(id int);\n\n---- create above / drop below ----\n\ndrop table t;\n",
+		importer.Format(&importer.Migration{UpSQL: "create table t(id int);", DownSQL: "drop table t;"}))
+
+	assert.Equal(t, "drop table t;\n",
+		importer.Format(&importer.Migration{UpSQL: "drop table t;"}))
+
+	assert.Equal(t, "---- tern: disable-tx ----\ncreate index concurrently i on t(id);\n\n---- create above / drop below ----\n\n---- tern: disable-tx ----\ndrop index concurrently i;\n",
+		importer.Format(&importer.Migration{UpSQL: "create index concurrently i on t(id);", DownSQL: "drop index concurrently i;", DisableTx: true}))
+}
+
+func TestWrite(t *testing.T) {
+	migrations, _, err := importer.ReadGolangMigrate(os.DirFS("testdata/golang-migrate"))
+	require.NoError(t, err)
+
+	dir := filepath.Join(t.TempDir(), "migrations")
+	filenames, err := importer.Write(dir, migrations)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"001_create_users.sql", "002_add_index.sql"}, filenames)
+
+	body, err := os.ReadFile(filepath.Join(dir, "001_create_users.sql"))
+	require.NoError(t, err)
+	assert.Equal(t, "create table users(id serial primary key);\n\n---- create above / drop below ----\n\ndrop table users;\n", string(body))
+
+	// Existing files are not overwritten
+	_, err = importer.Write(dir, migrations)
+	require.Error(t, err)
+}
@@ -0,0 +1 @@
+create table users(id serial primary key);
@@ -0,0 +1 @@
+create index concurrently users_id_idx on users(id);
@@ -0,0 +1,5 @@
+-- +goose Up
+create table users(id serial primary key);
+
+-- +goose Down
+drop table users;
@@ -0,0 +1,7 @@
+-- +goose Up
+-- +goose StatementBegin
+create function one() returns int language sql as $$ select 1 $$;
+-- +goose StatementEnd
+
+-- +goose Down
+drop function one();
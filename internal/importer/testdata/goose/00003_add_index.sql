@@ -0,0 +1,3 @@
+-- +goose NO TRANSACTION
+-- +goose Up
+create index concurrently users_id_idx on users(id);
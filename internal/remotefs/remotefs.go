@@ -0,0 +1,305 @@
+// Package remotefs fetches an archive of migrations from a URL so it can be used as an fs.FS.
+package remotefs
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Fetch downloads the tar, tar.gz, or zip archive at url and returns its contents as an fs.FS. The archive format is
+// determined by the extension of the URL path. If the archive contains a single top level directory that directory is
+// the root of the returned fs.FS.
+//
+// If checksum is not empty it must be the hex encoded SHA-256 of the archive. The archive is cached in cacheDir by
+// checksum so it is only downloaded once. A cached archive is verified against the checksum every time it is used.
+// Without a checksum the archive is always downloaded. If cacheDir is empty a tern-remotefs directory in the user's
+// cache directory is used. The cache directory is created readable only by the current user.
+//
+// The archive is extracted into a new temporary directory on every call. cleanup removes it and must be called when
+// the returned fs.FS is no longer needed.
+func Fetch(ctx context.Context, url, checksum, cacheDir string) (fsys fs.FS, cleanup func(), err error) {
+	format, err := archiveFormat(url)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if cacheDir == "" {
+		userCacheDir, err := os.UserCacheDir()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to find cache directory: %w", err)
+		}
+		cacheDir = filepath.Join(userCacheDir, "tern-remotefs")
+	}
+	err = os.MkdirAll(cacheDir, 0o700)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	checksum = strings.ToLower(checksum)
+	if checksum != "" {
+		archivePath := filepath.Join(cacheDir, checksum+format)
+		if actual, err := fileChecksum(archivePath); err == nil && actual == checksum {
+			return extract(archivePath, format, cacheDir)
+		}
+	}
+
+	// Download to a new file so a partial or unverified download is never used from the cache.
+	f, err := os.CreateTemp(cacheDir, "download-*"+format)
+	if err != nil {
+		return nil, nil, err
+	}
+	downloadPath := f.Name()
+	f.Close()
+	defer os.Remove(downloadPath)
+
+	err = download(ctx, url, downloadPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	actual, err := fileChecksum(downloadPath)
+	if err != nil {
+		return nil, nil, err
+	}
+	if checksum != "" && actual != checksum {
+		return nil, nil, fmt.Errorf("checksum mismatch for %s: expected %s, got %s", url, checksum, actual)
+	}
+
+	fsys, cleanup, err = extract(downloadPath, format, cacheDir)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if checksum != "" {
+		// Caching is only an optimization so a failure to cache is not an error.
+		os.Rename(downloadPath, filepath.Join(cacheDir, checksum+format))
+	}
+
+	return fsys, cleanup, nil
+}
+
+func archiveFormat(url string) (string, error) {
+	p := url
+	if i := strings.IndexAny(p, "?#"); i != -1 {
+		p = p[:i]
+	}
+
+	for _, ext := range []string{".tar.gz", ".tgz", ".tar", ".zip"} {
+		if strings.HasSuffix(p, ext) {
+			return ext, nil
+		}
+	}
+
+	return "", fmt.Errorf("unsupported archive format for %s (must be .tar, .tar.gz, .tgz, or .zip)", url)
+}
+
+func download(ctx context.Context, url, dest string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to download %s: %s", url, resp.Status)
+	}
+
+	f, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, resp.Body)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// extract extracts the archive at archivePath into a new temporary directory in cacheDir and returns it as an fs.FS
+// and a function that removes the directory. Extracted files are never reused as the directory could have been
+// modified after it was extracted.
+func extract(archivePath, format, cacheDir string) (fs.FS, func(), error) {
+	dir, err := os.MkdirTemp(cacheDir, "extract-*")
+	if err != nil {
+		return nil, nil, err
+	}
+	cleanup := func() { os.RemoveAll(dir) }
+
+	if format == ".zip" {
+		err = extractZip(archivePath, dir)
+	} else {
+		err = extractTar(archivePath, format, dir)
+	}
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+
+	root := dir
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if len(entries) == 1 && entries[0].IsDir() {
+		root = filepath.Join(dir, entries[0].Name())
+	}
+
+	return os.DirFS(root), cleanup, nil
+}
+
+// destPath returns the path name should be extracted to in dir. It returns an error if name would be outside of dir.
+func destPath(dir, name string) (string, error) {
+	name = strings.TrimSuffix(strings.TrimPrefix(name, "./"), "/")
+	if name == "" || name == "." {
+		return dir, nil
+	}
+	if !fs.ValidPath(name) || strings.Contains(name, `\`) {
+		return "", fmt.Errorf("invalid path in archive: %s", name)
+	}
+	return filepath.Join(dir, filepath.FromSlash(name)), nil
+}
+
+func extractTar(archivePath, format, dir string) error {
+	f, err := os.Open(archivePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if format != ".tar" {
+		gr, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gr.Close()
+		r = gr
+	}
+
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			p, err := destPath(dir, hdr.Name)
+			if err != nil {
+				return err
+			}
+			err = os.MkdirAll(p, os.ModePerm)
+			if err != nil {
+				return err
+			}
+		case tar.TypeReg:
+			p, err := destPath(dir, hdr.Name)
+			if err != nil {
+				return err
+			}
+			err = writeFile(p, tr)
+			if err != nil {
+				return err
+			}
+		default:
+			// Links and other special files are not needed for migrations and could point outside of dir.
+		}
+	}
+}
+
+func extractZip(archivePath, dir string) error {
+	zr, err := zip.OpenReader(archivePath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	for _, zf := range zr.File {
+		p, err := destPath(dir, zf.Name)
+		if err != nil {
+			return err
+		}
+
+		if zf.FileInfo().IsDir() {
+			err = os.MkdirAll(p, os.ModePerm)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		if !zf.Mode().IsRegular() {
+			continue
+		}
+
+		r, err := zf.Open()
+		if err != nil {
+			return err
+		}
+		err = writeFile(p, r)
+		r.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeFile(p string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(p), os.ModePerm)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(p, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o666)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
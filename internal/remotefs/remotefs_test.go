@@ -0,0 +1,183 @@
+package remotefs_test
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/fs"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/jackc/tern/v2/internal/remotefs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var migrationFiles = map[string]string{
+	"migrations/001_create_t1.sql":         "create table t1(id serial primary key);",
+	"migrations/shared/columns.sql":        "id serial primary key",
+	"migrations/002_create_t2.sql":         "create table t2({{ template \"shared/columns.sql\" }});",
+	"migrations/003_irreversible.down.sql": "",
+}
+
+func tarGz(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	gw := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gw)
+	for name, body := range files {
+		err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0o644, Size: int64(len(body)), Typeflag: tar.TypeReg})
+		require.NoError(t, err)
+		_, err = tw.Write([]byte(body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, gw.Close())
+	return buf.Bytes()
+}
+
+func zipArchive(t *testing.T, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, body := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(body))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func checksum(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func serve(t *testing.T, archives map[string][]byte) (*httptest.Server, *int) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		archive, ok := archives[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write(archive)
+	}))
+	t.Cleanup(server.Close)
+	return server, &requests
+}
+
+func TestFetch(t *testing.T) {
+	tarGzArchive := tarGz(t, migrationFiles)
+	server, requests := serve(t, map[string][]byte{
+		"/migrations.tar.gz": tarGzArchive,
+		"/migrations.zip":    zipArchive(t, migrationFiles),
+	})
+
+	for _, url := range []string{server.URL + "/migrations.tar.gz", server.URL + "/migrations.zip"} {
+		fsys, cleanup, err := remotefs.Fetch(context.Background(), url, "", t.TempDir())
+		require.NoError(t, err)
+		defer cleanup()
+
+		body, err := fs.ReadFile(fsys, "002_create_t2.sql")
+		require.NoError(t, err)
+		assert.Equal(t, migrationFiles["migrations/002_create_t2.sql"], string(body))
+
+		body, err = fs.ReadFile(fsys, "shared/columns.sql")
+		require.NoError(t, err)
+		assert.Equal(t, migrationFiles["migrations/shared/columns.sql"], string(body))
+	}
+
+	// With a checksum the download is cached.
+	cacheDir := t.TempDir()
+	*requests = 0
+	for i := 0; i < 2; i++ {
+		fsys, cleanup, err := remotefs.Fetch(context.Background(), server.URL+"/migrations.tar.gz", checksum(tarGzArchive), cacheDir)
+		require.NoError(t, err)
+		_, err = fs.Stat(fsys, "001_create_t1.sql")
+		require.NoError(t, err)
+		cleanup()
+	}
+	assert.Equal(t, 1, *requests)
+
+	// Only the verified archive is kept in the cache.
+	entries, err := os.ReadDir(cacheDir)
+	require.NoError(t, err)
+	require.Len(t, entries, 1)
+	assert.Equal(t, checksum(tarGzArchive)+".tar.gz", entries[0].Name())
+}
+
+func TestFetchIgnoresPreexistingExtraction(t *testing.T) {
+	tarGzArchive := tarGz(t, migrationFiles)
+	server, _ := serve(t, map[string][]byte{"/migrations.tar.gz": tarGzArchive})
+
+	// A directory named by the checksum must not be mistaken for the contents of the archive.
+	cacheDir := t.TempDir()
+	planted := filepath.Join(cacheDir, checksum(tarGzArchive), "migrations")
+	require.NoError(t, os.MkdirAll(planted, 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(planted, "001_create_t1.sql"), []byte("drop table t1;"), 0o644))
+
+	fsys, cleanup, err := remotefs.Fetch(context.Background(), server.URL+"/migrations.tar.gz", checksum(tarGzArchive), cacheDir)
+	require.NoError(t, err)
+	defer cleanup()
+
+	body, err := fs.ReadFile(fsys, "001_create_t1.sql")
+	require.NoError(t, err)
+	assert.Equal(t, migrationFiles["migrations/001_create_t1.sql"], string(body))
+}
+
+func TestFetchCacheDirPermissions(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("permission bits are not supported on Windows")
+	}
+
+	server, _ := serve(t, map[string][]byte{"/migrations.tar.gz": tarGz(t, migrationFiles)})
+
+	cacheDir := filepath.Join(t.TempDir(), "cache")
+	_, cleanup, err := remotefs.Fetch(context.Background(), server.URL+"/migrations.tar.gz", "", cacheDir)
+	require.NoError(t, err)
+	defer cleanup()
+
+	fi, err := os.Stat(cacheDir)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0o700), fi.Mode().Perm())
+}
+
+func TestFetchChecksumMismatch(t *testing.T) {
+	server, _ := serve(t, map[string][]byte{"/migrations.tar.gz": tarGz(t, migrationFiles)})
+
+	_, _, err := remotefs.Fetch(context.Background(), server.URL+"/migrations.tar.gz", checksum([]byte("other")), t.TempDir())
+	require.ErrorContains(t, err, "checksum mismatch")
+}
+
+func TestFetchPathTraversal(t *testing.T) {
+	server, _ := serve(t, map[string][]byte{
+		"/evil.tar.gz": tarGz(t, map[string]string{"../evil.sql": "drop table t1;"}),
+		"/evil.zip":    zipArchive(t, map[string]string{"../evil.sql": "drop table t1;"}),
+	})
+
+	_, _, err := remotefs.Fetch(context.Background(), server.URL+"/evil.tar.gz", "", t.TempDir())
+	require.ErrorContains(t, err, "invalid path in archive")
+
+	_, _, err = remotefs.Fetch(context.Background(), server.URL+"/evil.zip", "", t.TempDir())
+	require.ErrorContains(t, err, "invalid path in archive")
+}
+
+func TestFetchErrors(t *testing.T) {
+	server, _ := serve(t, map[string][]byte{})
+
+	_, _, err := remotefs.Fetch(context.Background(), server.URL+"/migrations.rar", "", t.TempDir())
+	require.ErrorContains(t, err, "unsupported archive format")
+
+	_, _, err = remotefs.Fetch(context.Background(), server.URL+"/missing.tar.gz", "", t.TempDir())
+	require.ErrorContains(t, err, "404 Not Found")
+}
@@ -4,26 +4,37 @@ import (
 	"bufio"
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"os/user"
 	"path/filepath"
 	"regexp"
+	"runtime"
+	"slices"
 	"sort"
 	"strconv"
 	"strings"
 	"text/template"
 	"time"
+	"unicode"
 
 	"github.com/Masterminds/sprig/v3"
 	"github.com/jackc/pgx/v5"
+	"github.com/jackc/tern/v2/internal/importer"
+	"github.com/jackc/tern/v2/internal/remotefs"
 	"github.com/jackc/tern/v2/migrate"
 	"github.com/spf13/cobra"
 	ini "github.com/vaughan0/go-ini"
+	"golang.org/x/term"
+	"gopkg.in/yaml.v3"
 )
 
 const VERSION = "2.3.2"
@@ -39,6 +50,30 @@ var defaultConf = `[database]
 # password =
 # version_table = public.schema_version
 #
+# history_table records every migration that is run. It is disabled by default.
+# history_table = public.schema_version_history
+#
+# lock_id_from_table_name derives the advisory lock that prevents concurrent
+# migrations from version_table so migrations of different schemas do not
+# wait for each other. Every run against the same version table must use the
+# same setting.
+# lock_id_from_table_name = false
+#
+# allow_down_to_zero = false refuses to migrate down to version 0. Use it to
+# protect production databases from tern migrate -d 0 and tern reset.
+# allow_down_to_zero = true
+#
+# guard_sql is a query that must return true before any migrations are run.
+# guard_message is reported when it does not.
+# guard_sql = select not exists (select 1 from deployments where active)
+# guard_message = a deployment is in progress
+#
+# notify_channel is notified with pg_notify after migrating. The payload is the
+# new version. By default it is only notified when migrations were run. Set
+# notify_always to also notify when there was nothing to migrate.
+# notify_channel = tern_migrated
+# notify_always = false
+#
 # sslmode generally matches the behavior described in:
 # http://www.postgresql.org/docs/9.4/static/libpq-ssl.html#LIBPQ-SSL-PROTECTION
 #
@@ -49,6 +84,19 @@ var defaultConf = `[database]
 #
 # sslrootcert is generally used with sslmode=verify-full
 # sslrootcert = /path/to/root/ca
+#
+# sslcert and sslkey are used for client certificate authentication
+# sslcert = /path/to/client/cert
+# sslkey = /path/to/client/key
+#
+# Other libpq connection parameters such as connect_timeout,
+# target_session_attrs, and sslpassword are also supported
+# connect_timeout = 10
+
+# Run time parameters set on the connection
+# [runtime_params]
+# timezone = UTC
+# statement_timeout = 60s
 
 # Proxy the above database connection via SSH
 # [ssh-tunnel]
@@ -58,6 +106,10 @@ var defaultConf = `[database]
 # user =
 # password is not required if using SSH agent authentication
 # password =
+# An SSH agent is used when available. no_agent disables it. agent_sock is the
+# path of the agent socket (default is $SSH_AUTH_SOCK).
+# no_agent = false
+# agent_sock =
 
 [data]
 # Any fields in the data section are available in migration templates
@@ -77,6 +129,22 @@ create table people(
 drop table people;
 `
 
+var sampleCodePackageInstall = `{{/*
+This is the install.sql of a code package. It must completely drop and
+recreate the code in the package so it can be installed again after any
+change. Other .sql files in this directory can be included as templates.
+Alternatively, list the files of the package in install order in deps.txt.
+
+This comment is removed when the code package is compiled. e.g.
+
+drop schema if exists code cascade;
+create schema code;
+
+{{ template "functions.sql" . }}
+{{ template "views.sql" . }}
+*/}}
+`
+
 var newMigrationText = `-- Write your migrate up statements here
 
 ---- create above / drop below ----
@@ -89,28 +157,98 @@ type Config struct {
 	ConnConfig    pgx.ConnConfig
 	ConnString    string
 	PGEnvvars     map[string]string
+	RuntimeParams map[string]string
 	VersionTable  string
+	HistoryTable  string
+	GuardSQL      string
+	GuardMessage  string
+	NotifyChannel string
+	NotifyAlways  bool
+
+	// LockIDFromTableName derives the advisory lock id from VersionTable instead of using the fixed default.
+	LockIDFromTableName bool
+
+	// AllowDownToZero allows migrating down to version 0. It is true unless allow_down_to_zero is false.
+	AllowDownToZero bool
+
 	Data          map[string]interface{}
 	SSHConnConfig SSHConnConfig
+
+	// TemplateDelims are the left and right delimiters of migration templates. Empty means the default {{ and }}.
+	TemplateDelims [2]string
 }
 
 var cliOptions struct {
-	destinationVersion string
-	currentVersion     string
-	migrationsPath     string
-	configPaths        []string
-	editNewMigration   bool
-	outputFile         string // used for gengen or print-migrations
-
-	connString   string
-	host         string
-	port         uint16
-	user         string
-	password     string
-	database     string
-	sslmode      string
-	sslrootcert  string
-	versionTable string
+	destinationVersion      string
+	currentVersion          string
+	migrationsPath          string
+	configPaths             []string
+	editNewMigration        bool
+	newFromStdin            bool
+	newFromFile             string
+	outputFile              string // used for gengen or print-migrations
+	generatedAt             string // used for gengen or print-migrations
+	continueOnError         bool
+	transactionPerStatement bool
+	disableTx               bool
+	skipReadOnlyCheck       bool
+	quiet                   bool
+	showSQLOnErrorOnly      bool
+	environment             string
+	failOnExcludedEnv       bool
+	includeTags             []string
+	fromVersion             int32
+	initialVersion          int32
+	allowDownToZero         bool
+	yes                     bool
+	padWidth                int
+	verifyState             bool
+	metricsFile             string
+	dryRun                  bool
+	force                   bool
+	excludeTags             []string
+	maxRetries              int
+	retryBackoff            time.Duration
+	migrationTimeout        time.Duration
+	annotateApplicationName bool
+	checkUpdates            bool
+	codeEntry               string
+	codeAll                 bool
+	updateCheckTimeout      time.Duration
+	since                   string
+	migrationsURL           string
+	migrationsSHA256        string
+	limit                   int
+	maxSteps                int32
+	repeatableOnly          bool
+	setVersion              int32
+	detect                  bool
+	importFrom              string
+	importTo                string
+	format                  string
+	graphFormat             string
+	errorFormat             string
+	noColor                 bool
+	lineEndings             string
+	initTemplateDir         string
+	initPasswordEnv         string
+
+	connString          string
+	host                string
+	port                uint16
+	user                string
+	password            string
+	database            string
+	sslmode             string
+	sslrootcert         string
+	sslcert             string
+	sslkey              string
+	connectTimeout      time.Duration
+	versionTable        string
+	historyTable        string
+	lockIDFromTableName bool
+	runtimeParams       []string
+	dataValues          []string
 
 	sshHost       string
 	sshPort       string
@@ -118,6 +256,8 @@ var cliOptions struct {
 	sshPassphrase string
 	sshUser       string
 	sshPassword   string
+	sshNoAgent    bool
+	sshAgentSock  string
 }
 
 func (c *Config) Validate() error {
@@ -151,15 +291,44 @@ func main() {
 	cmdInit := &cobra.Command{
 		Use:   "init DIRECTORY",
 		Short: "Initialize a new tern project",
-		Long:  "Initialize a new tern project in DIRECTORY",
-		Run:   Init,
-	}
+		Long: `Initialize a new tern project in DIRECTORY.
+
+By default a tern.conf and a sample migration are written. If --template-dir
+or the TERN_INIT_TEMPLATE_DIR environment variable is set the files in that
+directory are copied instead.
+
+Connection settings can be given to write a tern.conf that is immediately
+usable. Use --password-env to have the config read the password from an
+environment variable instead of storing it in the file.
+  e.g. tern init --host localhost --database app --password-env APP_DB_PASSWORD
+`,
+		Run: Init,
+	}
+	cmdInit.Flags().StringVarP(&cliOptions.initTemplateDir, "template-dir", "", "", "directory of starter files to copy instead of the defaults")
+	cmdInit.Flags().StringVarP(&cliOptions.connString, "conn-string", "", "", "database connection string to write to the config")
+	cmdInit.Flags().StringVarP(&cliOptions.host, "host", "", "", "database host to write to the config")
+	cmdInit.Flags().Uint16VarP(&cliOptions.port, "port", "", 0, "database port to write to the config")
+	cmdInit.Flags().StringVarP(&cliOptions.user, "user", "", "", "database user to write to the config")
+	cmdInit.Flags().StringVarP(&cliOptions.password, "password", "", "", "database password to write to the config (prefer --password-env)")
+	cmdInit.Flags().StringVarP(&cliOptions.initPasswordEnv, "password-env", "", "", "environment variable the config reads the database password from")
+	cmdInit.Flags().StringVarP(&cliOptions.database, "database", "", "", "database name to write to the config")
+	cmdInit.Flags().StringVarP(&cliOptions.sslmode, "sslmode", "", "", "SSL mode to write to the config")
+	cmdInit.Flags().StringVarP(&cliOptions.sslrootcert, "sslrootcert", "", "", "SSL root certificate to write to the config")
+	cmdInit.Flags().StringVarP(&cliOptions.sslcert, "sslcert", "", "", "SSL client certificate to write to the config")
+	cmdInit.Flags().StringVarP(&cliOptions.sslkey, "sslkey", "", "", "SSL client key to write to the config")
+	cmdInit.Flags().StringVarP(&cliOptions.versionTable, "version-table", "", "", "version table name to write to the config")
+	addLineEndingsFlagToCommand(cmdInit)
 
 	cmdMigrate := &cobra.Command{
-		Use:   "migrate",
+		Use:   "migrate [redo-last]",
 		Short: "Migrate the database",
 		Long: `Migrate the database to destination migration version.
 
+With the redo-last argument the last applied migration is migrated down and
+then up again. This is the same as -d -+1, but it first checks that the
+migration is reversible and prints its name.
+  e.g. tern migrate redo-last
+
 Destination migration version can be one of the following value types:
 
 An integer:
@@ -183,10 +352,44 @@ The word "last":
   never needed to specify directly.
   e.g. tern migrate
   e.g. tern migrate -d last
+
+The number of migrations applied when migrating to the most recent migration
+can be limited with --max-steps. It cannot be combined with --destination.
+  e.g. tern migrate --max-steps 2
+
+Only the repeatable migrations that have changed are run with
+--repeatable-only. The version is not changed.
+  e.g. tern migrate --repeatable-only
 		`,
-		Run: Migrate,
+		Args:      cobra.MatchAll(cobra.MaximumNArgs(1), cobra.OnlyValidArgs),
+		ValidArgs: []string{"redo-last"},
+		Run:       Migrate,
 	}
 	cmdMigrate.Flags().StringVarP(&cliOptions.destinationVersion, "destination", "d", "last", "destination migration version")
+	cmdMigrate.Flags().Int32VarP(&cliOptions.maxSteps, "max-steps", "", 0, "maximum number of migrations to apply when migrating to the last migration")
+	cmdMigrate.Flags().BoolVarP(&cliOptions.repeatableOnly, "repeatable-only", "", false, "only run repeatable migrations that have changed")
+	cmdMigrate.Flags().BoolVarP(&cliOptions.continueOnError, "continue-on-error", "", false, "attempt all migrations and report every failure (development only)")
+	cmdMigrate.Flags().StringVarP(&cliOptions.migrationsURL, "migrations-url", "", "", "URL of a .tar, .tar.gz, .tgz, or .zip archive of migrations to use instead of --migrations")
+	cmdMigrate.Flags().StringVarP(&cliOptions.migrationsSHA256, "migrations-sha256", "", "", "expected SHA-256 of the --migrations-url archive")
+	cmdMigrate.Flags().BoolVarP(&cliOptions.quiet, "quiet", "q", false, "do not print each migration as it is run")
+	cmdMigrate.Flags().BoolVarP(&cliOptions.showSQLOnErrorOnly, "show-sql-on-error-only", "", false, "only print migration SQL when the migration fails")
+	cmdMigrate.Flags().StringVarP(&cliOptions.environment, "env", "", "", "environment being migrated for migrations restricted with the environments magic comment")
+	cmdMigrate.Flags().BoolVarP(&cliOptions.failOnExcludedEnv, "fail-on-excluded-env", "", false, "fail instead of skipping a migration that is not allowed to run in --env")
+	cmdMigrate.Flags().StringSliceVarP(&cliOptions.includeTags, "tags", "", nil, "only run tagged migrations with one of these tags (untagged migrations always run)")
+	cmdMigrate.Flags().StringSliceVarP(&cliOptions.excludeTags, "exclude-tags", "", nil, "skip tagged migrations with any of these tags")
+	addAllowDownToZeroFlagToCommand(cmdMigrate)
+	cmdMigrate.Flags().Int32VarP(&cliOptions.initialVersion, "initial-version", "", 0, "version to initialize the version table to if it does not exist (baselining an existing database)")
+	cmdMigrate.Flags().Int32VarP(&cliOptions.fromVersion, "from", "", 0, "plan as if the current version is this version instead of the version in the version table (disaster recovery)")
+	cmdMigrate.Flags().StringVarP(&cliOptions.metricsFile, "metrics-file", "", "", "write Prometheus text format metrics of the run to this file (e.g. for the node_exporter textfile collector)")
+	cmdMigrate.Flags().BoolVarP(&cliOptions.verifyState, "verify-state", "", false, "before migrating check for schema drift by running the down and up SQL of the current migration in a rolled back transaction")
+	cmdMigrate.Flags().BoolVarP(&cliOptions.force, "force", "", false, "allow migrating down from the version given with --from")
+	cmdMigrate.Flags().IntVarP(&cliOptions.maxRetries, "max-retries", "", 0, "times to retry a transactional migration that fails with a deadlock or serialization failure")
+	cmdMigrate.Flags().DurationVarP(&cliOptions.retryBackoff, "retry-backoff", "", time.Second, "time to wait before the first retry (doubled for each retry)")
+	cmdMigrate.Flags().DurationVarP(&cliOptions.migrationTimeout, "migration-timeout", "", 0, "cancel a migration that runs longer than this (e.g. 10m)")
+	cmdMigrate.Flags().BoolVarP(&cliOptions.annotateApplicationName, "annotate-application-name", "", false, "set application_name to include the name of the running migration (e.g. tern:003_create_orders)")
+	cmdMigrate.Flags().StringVarP(&cliOptions.errorFormat, "error-format", "", "text", "migration error output format (text or json)")
+	addNoColorFlagToCommand(cmdMigrate)
+	cmdMigrate.Flags().BoolVarP(&cliOptions.skipReadOnlyCheck, "skip-read-only-check", "", false, "do not check that the database is writable before migrating")
 	addConfigFlagsToCommand(cmdMigrate)
 
 	cmdCode := &cobra.Command{
@@ -200,15 +403,60 @@ The word "last":
 		Args:  cobra.ExactArgs(1),
 		Run:   InstallCode,
 	}
+	cmdCodeInstall.Flags().BoolVarP(&cliOptions.transactionPerStatement, "transaction-per-statement", "", false, "run and commit each statement on its own instead of in one transaction")
+	cmdCodeInstall.Flags().StringVarP(&cliOptions.errorFormat, "error-format", "", "text", "error output format (text or json)")
+	addNoColorFlagToCommand(cmdCodeInstall)
+	cmdCodeInstall.Flags().BoolVarP(&cliOptions.continueOnError, "continue-on-error", "", false, "with --transaction-per-statement, run the remaining statements after a failure")
+	cmdCodeInstall.Flags().BoolVarP(&cliOptions.dryRun, "dry-run", "", false, "print the SQL and run it in a transaction that is rolled back instead of committed")
 	addCoreConfigFlagsToCommand(cmdCodeInstall)
 
+	cmdExec := &cobra.Command{
+		Use:   "exec FILE",
+		Short: "Execute a SQL file under the migration lock",
+		Long: `Execute a SQL file under the migration lock
+
+The file is evaluated as a template with the data from the config file and
+run in a transaction while holding the same advisory lock as migrations so it
+cannot run at the same time as a migration. This is useful for one-off
+maintenance scripts. Use --disable-tx to run each statement on its own without
+a transaction.
+`,
+		Args: cobra.ExactArgs(1),
+		Run:  Exec,
+	}
+	cmdExec.Flags().BoolVarP(&cliOptions.disableTx, "disable-tx", "", false, "run each statement on its own without a transaction")
+	cmdExec.Flags().StringVarP(&cliOptions.errorFormat, "error-format", "", "text", "error output format (text or json)")
+	addNoColorFlagToCommand(cmdExec)
+	addCoreConfigFlagsToCommand(cmdExec)
+
 	cmdCodeCompile := &cobra.Command{
 		Use:   "compile PATH",
 		Short: "Compile a code package into SQL",
-		Args:  cobra.ExactArgs(1),
-		Run:   CompileCode,
+		Long: `Compile a code package into SQL.
+
+By default the SQL that code install would run is printed: install.sql
+followed by the files in deps.txt. Use --entry to print a single file of the
+code package instead or --all to print every file with a header naming it.
+`,
+		Args: cobra.ExactArgs(1),
+		Run:  CompileCode,
+	}
+	cmdCodeCompile.Flags().StringSliceVarP(&cliOptions.configPaths, "config", "c", []string{}, "config file or directory of *.conf files (default is ./tern.conf and ./tern.conf.d)")
+	addDataFlagToCommand(cmdCodeCompile)
+	cmdCodeCompile.Flags().StringVarP(&cliOptions.codeEntry, "entry", "", "", "file in the code package to compile (e.g. install.sql)")
+	cmdCodeCompile.Flags().BoolVarP(&cliOptions.codeAll, "all", "", false, "compile every file in the code package")
+
+	cmdCodeNew := &cobra.Command{
+		Use:   "new PATH",
+		Short: "Create a new code package",
+		Long: `Create a new code package.
+
+The directory PATH is created if it does not exist and a starter install.sql
+is written to it. It is an error if install.sql already exists.
+`,
+		Args: cobra.ExactArgs(1),
+		Run:  NewCode,
 	}
-	cmdCodeCompile.Flags().StringSliceVarP(&cliOptions.configPaths, "config", "c", []string{}, "config path (default is ./tern.conf)")
 
 	cmdCodeSnapshot := &cobra.Command{
 		Use:   "snapshot PATH",
@@ -225,6 +473,101 @@ The word "last":
 	}
 	addConfigFlagsToCommand(cmdStatus)
 
+	cmdTestRoundtrip := &cobra.Command{
+		Use:   "test-roundtrip",
+		Short: "Check that down migrations reverse their up migrations",
+		Long: `Check that down migrations reverse their up migrations.
+
+All migrations are run up to the last migration and then down to version 0.
+Any migration that fails is reported. Afterwards the schemas, relations,
+functions, types, and extensions in the database are compared with those that
+existed before the up migrations were run. Anything left over usually means a
+down migration is missing a drop.
+
+This is intended for a throwaway database. It refuses to run against a database
+that already contains objects unless --force is given.
+  e.g. tern test-roundtrip --database roundtrip_test
+`,
+		Run: RunTestRoundtrip,
+	}
+	cmdTestRoundtrip.Flags().BoolVarP(&cliOptions.force, "force", "", false, "run even if the database is not empty")
+	addConfigFlagsToCommand(cmdTestRoundtrip)
+
+	cmdReset := &cobra.Command{
+		Use:   "reset",
+		Short: "Migrate down to version 0 and back up to the last migration",
+		Long: `Migrate down to version 0 and back up to the last migration.
+
+This is intended for development databases. All data in objects created by the
+migrations is lost. Every migration must be reversible. Unless --yes is given
+the reset must be confirmed by answering y. It is refused if allow_down_to_zero
+is false in the config.
+
+  e.g. tern reset --yes
+`,
+		Args: cobra.NoArgs,
+		Run:  Reset,
+	}
+	cmdReset.Flags().BoolVarP(&cliOptions.yes, "yes", "y", false, "reset without asking for confirmation")
+	addAllowDownToZeroFlagToCommand(cmdReset)
+	addNoColorFlagToCommand(cmdReset)
+	addConfigFlagsToCommand(cmdReset)
+
+	cmdDetectVersionTable := &cobra.Command{
+		Use:   "detect-version-table",
+		Short: "Find tables in any schema that look like a tern version table",
+		Long: `Find tables in any schema that look like a tern version table.
+
+This is useful when adopting tern on a database where a version table already
+exists but its name is not known. Every table with an integer version column
+and no other columns except the in_progress column tern adds is reported with
+its current version. The table matching version_table is marked as configured.
+Nothing in the database is modified.
+
+  e.g. tern detect-version-table --database orders
+`,
+		Args: cobra.NoArgs,
+		Run:  DetectVersionTable,
+	}
+	addCoreConfigFlagsToCommand(cmdDetectVersionTable)
+
+	cmdRepair := &cobra.Command{
+		Use:   "repair",
+		Short: "Repair the version table",
+		Long: `Repair the version table.
+
+The version table can end up outside the range of known migrations. For
+example, if an applied migration file is deleted. Use --detect to check for
+this situation or --set-version to set the version table directly without
+running any migrations.
+
+  e.g. tern repair --detect
+  e.g. tern repair --set-version 3
+`,
+		Run: Repair,
+	}
+	cmdRepair.Flags().Int32VarP(&cliOptions.setVersion, "set-version", "", 0, "set the version table to this version without running migrations")
+	cmdRepair.Flags().BoolVarP(&cliOptions.detect, "detect", "", false, "report whether the version table is inconsistent with the migrations")
+	addConfigFlagsToCommand(cmdRepair)
+
+	cmdHistory := &cobra.Command{
+		Use:   "history",
+		Short: "Print the migration history",
+		Long: `Print the migrations recorded in the history table, most recent first.
+
+History is only recorded when history_table is set in the config or
+--history-table is given.
+
+  e.g. tern history --since 2024-01-01 --limit 10
+  e.g. tern history --format json
+`,
+		Run: History,
+	}
+	cmdHistory.Flags().StringVarP(&cliOptions.since, "since", "", "", "only show migrations run at or after this date or RFC 3339 time")
+	cmdHistory.Flags().IntVarP(&cliOptions.limit, "limit", "", 0, "maximum number of entries to show")
+	cmdHistory.Flags().StringVarP(&cliOptions.format, "format", "", "text", "output format (text or json)")
+	addCoreConfigFlagsToCommand(cmdHistory)
+
 	cmdPrintConnString := &cobra.Command{
 		Use:   "print-connstring",
 		Short: "Prints a connection string based on the provided config file/arguments",
@@ -240,6 +583,18 @@ The word "last":
 	}
 	cmdNew.Flags().StringVarP(&cliOptions.migrationsPath, "migrations", "m", "", "migrations path (default is .)")
 	cmdNew.Flags().BoolVarP(&cliOptions.editNewMigration, "edit", "e", false, "open new migration in EDITOR")
+	cmdNew.Flags().BoolVarP(&cliOptions.newFromStdin, "from-stdin", "", false, "read the up SQL of the new migration from stdin")
+	cmdNew.Flags().StringVarP(&cliOptions.newFromFile, "from-file", "", "", "read the up SQL of the new migration from a file")
+	addLineEndingsFlagToCommand(cmdNew)
+
+	cmdEdit := &cobra.Command{
+		Use:   "edit MIGRATION",
+		Short: "Open an existing migration in EDITOR",
+		Long:  "Open an existing migration in EDITOR. MIGRATION is the sequence number or name of the migration. e.g. 3, 003_create_people.sql, or create_people",
+		Args:  cobra.ExactArgs(1),
+		Run:   EditMigration,
+	}
+	cmdEdit.Flags().StringVarP(&cliOptions.migrationsPath, "migrations", "m", "", "migrations path (default is .)")
 
 	cmdRenumber := &cobra.Command{
 		Use:   "renumber COMMAND",
@@ -257,11 +612,17 @@ The word "last":
 	cmdRenumberFinish := &cobra.Command{
 		Use:   "finish",
 		Short: "Finish renumbering",
-		Long:  "Finish renumbering with new migrations renumbered",
+		Long: `Finish renumbering with new migrations renumbered
+
+New numbers are zero padded to the width of the number of the last migration
+that existed when renumbering was started (e.g. 0042_add_users.sql is padded to
+four digits). Use --pad-width to use a different width. The separator between
+the number and the name of each migration is preserved.`,
 
 		Run: RenumberFinish,
 	}
 	cmdRenumberFinish.Flags().StringVarP(&cliOptions.migrationsPath, "migrations", "m", "", "migrations path (default is .)")
+	cmdRenumberFinish.Flags().IntVarP(&cliOptions.padWidth, "pad-width", "", 0, "zero pad migration numbers to this many digits (default is the width of the existing migration numbers)")
 
 	cmdGengen := &cobra.Command{
 		Use:   "gengen",
@@ -287,10 +648,13 @@ Migrations can only go forward to the latest version.
 `,
 		Run: Gengen,
 	}
-	cmdGengen.Flags().StringSliceVarP(&cliOptions.configPaths, "config", "c", []string{}, "config path (default is ./tern.conf)")
+	cmdGengen.Flags().StringSliceVarP(&cliOptions.configPaths, "config", "c", []string{}, "config file or directory of *.conf files (default is ./tern.conf and ./tern.conf.d)")
+	addDataFlagToCommand(cmdGengen)
 	cmdGengen.Flags().StringVarP(&cliOptions.versionTable, "version-table", "", "", "version table name (default is public.schema_version)")
 	cmdGengen.Flags().StringVarP(&cliOptions.migrationsPath, "migrations", "m", "", "migrations path (default is .)")
-	cmdGengen.Flags().StringVarP(&cliOptions.outputFile, "output", "o", "", "output file")
+	cmdGengen.Flags().StringVarP(&cliOptions.outputFile, "output", "o", "", "output file (default or - is stdout)")
+	addLineEndingsFlagToCommand(cmdGengen)
+	cmdGengen.Flags().StringVarP(&cliOptions.generatedAt, "generated-at", "", defaultGeneratedAt, "value of .GeneratedAt in migration templates (RFC 3339)")
 
 	cmdPrintMigrations := &cobra.Command{
 		Use:   "print-migrations",
@@ -307,6 +671,11 @@ Note that the generated SQL file is not intended to be executed directly
 against your database, as it does not update the version table nor does
 it do any error handling
 
+Repeatable migrations are printed after the versioned migrations when the
+destination is the last version. With --current from_db only the repeatable
+migrations that have changed are printed.
+
+Use --format json to print the migration plan as JSON for other tools.
 `,
 		Run: PrintMigrations,
 	}
@@ -314,18 +683,131 @@ it do any error handling
 	cmdPrintMigrations.Flags().StringVarP(&cliOptions.currentVersion, "current", "", "0", "current version of the database (use from_db to read the current version form the database)")
 	cmdPrintMigrations.Flags().StringVarP(&cliOptions.destinationVersion, "destination", "d", "last", "destination migration version")
 	cmdPrintMigrations.Flags().StringVarP(&cliOptions.migrationsPath, "migrations", "m", "", "migrations path (default is .)")
-	cmdPrintMigrations.Flags().StringVarP(&cliOptions.outputFile, "output", "o", "", "output file")
+	cmdPrintMigrations.Flags().StringVarP(&cliOptions.outputFile, "output", "o", "", "output file (default or - is stdout)")
+	addLineEndingsFlagToCommand(cmdPrintMigrations)
+	cmdPrintMigrations.Flags().StringVarP(&cliOptions.format, "format", "", "text", "output format (text or json)")
+	cmdPrintMigrations.Flags().StringVarP(&cliOptions.generatedAt, "generated-at", "", defaultGeneratedAt, "value of .GeneratedAt in migration templates (RFC 3339)")
+
+	cmdImport := &cobra.Command{
+		Use:   "import SOURCE",
+		Short: "Import migrations from another migration tool",
+		Long: `Import migrations from another migration tool.
+
+Reads the migrations in SOURCE and writes them to the destination directory in
+the tern format. Migrations are renumbered starting at 1 in their original
+order. Anything that cannot be converted exactly is reported as a warning.
+
+Supported tools:
+
+golang-migrate:
+  Pairs of VERSION_NAME.up.sql and VERSION_NAME.down.sql files.
+  e.g. tern import --from golang-migrate path/to/migrations --to path/to/tern
+
+goose:
+  VERSION_NAME.sql files with -- +goose Up and -- +goose Down annotations.
+  Go migrations are skipped.
+  e.g. tern import --from goose path/to/migrations --to path/to/tern
+`,
+		Args: cobra.ExactArgs(1),
+		Run:  Import,
+	}
+	cmdImport.Flags().StringVarP(&cliOptions.importFrom, "from", "", "", "migration tool to import from (golang-migrate or goose)")
+	cmdImport.Flags().StringVarP(&cliOptions.importTo, "to", "", "", "destination migrations path (default is .)")
+
+	cmdList := &cobra.Command{
+		Use:   "list",
+		Short: "List the migrations",
+		Long: `List the migrations without connecting to the database.
+
+The default format is plain text. Use --format json for a machine readable
+array of migrations with their sequence, name, whether they are reversible and
+transactional, the length of the up SQL, and a SHA-256 hash of the content.
+
+Repeatable migrations are listed after the versioned migrations with R in
+place of the sequence. In JSON they have "repeatable": true and no sequence.
+`,
+		Run: List,
+	}
+	cmdList.Flags().StringSliceVarP(&cliOptions.configPaths, "config", "c", []string{}, "config file or directory of *.conf files (default is ./tern.conf and ./tern.conf.d)")
+	addDataFlagToCommand(cmdList)
+	cmdList.Flags().StringVarP(&cliOptions.migrationsPath, "migrations", "m", "", "migrations path (default is .)")
+	cmdList.Flags().StringVarP(&cliOptions.format, "format", "", "text", "output format (text or json)")
+
+	cmdGraph := &cobra.Command{
+		Use:   "graph",
+		Short: "Print a graph of the migrations",
+		Long: `Print a graph of the migrations without connecting to the database.
+
+Each migration is a node labeled with its sequence and name. Irreversible
+migrations are drawn in red and migrations that disable the transaction are
+dashed. The format is Graphviz DOT by default or Mermaid with --format mermaid.
+
+  e.g. tern graph | dot -Tsvg > migrations.svg
+`,
+		Args: cobra.NoArgs,
+		Run:  Graph,
+	}
+	cmdGraph.Flags().StringSliceVarP(&cliOptions.configPaths, "config", "c", []string{}, "config file or directory of *.conf files (default is ./tern.conf and ./tern.conf.d)")
+	addDataFlagToCommand(cmdGraph)
+	cmdGraph.Flags().StringVarP(&cliOptions.migrationsPath, "migrations", "m", "", "migrations path (default is .)")
+	cmdGraph.Flags().StringVarP(&cliOptions.graphFormat, "format", "", "dot", "output format (dot or mermaid)")
+
+	cmdDiff := &cobra.Command{
+		Use:   "diff DIR_A DIR_B",
+		Short: "Compare the migrations in two directories",
+		Long: `Compare the migrations in two directories without connecting to the database.
+
+Migrations are compared by sequence number and a hash of their SQL after
+template evaluation. Migrations in DIR_B that are not in DIR_A are added.
+Migrations in DIR_A that are not in DIR_B are removed. Migrations in both
+whose name or SQL differs are modified.
+
+The exit status is 1 if any migrations were removed or modified. Adding
+migrations is normal but editing migrations that may already have been applied
+is usually a mistake so this can be used as a CI check.
+
+  e.g. tern diff path/to/main/migrations migrations
+`,
+		Args: cobra.ExactArgs(2),
+		Run:  Diff,
+	}
+	cmdDiff.Flags().StringSliceVarP(&cliOptions.configPaths, "config", "c", []string{}, "config file or directory of *.conf files (default is ./tern.conf and ./tern.conf.d)")
+	addDataFlagToCommand(cmdDiff)
+
+	cmdValidate := &cobra.Command{
+		Use:   "validate",
+		Short: "Check migrations for errors without connecting to the database",
+		Long: `Check migrations for errors without connecting to the database.
+
+Each migration is evaluated as a template with the data from the config and
+the resulting SQL is checked for unterminated quoted strings, dollar-quoted
+strings, and comments. Unlike migrate, every error is reported rather than
+only the first. The SQL is not parsed by PostgreSQL so other syntax errors are
+not found.
+`,
+		Run: Validate,
+	}
+	cmdValidate.Flags().StringSliceVarP(&cliOptions.configPaths, "config", "c", []string{}, "config file or directory of *.conf files (default is ./tern.conf and ./tern.conf.d)")
+	addDataFlagToCommand(cmdValidate)
+	cmdValidate.Flags().StringVarP(&cliOptions.migrationsPath, "migrations", "m", "", "migrations path (default is .)")
 
 	cmdVersion := &cobra.Command{
 		Use:   "version",
 		Short: "Print version",
-		Run: func(cmd *cobra.Command, args []string) {
-			fmt.Printf("tern v%s\n", VERSION)
-		},
+		Long: `Print version.
+
+With --check-updates the latest release is looked up on GitHub and a message is
+printed if it is newer than this version. Nothing more is printed if the lookup
+fails.
+`,
+		Run: Version,
 	}
+	cmdVersion.Flags().BoolVarP(&cliOptions.checkUpdates, "check-updates", "", false, "check GitHub for a newer release")
+	cmdVersion.Flags().DurationVarP(&cliOptions.updateCheckTimeout, "timeout", "", 5*time.Second, "maximum time to wait for the update check")
 
 	cmdCode.AddCommand(cmdCodeInstall)
 	cmdCode.AddCommand(cmdCodeCompile)
+	cmdCode.AddCommand(cmdCodeNew)
 	cmdCode.AddCommand(cmdCodeSnapshot)
 
 	cmdRenumber.AddCommand(cmdRenumberStart)
@@ -337,16 +819,28 @@ it do any error handling
 	rootCmd.AddCommand(cmdRenumber)
 	rootCmd.AddCommand(cmdCode)
 	rootCmd.AddCommand(cmdStatus)
+	rootCmd.AddCommand(cmdRepair)
+	rootCmd.AddCommand(cmdReset)
+	rootCmd.AddCommand(cmdDetectVersionTable)
+	rootCmd.AddCommand(cmdTestRoundtrip)
+	rootCmd.AddCommand(cmdHistory)
 	rootCmd.AddCommand(cmdPrintConnString)
 	rootCmd.AddCommand(cmdNew)
+	rootCmd.AddCommand(cmdExec)
+	rootCmd.AddCommand(cmdEdit)
 	rootCmd.AddCommand(cmdGengen)
 	rootCmd.AddCommand(cmdPrintMigrations)
+	rootCmd.AddCommand(cmdImport)
+	rootCmd.AddCommand(cmdList)
+	rootCmd.AddCommand(cmdGraph)
+	rootCmd.AddCommand(cmdDiff)
+	rootCmd.AddCommand(cmdValidate)
 	rootCmd.AddCommand(cmdVersion)
 	rootCmd.Execute()
 }
 
 func addCoreConfigFlagsToCommand(cmd *cobra.Command) {
-	cmd.Flags().StringSliceVarP(&cliOptions.configPaths, "config", "c", []string{}, "config path (default is ./tern.conf)")
+	cmd.Flags().StringSliceVarP(&cliOptions.configPaths, "config", "c", []string{}, "config file or directory of *.conf files (default is ./tern.conf and ./tern.conf.d)")
 
 	cmd.Flags().StringVarP(&cliOptions.connString, "conn-string", "", "", "database connection string (https://www.postgresql.org/docs/current/libpq-connect.html#LIBPQ-CONNSTRING)")
 	cmd.Flags().StringVarP(&cliOptions.host, "host", "", "", "database host")
@@ -356,7 +850,14 @@ func addCoreConfigFlagsToCommand(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&cliOptions.database, "database", "", "", "database name")
 	cmd.Flags().StringVarP(&cliOptions.sslmode, "sslmode", "", "", "SSL mode")
 	cmd.Flags().StringVarP(&cliOptions.sslrootcert, "sslrootcert", "", "", "SSL root certificate")
+	cmd.Flags().StringVarP(&cliOptions.sslcert, "sslcert", "", "", "SSL client certificate")
+	cmd.Flags().StringVarP(&cliOptions.sslkey, "sslkey", "", "", "SSL client key")
+	cmd.Flags().DurationVarP(&cliOptions.connectTimeout, "connect-timeout", "", 0, "maximum time to wait when connecting to the database (e.g. 5s)")
 	cmd.Flags().StringVarP(&cliOptions.versionTable, "version-table", "", "", "version table name (default is public.schema_version)")
+	cmd.Flags().StringVarP(&cliOptions.historyTable, "history-table", "", "", "table to record each migration run in (default is none)")
+	cmd.Flags().BoolVarP(&cliOptions.lockIDFromTableName, "lock-id-from-table-name", "", false, "derive the advisory lock id from the version table name so runs against different version tables do not wait for each other")
+	cmd.Flags().StringArrayVarP(&cliOptions.runtimeParams, "runtime-param", "", []string{}, "run time parameter to set on connection as key=value (can be repeated)")
+	addDataFlagToCommand(cmd)
 
 	cmd.Flags().StringVarP(&cliOptions.sshHost, "ssh-host", "", "", "SSH tunnel host")
 	cmd.Flags().StringVarP(&cliOptions.sshPort, "ssh-port", "", "", "SSH tunnel port")
@@ -364,6 +865,25 @@ func addCoreConfigFlagsToCommand(cmd *cobra.Command) {
 	cmd.Flags().StringVarP(&cliOptions.sshPassphrase, "ssh-passphrase", "", "", "Passphrase for SSH key file (only required if file is encrypted)")
 	cmd.Flags().StringVarP(&cliOptions.sshUser, "ssh-user", "", "", "SSH tunnel user (default is OS user")
 	cmd.Flags().StringVarP(&cliOptions.sshPassword, "ssh-password", "", "", "SSH tunnel password (unneeded if using SSH agent authentication)")
+	cmd.Flags().BoolVarP(&cliOptions.sshNoAgent, "ssh-no-agent", "", false, "do not use an SSH agent for SSH tunnel authentication")
+	cmd.Flags().StringVarP(&cliOptions.sshAgentSock, "ssh-agent-sock", "", "", "path of the SSH agent socket (default is $SSH_AUTH_SOCK)")
+}
+
+// addDataFlagToCommand adds the --set flag to cmd. It is used by every command that loads a config.
+func addDataFlagToCommand(cmd *cobra.Command) {
+	cmd.Flags().StringArrayVarP(&cliOptions.dataValues, "set", "", []string{}, "data value available to migrations as key=value overriding the config (can be repeated)")
+}
+
+func addAllowDownToZeroFlagToCommand(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&cliOptions.allowDownToZero, "allow-down-to-zero", "", true, "allow migrating down to version 0 (overrides allow_down_to_zero in the config)")
+}
+
+func addNoColorFlagToCommand(cmd *cobra.Command) {
+	cmd.Flags().BoolVarP(&cliOptions.noColor, "no-color", "", false, "do not colorize error output (color is only used when stderr is a terminal)")
+}
+
+func addLineEndingsFlagToCommand(cmd *cobra.Command) {
+	cmd.Flags().StringVarP(&cliOptions.lineEndings, "line-endings", "", "lf", "line endings of generated files (lf or crlf)")
 }
 
 func addConfigFlagsToCommand(cmd *cobra.Command) {
@@ -371,7 +891,93 @@ func addConfigFlagsToCommand(cmd *cobra.Command) {
 	addCoreConfigFlagsToCommand(cmd)
 }
 
+// latestReleaseURL is the GitHub API endpoint for the latest tern release. It can be overridden with the
+// TERN_LATEST_RELEASE_URL environment variable.
+const latestReleaseURL = "https://api.github.com/repos/jackc/tern/releases/latest"
+
+func Version(cmd *cobra.Command, args []string) {
+	fmt.Printf("tern v%s\n", VERSION)
+
+	if !cliOptions.checkUpdates {
+		return
+	}
+
+	url := latestReleaseURL
+	if envURL := os.Getenv("TERN_LATEST_RELEASE_URL"); envURL != "" {
+		url = envURL
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), cliOptions.updateCheckTimeout)
+	defer cancel()
+
+	// Failing to check for updates is not an error as the network or GitHub may be unavailable.
+	latest, err := fetchLatestVersion(ctx, url)
+	if err != nil {
+		return
+	}
+
+	if isNewerVersion(latest, VERSION) {
+		fmt.Printf("A newer version is available: v%s (https://github.com/jackc/tern/releases)\n", latest)
+	} else {
+		fmt.Println("tern is up to date")
+	}
+}
+
+// fetchLatestVersion returns the version of the latest release from the GitHub releases API at url without a leading v.
+func fetchLatestVersion(ctx context.Context, url string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Accept", "application/vnd.github+json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	var release struct {
+		TagName string `json:"tag_name"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&release)
+	if err != nil {
+		return "", err
+	}
+	if release.TagName == "" {
+		return "", errors.New("release has no tag name")
+	}
+
+	return strings.TrimPrefix(release.TagName, "v"), nil
+}
+
+// isNewerVersion reports whether version a is newer than version b. Versions are compared by their dot separated
+// numeric parts. e.g. 2.10.0 is newer than 2.9.1. Parts that are not numbers are treated as 0.
+func isNewerVersion(a, b string) bool {
+	aParts := strings.Split(a, ".")
+	bParts := strings.Split(b, ".")
+	for i := 0; i < len(aParts) || i < len(bParts); i++ {
+		var an, bn int
+		if i < len(aParts) {
+			an, _ = strconv.Atoi(aParts[i])
+		}
+		if i < len(bParts) {
+			bn, _ = strconv.Atoi(bParts[i])
+		}
+		if an != bn {
+			return an > bn
+		}
+	}
+	return false
+}
+
 func Init(cmd *cobra.Command, args []string) {
+	mustValidateLineEndings()
+
 	var directory string
 	switch len(args) {
 	case 0:
@@ -388,6 +994,19 @@ func Init(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	// If no template directory was set in CLI argument look in environment.
+	if cliOptions.initTemplateDir == "" {
+		cliOptions.initTemplateDir = os.Getenv("TERN_INIT_TEMPLATE_DIR")
+	}
+
+	if cliOptions.initTemplateDir != "" {
+		err := copyInitTemplateDir(cliOptions.initTemplateDir, directory)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		return
+	}
 	// Write default conf file
 	confPath := filepath.Join(directory, "tern.conf")
 	confFile, err := os.OpenFile(confPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o666)
@@ -397,7 +1016,13 @@ func Init(cmd *cobra.Command, args []string) {
 	}
 	defer confFile.Close()
 
-	_, err = confFile.WriteString(defaultConf)
+	conf, err := initConf()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	_, err = confFile.WriteString(convertLineEndings(conf))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
@@ -412,13 +1037,106 @@ func Init(cmd *cobra.Command, args []string) {
 	}
 	defer smFile.Close()
 
-	_, err = smFile.WriteString(sampleMigration)
+	_, err = smFile.WriteString(convertLineEndings(sampleMigration))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 }
 
+// initConf returns the config written by tern init. The commented out settings in the database section of defaultConf
+// are replaced by any connection settings given on the command line.
+func initConf() (string, error) {
+	if cliOptions.password != "" && cliOptions.initPasswordEnv != "" {
+		return "", errors.New("--password and --password-env cannot both be used")
+	}
+
+	if cliOptions.connString != "" {
+		if _, err := pgx.ParseConfig(cliOptions.connString); err != nil {
+			return "", fmt.Errorf("error while parsing conn-string argument: %w", err)
+		}
+	}
+
+	password := cliOptions.password
+	if cliOptions.initPasswordEnv != "" {
+		password = fmt.Sprintf(`{{env "%s"}}`, cliOptions.initPasswordEnv)
+	}
+
+	var port string
+	if cliOptions.port != 0 {
+		port = strconv.FormatUint(uint64(cliOptions.port), 10)
+	}
+
+	settings := []struct {
+		key   string
+		value string
+	}{
+		{"host", cliOptions.host},
+		{"port", port},
+		{"database", cliOptions.database},
+		{"user", cliOptions.user},
+		{"password", password},
+		{"version_table", cliOptions.versionTable},
+		{"sslmode", cliOptions.sslmode},
+		{"sslrootcert", cliOptions.sslrootcert},
+		{"sslcert", cliOptions.sslcert},
+		{"sslkey", cliOptions.sslkey},
+	}
+
+	// Only the database section is modified as other sections use some of the same keys.
+	sectionEnd := strings.Index(defaultConf, "\n\n") + 1
+	databaseSection, rest := defaultConf[:sectionEnd], defaultConf[sectionEnd:]
+
+	for _, setting := range settings {
+		if setting.value == "" {
+			continue
+		}
+		re := regexp.MustCompile(`(?m)^# ` + setting.key + ` =.*$`)
+		databaseSection = re.ReplaceAllLiteralString(databaseSection, setting.key+" = "+setting.value)
+	}
+
+	if cliOptions.connString != "" {
+		databaseSection = strings.Replace(databaseSection, "[database]\n", "[database]\nconn_string = "+cliOptions.connString+"\n", 1)
+	}
+
+	return databaseSection + rest, nil
+}
+
+// copyInitTemplateDir copies the files in templateDir into directory. Existing files are never overwritten.
+func copyInitTemplateDir(templateDir, directory string) error {
+	fsys := os.DirFS(templateDir)
+	return fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		destPath := filepath.Join(directory, filepath.FromSlash(p))
+		if d.IsDir() {
+			if p == "." {
+				return nil
+			}
+			return os.Mkdir(destPath, os.ModePerm)
+		}
+
+		body, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.OpenFile(destPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o666)
+		if err != nil {
+			return err
+		}
+
+		_, err = f.Write(body)
+		closeErr := f.Close()
+		if err != nil {
+			return err
+		}
+		return closeErr
+	})
+}
+
 func NewMigration(cmd *cobra.Command, args []string) {
 	if len(args) != 1 {
 		cmd.Help()
@@ -427,6 +1145,8 @@ func NewMigration(cmd *cobra.Command, args []string) {
 
 	name := args[0]
 
+	mustValidateLineEndings()
+
 	// If no migrations path was set in CLI argument look in environment.
 	if cliOptions.migrationsPath == "" {
 		cliOptions.migrationsPath = os.Getenv("TERN_MIGRATIONS")
@@ -438,116 +1158,563 @@ func NewMigration(cmd *cobra.Command, args []string) {
 	}
 
 	migrationsPath := cliOptions.migrationsPath
-	migrations, err := migrate.FindMigrations(os.DirFS(migrationsPath))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading migrations:\n  %v\n", err)
-		os.Exit(1)
-	}
 
-	newMigrationName := fmt.Sprintf("%03d_%s.sql", len(migrations)+1, name)
-
-	// Write new migration
-	mPath := filepath.Join(migrationsPath, newMigrationName)
-	mFile, err := os.OpenFile(mPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o666)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
-		os.Exit(1)
+	migrationText := newMigrationText
+	if cliOptions.newFromStdin || cliOptions.newFromFile != "" {
+		upSQL, err := readNewMigrationUpSQL()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		migrationText = strings.Replace(newMigrationText, "-- Write your migrate up statements here\n", upSQL+"\n", 1)
 	}
-	defer mFile.Close()
 
-	_, err = mFile.WriteString(newMigrationText)
+	// Write new migration
+	mPath, _, err := createNextMigrationFile(migrationsPath, name, convertLineEndings(migrationText))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
 
 	if cliOptions.editNewMigration {
-		editor := os.Getenv("EDITOR")
-		if editor == "" {
-			fmt.Fprintln(os.Stderr, "EDITOR environment variable not set")
-			os.Exit(1)
-		}
-
-		cmd := exec.Command("sh", "-c", fmt.Sprintf("%s '%s'", editor, mPath))
-		cmd.Stdin = os.Stdin
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
-		err := cmd.Run()
+		err := openInEditor(mPath)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Failed to start editor:", err)
+			fmt.Fprintln(os.Stderr, err)
 			os.Exit(1)
 		}
 	}
 }
 
-func loadConfigAndConnectToDB(ctx context.Context) (*Config, *pgx.Conn) {
-	config, err := LoadConfig()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading config:\n  %v\n", err)
-		os.Exit(1)
+// readNewMigrationUpSQL reads the up SQL for a new migration from stdin or the file given with --from-file. e.g. the
+// output of a schema diff tool.
+func readNewMigrationUpSQL() (string, error) {
+	if cliOptions.newFromStdin && cliOptions.newFromFile != "" {
+		return "", errors.New("--from-stdin and --from-file cannot be used together")
 	}
 
-	err = config.Validate()
+	var buf []byte
+	var err error
+	source := "stdin"
+	if cliOptions.newFromStdin {
+		buf, err = io.ReadAll(os.Stdin)
+	} else {
+		source = cliOptions.newFromFile
+		buf, err = os.ReadFile(cliOptions.newFromFile)
+	}
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid config:\n  %v\n", err)
-		os.Exit(1)
+		return "", fmt.Errorf("Error reading SQL from %s:\n  %v", source, err)
 	}
 
-	conn, err := config.Connect(ctx)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to connect to PostgreSQL:\n  %v\n", err)
-		os.Exit(1)
+	upSQL := strings.TrimSpace(string(buf))
+	if upSQL == "" {
+		return "", fmt.Errorf("No SQL read from %s", source)
 	}
 
-	return config, conn
+	return upSQL, nil
 }
 
-func Migrate(cmd *cobra.Command, args []string) {
-	ctx := context.Background()
-	config, conn := loadConfigAndConnectToDB(ctx)
-	defer conn.Close(ctx)
+func EditMigration(cmd *cobra.Command, args []string) {
+	// If no migrations path was set in CLI argument look in environment.
+	if cliOptions.migrationsPath == "" {
+		cliOptions.migrationsPath = os.Getenv("TERN_MIGRATIONS")
+	}
 
-	migrator, err := migrate.NewMigrator(ctx, conn, config.VersionTable)
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
-		os.Exit(1)
+	// If no migrations path was set in CLI argument or environment use default.
+	if cliOptions.migrationsPath == "" {
+		cliOptions.migrationsPath = "."
 	}
-	migrator.Data = config.Data
 
-	migrationsPath := cliOptions.migrationsPath
-	err = migrator.LoadMigrations(os.DirFS(migrationsPath))
+	migrations, err := migrate.FindMigrations(os.DirFS(cliOptions.migrationsPath))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading migrations:\n  %v\n", err)
 		os.Exit(1)
 	}
-	if len(migrator.Migrations) == 0 {
-		fmt.Fprintln(os.Stderr, "No migrations found")
-		os.Exit(1)
-	}
 
-	migrator.OnStart = func(sequence int32, name, direction, sql string) {
-		fmt.Printf("%s executing %s %s\n%s\n\n", time.Now().Format("2006-01-02 15:04:05"), name, direction, sql)
+	migration, err := findMigrationBySequenceOrName(migrations, args[0])
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
 
-	var currentVersion int32
-	currentVersion, err = migrator.GetCurrentVersion(ctx)
+	err = openInEditor(filepath.Join(cliOptions.migrationsPath, migration))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Unable to get current version:\n  %v\n", err)
+		fmt.Fprintln(os.Stderr, err)
 		os.Exit(1)
 	}
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	defer cancel()
-	interruptChan := make(chan os.Signal, 1)
-	signal.Notify(interruptChan, os.Interrupt)
-	go func() {
-		<-interruptChan
-		cancel()       // Cancel any in progress migrations
-		signal.Reset() // Only listen for one interrupt. If another interrupt signal is received allow it to terminate the program.
-	}()
+// findMigrationBySequenceOrName returns the migration file in migrations identified by s. s can be the sequence number,
+// the file name, or the name without the sequence number and extension. e.g. 3, 003_create_people.sql, or
+// create_people.
+func findMigrationBySequenceOrName(migrations []string, s string) (string, error) {
+	if n, err := strconv.ParseInt(s, 10, 32); err == nil {
+		if n < 1 || n > int64(len(migrations)) {
+			return "", fmt.Errorf("migration %d not found", n)
+		}
+		return migrations[n-1], nil
+	}
 
-	destination := cliOptions.destinationVersion
-	mustParseDestination := func(d string) int32 {
+	namePattern := regexp.MustCompile(`\A\d+[_.](.+?)(?:\.up)?\.sql\z`)
+	var found []string
+	for _, m := range migrations {
+		if m == s {
+			return m, nil
+		}
+		if matches := namePattern.FindStringSubmatch(m); matches != nil && matches[1] == s {
+			found = append(found, m)
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return "", fmt.Errorf("migration %s not found", s)
+	case 1:
+		return found[0], nil
+	default:
+		return "", fmt.Errorf("migration name %s is ambiguous: %s", s, strings.Join(found, ", "))
+	}
+}
+
+// openInEditor opens path in the editor set by the EDITOR environment variable and waits for it to exit.
+func openInEditor(path string) error {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		return errors.New("EDITOR environment variable not set")
+	}
+
+	cmd := editorCommand(editor, path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("Failed to start editor: %w", err)
+	}
+
+	return nil
+}
+
+// editorCommand returns the command to open path in editor. editor may include arguments. e.g. "code --wait". On
+// Windows there is no sh so the editor is run directly. Double quotes can be used to quote an editor path that contains
+// spaces.
+func editorCommand(editor, path string) *exec.Cmd {
+	if runtime.GOOS == "windows" {
+		args := splitEditorCommand(editor)
+		if len(args) == 0 {
+			args = []string{editor}
+		}
+		return exec.Command(args[0], append(args[1:], path)...)
+	}
+
+	// path is passed as a positional parameter so it does not need to be quoted.
+	return exec.Command("sh", "-c", editor+` "$1"`, "sh", path)
+}
+
+// splitEditorCommand splits editor into words separated by whitespace. Double quotes group words that contain spaces.
+func splitEditorCommand(editor string) []string {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	inQuotes := false
+
+	for _, r := range editor {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+			inWord = true
+		case !inQuotes && unicode.IsSpace(r):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteRune(r)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+
+	return words
+}
+
+func Import(cmd *cobra.Command, args []string) {
+	source := args[0]
+
+	var readMigrations func(fs.FS) ([]*importer.Migration, []string, error)
+	switch cliOptions.importFrom {
+	case "golang-migrate":
+		readMigrations = importer.ReadGolangMigrate
+	case "goose":
+		readMigrations = importer.ReadGoose
+	default:
+		fmt.Fprintf(os.Stderr, "Unknown migration tool %q (must be golang-migrate or goose)\n", cliOptions.importFrom)
+		os.Exit(1)
+	}
+
+	migrations, warnings, err := readMigrations(os.DirFS(source))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading migrations:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	for _, w := range warnings {
+		fmt.Fprintln(os.Stderr, "Warning:", w)
+	}
+
+	if len(migrations) == 0 {
+		fmt.Fprintln(os.Stderr, "No migrations found")
+		os.Exit(1)
+	}
+
+	destination := cliOptions.importTo
+	if destination == "" {
+		destination = "."
+	}
+
+	filenames, err := importer.Write(destination, migrations)
+	for i, filename := range filenames {
+		fmt.Printf("%d_%s -> %s\n", migrations[i].Version, migrations[i].Name, filename)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error writing migrations:\n  %v\n", err)
+		os.Exit(1)
+	}
+}
+
+func loadConfigAndConnectToDB(ctx context.Context) (*Config, *pgx.Conn) {
+	config, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	conn, err := config.Connect(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to connect to PostgreSQL:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	return config, conn
+}
+
+// migrationProgress tracks the migrations run by tern migrate to display the progress and estimated time remaining.
+// Repeatable migrations are not counted.
+type migrationProgress struct {
+	total     int
+	started   int
+	completed int
+	elapsed   time.Duration
+}
+
+func (p *migrationProgress) finish(sequence int32, name, direction string, duration time.Duration) {
+	if direction == "repeatable" {
+		return
+	}
+	p.completed++
+	p.elapsed += duration
+}
+
+// prefix is called when a migration starts. It returns the progress prefix for the migration. e.g.
+// "[3/25 ETA 1m20s] ". The ETA is estimated from the average duration of the migrations completed so far.
+func (p *migrationProgress) prefix(direction string) string {
+	if direction == "repeatable" || p.total == 0 {
+		return ""
+	}
+
+	p.started++
+	if p.completed == 0 {
+		return fmt.Sprintf("[%d/%d] ", p.started, p.total)
+	}
+
+	remaining := p.total - p.started + 1
+	eta := p.elapsed / time.Duration(p.completed) * time.Duration(remaining)
+	return fmt.Sprintf("[%d/%d ETA %v] ", p.started, p.total, eta.Round(time.Second))
+}
+
+// runMetrics records the migrations run by tern migrate for --metrics-file.
+type runMetrics struct {
+	migrations []migrationMetric
+}
+
+type migrationMetric struct {
+	sequence  int32
+	name      string
+	direction string
+	duration  time.Duration
+}
+
+func (rm *runMetrics) finish(sequence int32, name, direction string, duration time.Duration) {
+	rm.migrations = append(rm.migrations, migrationMetric{sequence: sequence, name: name, direction: direction, duration: duration})
+}
+
+// write writes the metrics to path in the Prometheus text format. The file is written to a temporary file that is
+// renamed into place so a collector never reads a partially written file. The current version is omitted if it is not
+// known.
+func (rm *runMetrics) write(path string, currentVersion int32, haveVersion, success bool) error {
+	var buf bytes.Buffer
+
+	buf.WriteString("# HELP tern_migrations_applied_total Number of migrations applied by the last run.\n")
+	buf.WriteString("# TYPE tern_migrations_applied_total counter\n")
+	fmt.Fprintf(&buf, "tern_migrations_applied_total %d\n", len(rm.migrations))
+
+	if haveVersion {
+		buf.WriteString("# HELP tern_current_version Version of the database after the last run.\n")
+		buf.WriteString("# TYPE tern_current_version gauge\n")
+		fmt.Fprintf(&buf, "tern_current_version %d\n", currentVersion)
+	}
+
+	buf.WriteString("# HELP tern_migration_duration_seconds Time taken by each migration applied by the last run.\n")
+	buf.WriteString("# TYPE tern_migration_duration_seconds gauge\n")
+	for _, m := range rm.migrations {
+		fmt.Fprintf(&buf, "tern_migration_duration_seconds{sequence=\"%d\",name=\"%s\",direction=\"%s\"} %g\n",
+			m.sequence, escapeMetricLabel(m.name), escapeMetricLabel(m.direction), m.duration.Seconds())
+	}
+
+	buf.WriteString("# HELP tern_last_run_success Whether the last run succeeded (1) or failed (0).\n")
+	buf.WriteString("# TYPE tern_last_run_success gauge\n")
+	if success {
+		buf.WriteString("tern_last_run_success 1\n")
+	} else {
+		buf.WriteString("tern_last_run_success 0\n")
+	}
+
+	tmpPath := path + ".tmp"
+	err := os.WriteFile(tmpPath, buf.Bytes(), 0o644)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+// escapeMetricLabel escapes a Prometheus label value.
+func escapeMetricLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func Migrate(cmd *cobra.Command, args []string) {
+	mustValidateErrorFormat()
+
+	redoLast := len(args) == 1 && args[0] == "redo-last"
+	if redoLast && (cmd.Flags().Changed("destination") || cmd.Flags().Changed("max-steps")) {
+		fmt.Fprintln(os.Stderr, "redo-last cannot be used with --destination or --max-steps")
+		os.Exit(1)
+	}
+	if cliOptions.repeatableOnly && (redoLast || cmd.Flags().Changed("destination") || cmd.Flags().Changed("max-steps") || cmd.Flags().Changed("from")) {
+		fmt.Fprintln(os.Stderr, "--repeatable-only cannot be used with redo-last, --destination, --max-steps, or --from")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	config, conn := loadConfigAndConnectToDB(ctx)
+	defer conn.Close(ctx)
+
+	if cliOptions.continueOnError {
+		fmt.Fprintln(os.Stderr, "WARNING: --continue-on-error is for development only. Failed migrations are skipped and the database may not match any migration version.")
+	}
+
+	var assumedCurrentVersion *int32
+	if cmd.Flags().Changed("from") {
+		assumedCurrentVersion = &cliOptions.fromVersion
+	}
+
+	migrationsFS := os.DirFS(cliOptions.migrationsPath)
+	if cliOptions.migrationsURL != "" {
+		if cmd.Flags().Changed("migrations") {
+			fmt.Fprintln(os.Stderr, "--migrations-url cannot be used with --migrations")
+			os.Exit(1)
+		}
+
+		var cleanup func()
+		var err error
+		migrationsFS, cleanup, err = remotefs.Fetch(ctx, cliOptions.migrationsURL, cliOptions.migrationsSHA256, "")
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error fetching migrations:\n  %v\n", err)
+			os.Exit(1)
+		}
+		defer cleanup()
+	} else if cliOptions.migrationsSHA256 != "" {
+		fmt.Fprintln(os.Stderr, "--migrations-sha256 requires --migrations-url")
+		os.Exit(1)
+	}
+
+	// The initial version is checked before the migrator is created because creating the migrator creates the version
+	// table.
+	if cliOptions.initialVersion != 0 {
+		paths, err := migrate.FindMigrations(migrationsFS)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error loading migrations:\n  %v\n", err)
+			os.Exit(1)
+		}
+		if cliOptions.initialVersion < 0 || int(cliOptions.initialVersion) > len(paths) {
+			fmt.Fprintf(os.Stderr, "--initial-version %d must be between 0 and the number of migrations (%d)\n", cliOptions.initialVersion, len(paths))
+			os.Exit(1)
+		}
+	}
+
+	migrator, err := migrate.NewMigratorEx(ctx, conn, config.VersionTable, &migrate.MigratorOptions{
+		LockIDFromVersionTable: config.LockIDFromTableName,
+		InitialVersion:         cliOptions.initialVersion,
+		AssumedCurrentVersion:  assumedCurrentVersion,
+		ContinueOnError:        cliOptions.continueOnError,
+		SkipReadOnlyCheck:      cliOptions.skipReadOnlyCheck,
+		HistoryTable:           config.HistoryTable,
+		GuardSQL:               config.GuardSQL,
+		GuardMessage:           config.GuardMessage,
+
+		Environment:               cliOptions.environment,
+		FailOnExcludedEnvironment: cliOptions.failOnExcludedEnv,
+		IncludeTags:               cliOptions.includeTags,
+		ExcludeTags:               cliOptions.excludeTags,
+		Delims:                    config.TemplateDelims,
+		MaxRetries:                cliOptions.maxRetries,
+		RetryBackoff:              cliOptions.retryBackoff,
+		MigrationTimeout:          cliOptions.migrationTimeout,
+		NotifyChannel:             config.NotifyChannel,
+		NotifyWhenUnchanged:       config.NotifyAlways,
+		AnnotateApplicationName:   cliOptions.annotateApplicationName,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
+		os.Exit(1)
+	}
+	migrator.Data = config.Data
+	if cliOptions.verifyState {
+		migrator.PreMigrateCheck = migrator.CheckCurrentMigration
+	}
+	migrator.OnIncompleteMigration = func(name string) {
+		fmt.Fprintf(os.Stderr, "WARNING: %s did not finish on a previous run. It is marked idempotent so it is being run again.\n", name)
+	}
+	migrator.OnIncompleteMigrationWarning = func(name string) {
+		fmt.Fprintf(os.Stderr, "WARNING: %s did not finish on a previous run and may be partially applied. Repair the database and then run tern repair --set-version.\n", name)
+	}
+
+	err = migrator.LoadMigrations(migrationsFS)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading migrations:\n  %v\n", err)
+		os.Exit(1)
+	}
+	if len(migrator.Migrations) == 0 {
+		fmt.Fprintln(os.Stderr, "No migrations found")
+		os.Exit(1)
+	}
+	warnStrayMigrationFiles(migrator, migrationsFS)
+
+	progress := &migrationProgress{}
+	metrics := &runMetrics{}
+	migrator.OnFinish = func(sequence int32, name, direction string, duration time.Duration) {
+		progress.finish(sequence, name, direction, duration)
+		metrics.finish(sequence, name, direction, duration)
+	}
+
+	// With --show-sql-on-error-only the SQL of each migration is buffered and only printed if it fails.
+	migrationSQL := make(map[string]string)
+	var lastMigrationName string
+
+	migrator.OnStart = func(sequence int32, name, direction, sql string) {
+		migrationSQL[name] = sql
+		lastMigrationName = name
+
+		if cliOptions.quiet {
+			return
+		}
+
+		summary := fmt.Sprintf("%s%s executing %s %s", progress.prefix(direction), time.Now().Format("2006-01-02 15:04:05"), name, direction)
+		if sequence > 0 && int(sequence) <= len(migrator.Migrations) {
+			if metadata := formatMetadata(migrator.Migrations[sequence-1].Metadata); metadata != "" {
+				summary += " (" + metadata + ")"
+			}
+		}
+		if cliOptions.showSQLOnErrorOnly {
+			fmt.Println(summary)
+		} else {
+			fmt.Printf("%s\n%s\n\n", summary, sql)
+		}
+	}
+	if !cliOptions.quiet {
+		migrator.OnSkip = func(sequence int32, name, direction string) {
+			reason := fmt.Sprintf("not allowed in environment %q", cliOptions.environment)
+			if m := migrator.Migrations[sequence-1]; m.RunsInEnvironment(cliOptions.environment) {
+				reason = fmt.Sprintf("tags %s not selected", strings.Join(m.Tags(), ","))
+			}
+			fmt.Printf("%s%s skipping %s %s (%s)\n", progress.prefix(direction), time.Now().Format("2006-01-02 15:04:05"), name, direction, reason)
+		}
+		migrator.OnBatch = func(sequence int32, name string, batch int, rowsAffected int64) {
+			fmt.Printf("%s %s batch %d: %d rows\n", time.Now().Format("2006-01-02 15:04:05"), name, batch, rowsAffected)
+		}
+	}
+
+	var currentVersion int32
+	currentVersion, err = migrator.GetCurrentVersion(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to get current version:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	if assumedCurrentVersion != nil {
+		fmt.Fprintf(os.Stderr, "WARNING: --from %d overrides the current version %d in the version table. Migrations are planned as if the database is at version %d. The version table is updated as migrations are run.\n", cliOptions.fromVersion, currentVersion, cliOptions.fromVersion)
+		currentVersion = cliOptions.fromVersion
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	interruptChan := make(chan os.Signal, 1)
+	signal.Notify(interruptChan, os.Interrupt)
+	go func() {
+		<-interruptChan
+		cancel()       // Cancel any in progress migrations
+		signal.Reset() // Only listen for one interrupt. If another interrupt signal is received allow it to terminate the program.
+	}()
+
+	if cmd.Flags().Changed("max-steps") {
+		if cmd.Flags().Changed("destination") {
+			fmt.Fprintln(os.Stderr, "--max-steps cannot be used with --destination")
+			os.Exit(1)
+		}
+		if cliOptions.maxSteps < 1 {
+			fmt.Fprintln(os.Stderr, "--max-steps must be greater than 0")
+			os.Exit(1)
+		}
+	}
+
+	// Migrating down from a version given with --from runs down migrations against a schema tern has not verified.
+	migrateTo := func(targetVersion int32) error {
+		if assumedCurrentVersion != nil && targetVersion < *assumedCurrentVersion && !cliOptions.force {
+			fmt.Fprintf(os.Stderr, "Refusing to migrate down from --from %d to %d without --force\n", *assumedCurrentVersion, targetVersion)
+			os.Exit(1)
+		}
+		if targetVersion == 0 && currentVersion > 0 && !downToZeroAllowed(cmd, config) {
+			fmt.Fprintln(os.Stderr, "Refusing to migrate down to version 0 because allow_down_to_zero is false")
+			os.Exit(1)
+		}
+		return migrator.MigrateTo(ctx, targetVersion)
+	}
+
+	destination := cliOptions.destinationVersion
+	if redoLast {
+		if currentVersion < 1 || int(currentVersion) > len(migrator.Migrations) {
+			fmt.Fprintf(os.Stderr, "Cannot redo the last migration: current version is %d and there are %d migrations\n", currentVersion, len(migrator.Migrations))
+			os.Exit(1)
+		}
+		last := migrator.Migrations[currentVersion-1]
+		if !last.Reversible() {
+			fmt.Fprintf(os.Stderr, "Cannot redo %s: it is irreversible\n", last.Name)
+			os.Exit(1)
+		}
+		if !cliOptions.quiet {
+			fmt.Printf("Redoing %s\n", last.Name)
+		}
+		destination = "-+1"
+	}
+	mustParseDestination := func(d string) int32 {
 		var n int64
 		n, err = strconv.ParseInt(d, 10, 32)
 		if err != nil {
@@ -556,71 +1723,844 @@ func Migrate(cmd *cobra.Command, args []string) {
 		}
 		return int32(n)
 	}
-	if destination == "last" {
+	steps := func(targetVersion int32) int {
+		if targetVersion < currentVersion {
+			return int(currentVersion - targetVersion)
+		}
+		return int(targetVersion - currentVersion)
+	}
+	// --repeatable-only does not change the version. When --max-steps reaches the last migration Migrate is used so
+	// repeatable migrations are run.
+	if cliOptions.repeatableOnly {
+		err = migrator.MigrateRepeatable(ctx)
+	} else if destination == "last" && cliOptions.maxSteps > 0 && cliOptions.maxSteps < int32(len(migrator.Migrations))-currentVersion {
+		targetVersion := currentVersion + cliOptions.maxSteps
+		progress.total = steps(targetVersion)
+		err = migrateTo(targetVersion)
+	} else if destination == "last" {
+		progress.total = steps(int32(len(migrator.Migrations)))
 		err = migrator.Migrate(ctx)
 	} else if len(destination) >= 3 && destination[0:2] == "-+" {
-		err = migrator.MigrateTo(ctx, currentVersion-mustParseDestination(destination[2:]))
+		targetVersion := currentVersion - mustParseDestination(destination[2:])
+		progress.total = 2 * steps(targetVersion)
+		err = migrateTo(targetVersion)
 		if err == nil {
-			err = migrator.MigrateTo(ctx, currentVersion)
+			err = migrateTo(currentVersion)
 		}
 	} else if len(destination) >= 2 && destination[0] == '-' {
-		err = migrator.MigrateTo(ctx, currentVersion-mustParseDestination(destination[1:]))
+		targetVersion := currentVersion - mustParseDestination(destination[1:])
+		progress.total = steps(targetVersion)
+		err = migrateTo(targetVersion)
 	} else if len(destination) >= 2 && destination[0] == '+' {
-		err = migrator.MigrateTo(ctx, currentVersion+mustParseDestination(destination[1:]))
+		targetVersion := currentVersion + mustParseDestination(destination[1:])
+		progress.total = steps(targetVersion)
+		err = migrateTo(targetVersion)
 	} else {
-		err = migrator.MigrateTo(ctx, mustParseDestination(destination))
+		targetVersion := mustParseDestination(destination)
+		progress.total = steps(targetVersion)
+		err = migrateTo(targetVersion)
+	}
+
+	if cliOptions.metricsFile != "" {
+		// The run context may have been canceled by an interrupt.
+		version, versionErr := migrator.GetCurrentVersion(context.Background())
+		metricsErr := metrics.write(cliOptions.metricsFile, version, versionErr == nil, err == nil)
+		if metricsErr != nil {
+			fmt.Fprintf(os.Stderr, "Error writing metrics file:\n  %v\n", metricsErr)
+			if err == nil {
+				os.Exit(1)
+			}
+		}
 	}
 
 	if err != nil {
-		if mgErr, ok := err.(migrate.MigrationPgError); ok {
-			fmt.Fprintln(os.Stderr, mgErr.PgError)
-
-			if mgErr.Detail != "" {
-				fmt.Fprintln(os.Stderr, "DETAIL:", mgErr.Detail)
+		printMigrationErrors(err, "", func(err error) {
+			if !cliOptions.showSQLOnErrorOnly {
+				return
 			}
+			name := lastMigrationName
+			var mgErr migrate.MigrationPgError
+			if errors.As(err, &mgErr) && mgErr.MigrationName != "" {
+				name = mgErr.MigrationName
+			}
+			if sql, ok := migrationSQL[name]; ok {
+				fmt.Fprintf(os.Stderr, "%s\n\n", sql)
+			}
+		})
+		os.Exit(1)
+	}
+}
 
-			if mgErr.Position != 0 {
-				ele, err := migrate.ExtractErrorLine(mgErr.Sql, int(mgErr.Position))
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-					os.Exit(1)
-				}
+// createOutputFile creates the file at path for the output of gengen or print-migrations. An empty path or "-" means
+// stdout.
+func createOutputFile(path string) (*os.File, error) {
+	if path == "" || path == "-" {
+		return os.Stdout, nil
+	}
+	return os.Create(path)
+}
 
-				prefix := fmt.Sprintf("LINE %d: ", ele.LineNum)
-				fmt.Fprintf(os.Stderr, "%s%s\n", prefix, ele.Text)
+func mustValidateLineEndings() {
+	if cliOptions.lineEndings != "lf" && cliOptions.lineEndings != "crlf" {
+		fmt.Fprintf(os.Stderr, "Unknown line endings %q (must be lf or crlf)\n", cliOptions.lineEndings)
+		os.Exit(1)
+	}
+}
 
-				padding := strings.Repeat(" ", len(prefix)+ele.ColumnNum-1)
-				fmt.Fprintf(os.Stderr, "%s^\n", padding)
-			}
-		} else {
-			fmt.Fprintln(os.Stderr, err)
+// convertLineEndings converts the line endings of s to those selected with --line-endings. Line endings that are
+// already CRLF are not doubled.
+func convertLineEndings(s string) string {
+	if cliOptions.lineEndings != "crlf" {
+		return s
+	}
+	return strings.ReplaceAll(strings.ReplaceAll(s, "\r\n", "\n"), "\n", "\r\n")
+}
+
+// newLineEndingWriter returns a writer that converts the line endings written to w to those selected with
+// --line-endings.
+func newLineEndingWriter(w io.Writer) io.Writer {
+	if cliOptions.lineEndings != "crlf" {
+		return w
+	}
+	return &crlfWriter{w: w}
+}
+
+// crlfWriter converts LF line endings to CRLF. A CR at the end of one write is remembered so a CRLF split across
+// writes is not doubled.
+type crlfWriter struct {
+	w      io.Writer
+	lastCR bool
+}
+
+func (cw *crlfWriter) Write(p []byte) (int, error) {
+	buf := make([]byte, 0, len(p)+bytes.Count(p, []byte("\n")))
+	for _, b := range p {
+		if b == '\n' && !cw.lastCR {
+			buf = append(buf, '\r')
 		}
-		os.Exit(1)
+		buf = append(buf, b)
+		cw.lastCR = b == '\r'
+	}
+
+	_, err := cw.w.Write(buf)
+	if err != nil {
+		return 0, err
 	}
+	return len(p), nil
 }
 
-func Gengen(cmd *cobra.Command, args []string) {
+// warnStrayMigrationFiles prints a warning for each file in fsys that looks like a migration but will not be loaded. It
+// is not an error as a backup file left by an editor is harmless, but a misnamed migration is silently never run.
+func warnStrayMigrationFiles(migrator *migrate.Migrator, fsys fs.FS) {
+	stray, err := migrator.StrayMigrationFiles(fsys)
+	if err != nil {
+		return
+	}
+	for _, p := range stray {
+		fmt.Fprintf(os.Stderr, "WARNING: %s looks like a migration but does not match the migration file name pattern and is ignored\n", p)
+	}
+}
+
+func Validate(cmd *cobra.Command, args []string) {
 	config, err := LoadConfig()
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading config:\n  %v\n", err)
 		os.Exit(1)
 	}
 
-	err = config.Validate()
+	migrator, err := migrate.NewMigratorEx(context.Background(), nil, config.VersionTable, &migrate.MigratorOptions{Delims: config.TemplateDelims})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid config:\n  %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
 		os.Exit(1)
 	}
+	migrator.Data = config.Data
 
-	migrator, err := migrate.NewMigrator(context.Background(), nil, config.VersionTable)
+	warnStrayMigrationFiles(migrator, os.DirFS(cliOptions.migrationsPath))
+
+	errs := migrator.Validate(os.DirFS(cliOptions.migrationsPath))
+	if len(errs) > 0 {
+		for _, err := range errs {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+		}
+		fmt.Fprintf(os.Stderr, "%d error(s) found\n", len(errs))
+		os.Exit(1)
+	}
+
+	fmt.Println("No errors found")
+}
+
+func Gengen(cmd *cobra.Command, args []string) {
+	mustValidateLineEndings()
+	generatedAt := mustParseGeneratedAt()
+
+	config, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	migrator, err := migrate.NewMigratorEx(context.Background(), nil, config.VersionTable, &migrate.MigratorOptions{Delims: config.TemplateDelims, GeneratedAt: generatedAt})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
+		os.Exit(1)
+	}
+	migrator.Data = config.Data
+
+	migrationsPath := cliOptions.migrationsPath
+	err = migrator.LoadMigrations(os.DirFS(migrationsPath))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading migrations:\n  %v\n", err)
+		os.Exit(1)
+	}
+	if len(migrator.Migrations) == 0 {
+		fmt.Fprintln(os.Stderr, "No migrations found")
+		os.Exit(1)
+	}
+
+	gengenTemplate := template.Must(template.New("gengen").Parse(`-- This file was generated by tern gengen v{{ .Version }}.
+--
+-- If using psql to execute this script use the --no-psqlrc, --tuples-only,
+-- --quiet, and --no-align options to only output the migration SQL.
+--
+-- e.g. psql --no-psqlrc --tuples-only --quiet --no-align -f this_file.sql
+--
+-- The results can be redirected to a file where the proposed changes can be
+-- inspected or the results can be piped back into psql to migrate immediately.
+--
+-- e.g. psql --no-psqlrc --tuples-only --quiet --no-align -f this_file.sql | psql
+
+set tern.version = -1;
+do $$
+declare
+	schema_version_table_exists boolean;
+begin
+	select to_regclass('{{ .VersionTable }}') is not null into schema_version_table_exists;
+	if schema_version_table_exists then
+		perform set_config('tern.version', version::text, false) from {{ .VersionTable }};
+	end if;
+end
+$$;
+
+with migrations(version, up_sql) as (
+	values
+	(0,
+$tern_gengen$
+begin;
+create table {{ .VersionTable }}(version int4 not null, in_progress text);
+insert into {{ .VersionTable }}(version) values(0);
+$tern_gengen$)
+{{ range .Migrations }}
+, ({{ .Sequence }},
+$tern_gengen$
+-- {{ .Name }}
+begin;
+{{ .UpSQL }}$tern_gengen$)
+{{ end }}
+)
+select up_sql || '
+update {{ .VersionTable }} set version = ' || version || ';
+commit;
+'
+from migrations
+where version > current_setting('tern.version')::int4
+order by version asc;
+
+`))
+
+	out, err := createOutputFile(cliOptions.outputFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if out != os.Stdout {
+		defer out.Close()
+	}
+
+	err = gengenTemplate.Execute(newLineEndingWriter(out), map[string]any{
+		"Version":      VERSION,
+		"VersionTable": config.VersionTable,
+		"Migrations":   migrator.Migrations,
+	})
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Error generating gengen script:", err)
+		os.Exit(1)
+	}
+}
+
+func InstallCode(cmd *cobra.Command, args []string) {
+	path := args[0]
+
+	if cliOptions.continueOnError && !cliOptions.transactionPerStatement {
+		fmt.Fprintln(os.Stderr, "--continue-on-error requires --transaction-per-statement")
+		os.Exit(1)
+	}
+	if cliOptions.dryRun && cliOptions.transactionPerStatement {
+		fmt.Fprintln(os.Stderr, "--dry-run cannot be used with --transaction-per-statement")
+		os.Exit(1)
+	}
+
+	mustValidateErrorFormat()
+
+	codePackage, err := migrate.LoadCodePackage(os.DirFS(path))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load code package:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	config, conn := loadConfigAndConnectToDB(ctx)
+	defer conn.Close(ctx)
+
+	opts := &migrate.InstallCodePackageOptions{
+		TransactionPerStatement: cliOptions.transactionPerStatement,
+		ContinueOnError:         cliOptions.continueOnError,
+		DryRun:                  cliOptions.dryRun,
+	}
+	if config.LockIDFromTableName {
+		opts.LockID = migrate.VersionTableLockID(config.VersionTable)
+	}
+	if cliOptions.dryRun {
+		opts.OnStatement = func(sql string) {
+			fmt.Println(strings.TrimRight(sql, "\n"))
+		}
+	}
+
+	err = migrate.InstallCodePackageEx(ctx, conn, config.Data, codePackage, opts)
+	if err != nil {
+		printMigrationErrors(err, "Failed to install code package:\n  ", nil)
+		os.Exit(1)
+	}
+
+	if cliOptions.dryRun {
+		fmt.Fprintln(os.Stderr, "Dry run: the code package ran successfully and was rolled back")
+	}
+}
+
+// migrationErrorJSON is the --error-format json representation of a migration error.
+type migrationErrorJSON struct {
+	Error     string `json:"error"`
+	Migration string `json:"migration,omitempty"`
+	PgCode    string `json:"pg_code,omitempty"`
+	Line      int    `json:"line,omitempty"`
+	Column    int    `json:"column,omitempty"`
+}
+
+// mustValidateErrorFormat exits if --error-format is not a known format.
+func mustValidateErrorFormat() {
+	if cliOptions.errorFormat != "text" && cliOptions.errorFormat != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown error format %q (must be text or json)\n", cliOptions.errorFormat)
+		os.Exit(1)
+	}
+}
+
+// printMigrationErrors writes err to stderr in the format selected by --error-format. With --continue-on-error err may
+// join multiple errors. Each is printed on its own. In text format, a migrate.MigrationPgError is printed like psql
+// with a pointer to the error position, other errors are printed after otherErrPrefix, and beforeText, if not nil, is
+// called before each error is printed. In json format each error is printed as a JSON object on its own line.
+func printMigrationErrors(err error, otherErrPrefix string, beforeText func(err error)) {
+	errs := []error{err}
+	if joinedErr, ok := err.(interface{ Unwrap() []error }); ok {
+		errs = joinedErr.Unwrap()
+	}
+
+	for _, err := range errs {
+		mgErr, isMgErr := err.(migrate.MigrationPgError)
+
+		var ele migrate.ErrorLineExtract
+		var eleErr error
+		if isMgErr && mgErr.Position != 0 {
+			ele, eleErr = migrate.ExtractErrorLine(mgErr.Sql, int(mgErr.Position))
+		}
+
+		if cliOptions.errorFormat == "json" {
+			errJSON := migrationErrorJSON{Error: err.Error()}
+			if isMgErr {
+				errJSON.Error = mgErr.PgError.Error()
+				errJSON.Migration = mgErr.MigrationName
+				errJSON.PgCode = mgErr.Code
+				if mgErr.Position != 0 && eleErr == nil {
+					errJSON.Line = ele.LineNum
+					errJSON.Column = ele.ColumnNum
+				}
+			}
+			buf, err := json.Marshal(errJSON)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			fmt.Fprintln(os.Stderr, string(buf))
+			continue
+		}
+
+		if beforeText != nil {
+			beforeText(err)
+		}
+
+		if !isMgErr {
+			fmt.Fprintf(os.Stderr, "%s%v\n", otherErrPrefix, err)
+			continue
+		}
+
+		if mgErr.Position != 0 && eleErr != nil {
+			fmt.Fprintln(os.Stderr, eleErr)
+			os.Exit(1)
+		}
+		writeMigrationPgError(os.Stderr, mgErr, ele, colorEnabled(os.Stderr))
+	}
+}
+
+const (
+	ansiBoldRed = "\x1b[1;31m"
+	ansiReset   = "\x1b[0m"
+)
+
+// colorEnabled reports whether output written to f should be colorized. Color is disabled by --no-color or the
+// NO_COLOR environment variable (https://no-color.org) and is otherwise only used when f is a terminal.
+func colorEnabled(f *os.File) bool {
+	if cliOptions.noColor || os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+
+	return term.IsTerminal(int(f.Fd()))
+}
+
+// writeMigrationPgError writes mgErr to w like psql with the line containing the error and a pointer to the error
+// position. ele is only used when mgErr.Position is not 0. When color is true the error, the character at the error
+// position, and the pointer are highlighted.
+func writeMigrationPgError(w io.Writer, mgErr migrate.MigrationPgError, ele migrate.ErrorLineExtract, color bool) {
+	highlight := func(s string) string {
+		if !color || s == "" {
+			return s
+		}
+		return ansiBoldRed + s + ansiReset
+	}
+
+	fmt.Fprintln(w, highlight(mgErr.Error()))
+	if mgErr.Detail != "" {
+		fmt.Fprintln(w, "DETAIL:", mgErr.Detail)
+	}
+
+	if mgErr.Position == 0 {
+		return
+	}
+
+	prefix := fmt.Sprintf("LINE %d: ", ele.LineNum)
+	text := ele.Text
+	if color {
+		// ColumnNum counts characters, not bytes.
+		runes := []rune(text)
+		if col := ele.ColumnNum - 1; col >= 0 && col < len(runes) {
+			text = string(runes[:col]) + highlight(string(runes[col])) + string(runes[col+1:])
+		}
+	}
+	fmt.Fprintf(w, "%s%s\n", prefix, text)
+
+	padding := strings.Repeat(" ", len(prefix)+ele.ColumnNum-1)
+	fmt.Fprintf(w, "%s%s\n", padding, highlight("^"))
+}
+
+func Exec(cmd *cobra.Command, args []string) {
+	path := args[0]
+
+	mustValidateErrorFormat()
+
+	body, err := os.ReadFile(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to read SQL file:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	config, conn := loadConfigAndConnectToDB(ctx)
+	defer conn.Close(ctx)
+
+	tmpl, err := template.New(filepath.Base(path)).Funcs(sprig.TxtFuncMap()).Parse(string(body))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to evaluate SQL file:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, config.Data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to evaluate SQL file:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	switch {
+	case config.LockIDFromTableName && cliOptions.disableTx:
+		err = migrate.LockExecStatementsWithLockID(ctx, conn, migrate.VersionTableLockID(config.VersionTable), buf.String())
+	case config.LockIDFromTableName:
+		err = migrate.LockExecTxWithLockID(ctx, conn, migrate.VersionTableLockID(config.VersionTable), buf.String())
+	case cliOptions.disableTx:
+		err = migrate.LockExecStatements(ctx, conn, buf.String())
+	default:
+		err = migrate.LockExecTx(ctx, conn, buf.String())
+	}
+	if err != nil {
+		printMigrationErrors(err, "Failed to execute SQL file:\n  ", nil)
+		os.Exit(1)
+	}
+}
+
+func CompileCode(cmd *cobra.Command, args []string) {
+	path := args[0]
+
+	codePackage, err := migrate.LoadCodePackage(os.DirFS(path))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load code package:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	err = config.Validate()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Invalid config:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	if cliOptions.codeEntry != "" && cliOptions.codeAll {
+		fmt.Fprintln(os.Stderr, "--entry and --all cannot be used together")
+		os.Exit(1)
+	}
+
+	var sql string
+	switch {
+	case cliOptions.codeAll:
+		var sb strings.Builder
+		for i, p := range codePackage.Files() {
+			var fileSQL string
+			fileSQL, err = codePackage.EvalFile(p, config.Data)
+			if err != nil {
+				break
+			}
+			if i > 0 {
+				sb.WriteString("\n")
+			}
+			fmt.Fprintf(&sb, "-- File: %s\n%s\n", p, strings.TrimRight(fileSQL, "\n"))
+		}
+		sql = strings.TrimRight(sb.String(), "\n")
+	case cliOptions.codeEntry != "":
+		sql, err = codePackage.EvalFile(cliOptions.codeEntry, config.Data)
+		sql = strings.TrimRight(sql, "\n")
+	default:
+		sql, err = codePackage.Eval(config.Data)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to evaluate code package:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	fmt.Println(sql)
+}
+
+func NewCode(cmd *cobra.Command, args []string) {
+	path := args[0]
+
+	err := os.MkdirAll(path, os.ModePerm)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	installPath := filepath.Join(path, "install.sql")
+	installFile, err := os.OpenFile(installPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o666)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	defer installFile.Close()
+
+	_, err = installFile.WriteString(sampleCodePackageInstall)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+func SnapshotCode(cmd *cobra.Command, args []string) {
+	path := args[0]
+
+	_, err := migrate.LoadCodePackage(os.DirFS(path))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to load code package:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	migrationsPath := cliOptions.migrationsPath
+
+	// If no migrations path was set in CLI argument look in environment.
+	if migrationsPath == "" {
+		migrationsPath = os.Getenv("TERN_MIGRATIONS")
+	}
+
+	// Create the installer migration first. It reserves the sequence number used for the snapshot directory.
+	mPath, seq, err := createNextMigrationFile(migrationsPath, "install_"+filepath.Base(path), "")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	migrationID := fmt.Sprintf("%03d", seq)
+	snapshotPath := filepath.Join(migrationsPath, "snapshots", migrationID)
+	err = copyCodePackageDir(path, snapshotPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error copying snapshot:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	err = os.WriteFile(mPath, []byte(fmt.Sprintf(`{{ install_snapshot "%s" }}`, migrationID)), 0o666)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+}
+
+var migrationSequencePattern = regexp.MustCompile(`\A(\d+)([_.])`)
+
+// nextMigrationSequence returns the sequence number following the highest one used in migrationsPath and the
+// separator used by the migration with that number. Every file with a leading sequence number is considered, including
+// files that are not valid migrations, as are the snapshot directories used by code package installers. .example files
+// are ignored as they are never loaded and a number they used would leave a gap in the migrations. It does not require
+// the existing migrations to be valid so a new migration can still be created to fix a broken directory.
+func nextMigrationSequence(migrationsPath string) (seq int, separator string, err error) {
+	separator = "_"
+	var max int
+
+	entries, err := os.ReadDir(migrationsPath)
+	if err != nil {
+		return 0, "", err
+	}
+	for _, e := range entries {
+		if strings.HasSuffix(e.Name(), ".example") {
+			continue
+		}
+		matches := migrationSequencePattern.FindStringSubmatch(e.Name())
+		if matches == nil {
+			continue
+		}
+		n, err := strconv.Atoi(matches[1])
+		if err != nil {
+			continue
+		}
+		if n > max {
+			max = n
+			separator = matches[2]
+		}
+	}
+
+	entries, err = os.ReadDir(filepath.Join(migrationsPath, "snapshots"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return 0, "", err
+	}
+	for _, e := range entries {
+		n, err := strconv.Atoi(e.Name())
+		if err == nil && n > max {
+			max = n
+		}
+	}
+
+	return max + 1, separator, nil
+}
+
+// createNextMigrationFile creates a migration named name with the next sequence number in migrationsPath and writes
+// text to it. The file is created exclusively. If another process takes the same number first the next number is
+// tried.
+func createNextMigrationFile(migrationsPath, name, text string) (path string, seq int, err error) {
+	const maxAttempts = 10
+
+	for attempt := 0; attempt < maxAttempts; attempt++ {
+		var separator string
+		seq, separator, err = nextMigrationSequence(migrationsPath)
+		if err != nil {
+			return "", 0, err
+		}
+
+		path = filepath.Join(migrationsPath, fmt.Sprintf("%03d%s%s.sql", seq, separator, name))
+		f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o666)
+		if errors.Is(err, fs.ErrExist) {
+			continue
+		}
+		if err != nil {
+			return "", 0, err
+		}
+
+		_, err = f.WriteString(text)
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+		if err != nil {
+			return "", 0, err
+		}
+
+		return path, seq, nil
+	}
+
+	return "", 0, fmt.Errorf("could not create migration %s: sequence number %d already taken", name, seq)
+}
+
+// historyEntry is the JSON representation of a migration printed by tern history.
+type historyEntry struct {
+	Sequence    int32     `json:"sequence"`
+	Name        string    `json:"name"`
+	Direction   string    `json:"direction"`
+	AppliedBy   string    `json:"applied_by"`
+	SessionUser string    `json:"session_user"`
+	AppliedAt   time.Time `json:"applied_at"`
+}
+
+func History(cmd *cobra.Command, args []string) {
+	if cliOptions.format != "text" && cliOptions.format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown format %q (must be text or json)\n", cliOptions.format)
+		os.Exit(1)
+	}
+
+	var since time.Time
+	if cliOptions.since != "" {
+		var err error
+		since, err = time.ParseInLocation("2006-01-02", cliOptions.since, time.Local)
+		if err != nil {
+			since, err = time.Parse(time.RFC3339, cliOptions.since)
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Bad since %q (must be a date such as 2024-01-01 or an RFC 3339 time)\n", cliOptions.since)
+			os.Exit(1)
+		}
+	}
+
+	ctx := context.Background()
+	config, conn := loadConfigAndConnectToDB(ctx)
+	defer conn.Close(ctx)
+
+	if config.HistoryTable == "" {
+		fmt.Fprintln(os.Stderr, "No history table is configured. Set history_table in the database section of the config or use --history-table.")
+		os.Exit(1)
+	}
+
+	migrator, err := migrate.NewMigratorEx(ctx, conn, config.VersionTable, &migrate.MigratorOptions{HistoryTable: config.HistoryTable, LockIDFromVersionTable: config.LockIDFromTableName})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	entries, err := migrator.History(ctx, since, cliOptions.limit)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading history:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	if cliOptions.format == "json" {
+		history := make([]historyEntry, 0, len(entries))
+		for _, e := range entries {
+			history = append(history, historyEntry{
+				Sequence:    e.Sequence,
+				Name:        e.Name,
+				Direction:   e.Direction,
+				AppliedBy:   e.AppliedBy,
+				SessionUser: e.SessionUser,
+				AppliedAt:   e.AppliedAt,
+			})
+		}
+
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(history)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing history:\n  %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	for _, e := range entries {
+		appliedBy := e.AppliedBy
+		if e.SessionUser != e.AppliedBy {
+			appliedBy = fmt.Sprintf("%s as %s", e.SessionUser, e.AppliedBy)
+		}
+		fmt.Printf("%s  %-4s  %3d %s  (%s)\n", e.AppliedAt.Local().Format("2006-01-02 15:04:05"), e.Direction, e.Sequence, e.Name, appliedBy)
+	}
+}
+
+func PrintConnString(cmd *cobra.Command, args []string) {
+	config, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	connstring := config.ConnString
+	if connstring == "" {
+		var options []string
+		for _, option := range []struct{ name, envvar string }{
+			{"sslmode", "PGSSLMODE"},
+			{"sslrootcert", "PGSSLROOTCERT"},
+			{"sslcert", "PGSSLCERT"},
+			{"sslkey", "PGSSLKEY"},
+		} {
+			if value := config.PGEnvvars[option.envvar]; value != "" {
+				options = append(options, fmt.Sprintf("%s=%s", option.name, value))
+			}
+		}
+		connstring = fmt.Sprintf(
+			"postgres://%s:%s@%s:%d/%s?%s",
+			config.ConnConfig.User,
+			config.ConnConfig.Password,
+			config.ConnConfig.Host,
+			config.ConnConfig.Port,
+			config.ConnConfig.Database,
+			strings.Join(options, "&"),
+		)
+	}
+	fmt.Print(connstring)
+}
+
+// downToZeroAllowed reports whether migrating down to version 0 is allowed. --allow-down-to-zero overrides
+// allow_down_to_zero in the config.
+func downToZeroAllowed(cmd *cobra.Command, config *Config) bool {
+	if cmd.Flags().Changed("allow-down-to-zero") {
+		return cliOptions.allowDownToZero
+	}
+	return config.AllowDownToZero
+}
+
+func Reset(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	config, conn := loadConfigAndConnectToDB(ctx)
+	defer conn.Close(ctx)
+
+	if !downToZeroAllowed(cmd, config) {
+		fmt.Fprintln(os.Stderr, "Refusing to reset because allow_down_to_zero is false")
+		os.Exit(1)
+	}
+
+	migrator, err := migrate.NewMigratorEx(ctx, conn, config.VersionTable, &migrate.MigratorOptions{
+		LockIDFromVersionTable: config.LockIDFromTableName,
+		HistoryTable:           config.HistoryTable,
+		GuardSQL:               config.GuardSQL,
+		GuardMessage:           config.GuardMessage,
+		Delims:                 config.TemplateDelims,
+	})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
 		os.Exit(1)
 	}
 	migrator.Data = config.Data
+	migrator.OnStart = func(sequence int32, name, direction, sql string) {
+		fmt.Printf("%s executing %s %s\n", time.Now().Format("2006-01-02 15:04:05"), name, direction)
+	}
 
-	migrationsPath := cliOptions.migrationsPath
-	err = migrator.LoadMigrations(os.DirFS(migrationsPath))
+	err = migrator.LoadMigrations(os.DirFS(cliOptions.migrationsPath))
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error loading migrations:\n  %v\n", err)
 		os.Exit(1)
@@ -630,232 +2570,259 @@ func Gengen(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	gengenTemplate := template.Must(template.New("gengen").Parse(`-- This file was generated by tern gengen v{{ .Version }}.
---
--- If using psql to execute this script use the --no-psqlrc, --tuples-only,
--- --quiet, and --no-align options to only output the migration SQL.
---
--- e.g. psql --no-psqlrc --tuples-only --quiet --no-align -f this_file.sql
---
--- The results can be redirected to a file where the proposed changes can be
--- inspected or the results can be piped back into psql to migrate immediately.
---
--- e.g. psql --no-psqlrc --tuples-only --quiet --no-align -f this_file.sql | psql
-
-set tern.version = -1;
-do $$
-declare
-	schema_version_table_exists boolean;
-begin
-	select to_regclass('{{ .VersionTable }}') is not null into schema_version_table_exists;
-	if schema_version_table_exists then
-		perform set_config('tern.version', version::text, false) from {{ .VersionTable }};
-	end if;
-end
-$$;
-
-with migrations(version, up_sql) as (
-	values
-	(0,
-$tern_gengen$
-begin;
-create table {{ .VersionTable }}(version int4 not null);
-insert into {{ .VersionTable }}(version) values(0);
-$tern_gengen$)
-{{ range .Migrations }}
-, ({{ .Sequence }},
-$tern_gengen$
--- {{ .Name }}
-begin;
-{{ .UpSQL }}$tern_gengen$)
-{{ end }}
-)
-select up_sql || '
-update {{ .VersionTable }} set version = ' || version || ';
-commit;
-'
-from migrations
-where version > current_setting('tern.version')::int4
-order by version asc;
+	for _, m := range migrator.Migrations {
+		if !m.Reversible() {
+			fmt.Fprintf(os.Stderr, "Cannot reset: %s is irreversible\n", m.Name)
+			os.Exit(1)
+		}
+	}
 
-`))
+	currentVersion, err := migrator.GetCurrentVersion(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error retrieving migration version:\n  %v\n", err)
+		os.Exit(1)
+	}
 
-	var out *os.File
-	if cliOptions.outputFile == "" {
-		out = os.Stdout
-	} else {
-		var err error
-		out, err = os.Create(cliOptions.outputFile)
-		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+	fmt.Printf("This will migrate database %s on host %s down from version %d to 0 and back up to %d. Data in objects created by the migrations will be lost.\n", config.ConnConfig.Database, config.ConnConfig.Host, currentVersion, len(migrator.Migrations))
+	if !cliOptions.yes {
+		fmt.Print("Continue? [y/N] ")
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		answer = strings.ToLower(strings.TrimSpace(answer))
+		if answer != "y" && answer != "yes" {
+			fmt.Fprintln(os.Stderr, "Reset canceled")
 			os.Exit(1)
 		}
-		defer out.Close()
 	}
 
-	err = gengenTemplate.Execute(out, map[string]any{
-		"Version":      VERSION,
-		"VersionTable": config.VersionTable,
-		"Migrations":   migrator.Migrations,
-	})
+	err = migrator.MigrateTo(ctx, 0)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "Error generating gengen script:", err)
+		printMigrationErrors(err, "Failed migrating down:\n  ", nil)
 		os.Exit(1)
 	}
-}
-
-func InstallCode(cmd *cobra.Command, args []string) {
-	path := args[0]
 
-	codePackage, err := migrate.LoadCodePackage(os.DirFS(path))
+	err = migrator.MigrateTo(ctx, int32(len(migrator.Migrations)))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to load code package:\n  %v\n", err)
+		printMigrationErrors(err, "Failed migrating up:\n  ", nil)
 		os.Exit(1)
 	}
 
+	fmt.Printf("Reset to version %d\n", len(migrator.Migrations))
+}
+
+func RunTestRoundtrip(cmd *cobra.Command, args []string) {
 	ctx := context.Background()
 	config, conn := loadConfigAndConnectToDB(ctx)
 	defer conn.Close(ctx)
 
-	sql, err := codePackage.Eval(config.Data)
+	fmt.Printf("Testing migrations against database %s on host %s\n", config.ConnConfig.Database, config.ConnConfig.Host)
+
+	objects, err := schemaObjects(ctx, conn, config.VersionTable)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to evaluate code package:\n  %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error reading database objects:\n  %v\n", err)
 		os.Exit(1)
 	}
-
-	err = migrate.LockExecTx(ctx, conn, sql)
-	if err != nil {
-		if migrationpgError, ok := err.(migrate.MigrationPgError); ok {
-			fmt.Fprintln(os.Stderr, migrationpgError)
-			if migrationpgError.Detail != "" {
-				fmt.Fprintln(os.Stderr, "DETAIL:", migrationpgError.Detail)
-			}
-
-			if migrationpgError.Position != 0 {
-				ele, err := migrate.ExtractErrorLine(migrationpgError.Sql, int(migrationpgError.Position))
-				if err != nil {
-					fmt.Fprintln(os.Stderr, err)
-					os.Exit(1)
-				}
-
-				prefix := fmt.Sprintf("LINE %d: ", ele.LineNum)
-				fmt.Fprintf(os.Stderr, "%s%s\n", prefix, ele.Text)
-
-				padding := strings.Repeat(" ", len(prefix)+ele.ColumnNum-1)
-				fmt.Fprintf(os.Stderr, "%s^\n", padding)
-			}
-		} else {
-			fmt.Fprintf(os.Stderr, "Failed to install code package:\n  %v\n", err)
-		}
+	if len(objects) > 0 && !cliOptions.force {
+		fmt.Fprintf(os.Stderr, "Refusing to run against database %s because it is not empty (it contains %s). Use a throwaway database or --force.\n", config.ConnConfig.Database, objects[0])
 		os.Exit(1)
 	}
-}
-
-func CompileCode(cmd *cobra.Command, args []string) {
-	path := args[0]
 
-	codePackage, err := migrate.LoadCodePackage(os.DirFS(path))
+	migrator, err := migrate.NewMigratorEx(ctx, conn, config.VersionTable, &migrate.MigratorOptions{Delims: config.TemplateDelims, LockIDFromVersionTable: config.LockIDFromTableName})
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to load code package:\n  %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
 		os.Exit(1)
 	}
+	migrator.Data = config.Data
+	migrator.OnStart = func(sequence int32, name, direction, sql string) {
+		fmt.Printf("%s executing %s %s\n", time.Now().Format("2006-01-02 15:04:05"), name, direction)
+	}
 
-	config, err := LoadConfig()
+	err = migrator.LoadMigrations(os.DirFS(cliOptions.migrationsPath))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading config:\n  %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error loading migrations:\n  %v\n", err)
 		os.Exit(1)
 	}
-
-	err = config.Validate()
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Invalid config:\n  %v\n", err)
+	if len(migrator.Migrations) == 0 {
+		fmt.Fprintln(os.Stderr, "No migrations found")
 		os.Exit(1)
 	}
 
-	sql, err := codePackage.Eval(config.Data)
+	currentVersion, err := migrator.GetCurrentVersion(ctx)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to evaluate code package:\n  %v\n", err)
+		fmt.Fprintf(os.Stderr, "Error retrieving migration version:\n  %v\n", err)
 		os.Exit(1)
 	}
-
-	fmt.Println(sql)
-}
-
-func SnapshotCode(cmd *cobra.Command, args []string) {
-	path := args[0]
-
-	_, err := migrate.LoadCodePackage(os.DirFS(path))
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Failed to load code package:\n  %v\n", err)
+	if currentVersion != 0 {
+		fmt.Fprintf(os.Stderr, "The database is at version %d. test-roundtrip must start from version 0.\n", currentVersion)
 		os.Exit(1)
 	}
 
-	migrationsPath := cliOptions.migrationsPath
-
-	// If no migrations path was set in CLI argument look in environment.
-	if migrationsPath == "" {
-		migrationsPath = os.Getenv("TERN_MIGRATIONS")
+	// With --force the database may already contain objects. Only objects that differ from this are reported.
+	before, err := schemaObjects(ctx, conn, config.VersionTable)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error reading database objects:\n  %v\n", err)
+		os.Exit(1)
 	}
 
-	migrations, err := migrate.FindMigrations(os.DirFS(migrationsPath))
+	err = migrator.MigrateTo(ctx, int32(len(migrator.Migrations)))
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error loading migrations:\n  %v\n", err)
+		printMigrationErrors(err, "Failed migrating up:\n  ", nil)
 		os.Exit(1)
 	}
 
-	migrationID := fmt.Sprintf("%03d", len(migrations)+1)
-	snapshotPath := filepath.Join(migrationsPath, "snapshots", migrationID)
-	err = copyCodePackageDir(path, snapshotPath)
+	err = migrator.MigrateTo(ctx, 0)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error copying snapshot:\n  %v\n", err)
+		printMigrationErrors(err, "Failed migrating down:\n  ", nil)
 		os.Exit(1)
 	}
 
-	newMigrationName := fmt.Sprintf("%s_install_%s.sql", migrationID, filepath.Base(path))
-
-	// Write new migration
-	mPath := filepath.Join(migrationsPath, newMigrationName)
-	mFile, err := os.OpenFile(mPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o666)
+	after, err := schemaObjects(ctx, conn, config.VersionTable)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintf(os.Stderr, "Error reading database objects:\n  %v\n", err)
 		os.Exit(1)
 	}
-	defer mFile.Close()
 
-	_, err = fmt.Fprintf(mFile, `{{ install_snapshot "%s" }}`, migrationID)
-	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+	var leftover []string
+	for _, o := range after {
+		if !slices.Contains(before, o) {
+			leftover = append(leftover, o)
+		}
+	}
+	var missing []string
+	for _, o := range before {
+		if !slices.Contains(after, o) {
+			missing = append(missing, o)
+		}
+	}
+
+	if len(leftover) > 0 || len(missing) > 0 {
+		for _, o := range leftover {
+			fmt.Fprintf(os.Stderr, "left over after migrating down: %s\n", o)
+		}
+		for _, o := range missing {
+			fmt.Fprintf(os.Stderr, "dropped by migrating down: %s\n", o)
+		}
 		os.Exit(1)
 	}
+
+	fmt.Printf("Migrated up to version %d and down to version 0 with no objects left over\n", len(migrator.Migrations))
 }
 
-func PrintConnString(cmd *cobra.Command, args []string) {
-	config, err := LoadConfig()
+// schemaObjectsSQL lists the user created objects in the database as "kind name". Objects in system schemas, objects
+// that belong to an extension, and the version table named by $1 are excluded.
+const schemaObjectsSQL = `select 'schema ' || quote_ident(n.nspname)
+from pg_catalog.pg_namespace n
+where n.nspname not like 'pg\_%' and n.nspname <> 'information_schema' and n.nspname <> 'public'
+  and not exists (select 1 from pg_catalog.pg_depend d where d.classid='pg_catalog.pg_namespace'::regclass and d.objid=n.oid and d.deptype='e')
+union all
+select case c.relkind
+    when 'r' then 'table '
+    when 'p' then 'table '
+    when 'v' then 'view '
+    when 'm' then 'materialized view '
+    when 'S' then 'sequence '
+    when 'i' then 'index '
+    when 'I' then 'index '
+    when 'f' then 'foreign table '
+    when 'c' then 'type '
+    else 'relation '
+  end || c.oid::regclass::text
+from pg_catalog.pg_class c
+  join pg_catalog.pg_namespace n on c.relnamespace=n.oid
+where n.nspname not like 'pg\_%' and n.nspname <> 'information_schema'
+  and c.oid is distinct from to_regclass($1::text)
+  and not exists (select 1 from pg_catalog.pg_depend d where d.classid='pg_catalog.pg_class'::regclass and d.objid=c.oid and d.deptype='e')
+union all
+select 'function ' || p.oid::regprocedure::text
+from pg_catalog.pg_proc p
+  join pg_catalog.pg_namespace n on p.pronamespace=n.oid
+where n.nspname not like 'pg\_%' and n.nspname <> 'information_schema'
+  and not exists (select 1 from pg_catalog.pg_depend d where d.classid='pg_catalog.pg_proc'::regclass and d.objid=p.oid and d.deptype='e')
+union all
+select 'type ' || t.oid::regtype::text
+from pg_catalog.pg_type t
+  join pg_catalog.pg_namespace n on t.typnamespace=n.oid
+where n.nspname not like 'pg\_%' and n.nspname <> 'information_schema'
+  and t.typrelid=0 and t.typcategory <> 'A'
+  and not exists (select 1 from pg_catalog.pg_depend d where d.classid='pg_catalog.pg_type'::regclass and d.objid=t.oid and d.deptype='e')
+union all
+select 'extension ' || quote_ident(e.extname)
+from pg_catalog.pg_extension e
+where e.extname <> 'plpgsql'
+order by 1`
+
+// schemaObjects returns the user created objects in the database other than versionTable. See schemaObjectsSQL.
+func schemaObjects(ctx context.Context, conn *pgx.Conn, versionTable string) ([]string, error) {
+	rows, _ := conn.Query(ctx, schemaObjectsSQL, versionTable)
+	return pgx.CollectRows(rows, pgx.RowTo[string])
+}
+
+// versionTableCandidatesSQL lists the tables that look like a tern version table. That is, tables with a version int4
+// column and no other columns except in_progress. The second column is true for the table named by $1.
+const versionTableCandidatesSQL = `select quote_ident(n.nspname) || '.' || quote_ident(c.relname), coalesce(c.oid = to_regclass($1::text), false)
+from pg_catalog.pg_class c
+  join pg_catalog.pg_namespace n on n.oid=c.relnamespace
+where c.relkind in ('r', 'p')
+  and n.nspname not like 'pg\_%' and n.nspname <> 'information_schema'
+  and exists (
+    select 1 from pg_catalog.pg_attribute a
+    where a.attrelid=c.oid and a.attname='version' and a.atttypid='pg_catalog.int4'::regtype and not a.attisdropped
+  )
+  and not exists (
+    select 1 from pg_catalog.pg_attribute a
+    where a.attrelid=c.oid and a.attnum > 0 and not a.attisdropped and a.attname not in ('version', 'in_progress')
+  )
+order by 1`
+
+func DetectVersionTable(cmd *cobra.Command, args []string) {
+	ctx := context.Background()
+	config, conn := loadConfigAndConnectToDB(ctx)
+	defer conn.Close(ctx)
+
+	type candidate struct {
+		name       string
+		configured bool
+	}
+	rows, _ := conn.Query(ctx, versionTableCandidatesSQL, config.VersionTable)
+	candidates, err := pgx.CollectRows(rows, func(row pgx.CollectableRow) (candidate, error) {
+		var c candidate
+		err := row.Scan(&c.name, &c.configured)
+		return c, err
+	})
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		fmt.Fprintf(os.Stderr, "Error searching for version tables:\n  %v\n", err)
 		os.Exit(1)
 	}
 
-	connstring := config.ConnString
-	if connstring == "" {
-		options := ""
-		if ssl_mode := config.PGEnvvars["PGSSLMODE"]; ssl_mode != "" {
-			options += fmt.Sprintf("sslmode=%s&", ssl_mode)
+	if len(candidates) == 0 {
+		fmt.Println("No version tables found.")
+		return
+	}
+
+	configuredFound := false
+	for _, c := range candidates {
+		var version *int32
+		err := conn.QueryRow(ctx, "select version from "+c.name+" limit 1").Scan(&version)
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			fmt.Fprintf(os.Stderr, "Error reading version from %s:\n  %v\n", c.name, err)
+			os.Exit(1)
 		}
-		if ssl_cert := config.PGEnvvars["PGSSLROOTCERT"]; ssl_cert != "" {
-			options += fmt.Sprintf("sslrootcert=%s", ssl_cert)
+
+		line := c.name
+		if version != nil {
+			line += fmt.Sprintf("  version %d", *version)
+		} else {
+			line += "  no version"
 		}
-		connstring = fmt.Sprintf(
-			"postgres://%s:%s@%s:%d/%s?%s",
-			config.ConnConfig.User,
-			config.ConnConfig.Password,
-			config.ConnConfig.Host,
-			config.ConnConfig.Port,
-			config.ConnConfig.Database,
-			options,
-		)
+		if c.configured {
+			line += "  (configured)"
+			configuredFound = true
+		}
+		fmt.Println(line)
+	}
+
+	if !configuredFound {
+		fmt.Printf("The configured version_table %s is not among them. Set version_table to use one of these tables.\n", config.VersionTable)
 	}
-	fmt.Print(connstring)
 }
 
 func Status(cmd *cobra.Command, args []string) {
@@ -863,7 +2830,7 @@ func Status(cmd *cobra.Command, args []string) {
 	config, conn := loadConfigAndConnectToDB(ctx)
 	defer conn.Close(ctx)
 
-	migrator, err := migrate.NewMigrator(ctx, conn, config.VersionTable)
+	migrator, err := migrate.NewMigratorEx(ctx, conn, config.VersionTable, &migrate.MigratorOptions{Delims: config.TemplateDelims, LockIDFromVersionTable: config.LockIDFromTableName})
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
 		os.Exit(1)
@@ -887,10 +2854,20 @@ func Status(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
+	pendingRepeatable, err := migrator.PendingRepeatable(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error retrieving repeatable migrations:\n  %v\n", err)
+		os.Exit(1)
+	}
+
 	var status string
 	behindCount := len(migrator.Migrations) - int(migrationVersion)
-	if behindCount == 0 {
+	if behindCount == 0 && len(pendingRepeatable) > 0 {
+		status = "repeatable migration(s) pending"
+	} else if behindCount == 0 {
 		status = "up to date"
+	} else if behindCount < 0 {
+		status = "migration file(s) missing"
 	} else {
 		status = "migration(s) pending"
 	}
@@ -899,6 +2876,83 @@ func Status(cmd *cobra.Command, args []string) {
 	fmt.Printf("version:  %d of %d\n", migrationVersion, len(migrator.Migrations))
 	fmt.Println("host:    ", config.ConnConfig.Host)
 	fmt.Println("database:", config.ConnConfig.Database)
+
+	if irreversible := migrator.IrreversibleMigrations(); len(irreversible) > 0 {
+		names := make([]string, len(irreversible))
+		for i, m := range irreversible {
+			names[i] = m.Name
+		}
+		fmt.Println("irreversible:", strings.Join(names, ", "))
+	}
+
+	if len(migrator.RepeatableMigrations) > 0 {
+		fmt.Printf("repeatable: %d of %d pending\n", len(pendingRepeatable), len(migrator.RepeatableMigrations))
+		for _, rm := range pendingRepeatable {
+			fmt.Printf("  %s\n", rm.Name)
+		}
+	}
+
+	if behindCount < 0 {
+		fmt.Println()
+		fmt.Println(migrate.MissingMigrationsError{CurrentVersion: migrationVersion, MigrationCount: len(migrator.Migrations)})
+	}
+}
+
+func Repair(cmd *cobra.Command, args []string) {
+	setVersion := cmd.Flags().Changed("set-version")
+	if setVersion == cliOptions.detect {
+		fmt.Fprintln(os.Stderr, "Exactly one of --set-version or --detect is required")
+		os.Exit(1)
+	}
+
+	ctx := context.Background()
+	config, conn := loadConfigAndConnectToDB(ctx)
+	defer conn.Close(ctx)
+
+	migrator, err := migrate.NewMigratorEx(ctx, conn, config.VersionTable, &migrate.MigratorOptions{Delims: config.TemplateDelims, LockIDFromVersionTable: config.LockIDFromTableName})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
+		os.Exit(1)
+	}
+	migrator.Data = config.Data
+
+	err = migrator.LoadMigrations(os.DirFS(cliOptions.migrationsPath))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading migrations:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	migrationVersion, err := migrator.GetCurrentVersion(ctx)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error retrieving migration version:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	migrationCount := int32(len(migrator.Migrations))
+
+	if setVersion {
+		err = migrator.SetVersion(ctx, cliOptions.setVersion)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error setting version:\n  %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("version changed from %d to %d\n", migrationVersion, cliOptions.setVersion)
+		return
+	}
+
+	switch {
+	case migrationVersion < 0:
+		fmt.Printf("version %d is less than 0\n", migrationVersion)
+		fmt.Println("If no migrations have been applied run: tern repair --set-version 0")
+		os.Exit(1)
+	case migrationVersion > migrationCount:
+		fmt.Printf("version %d is greater than the %d migrations found\n", migrationVersion, migrationCount)
+		fmt.Println("Applied migration files appear to be missing. Restore them if possible.")
+		fmt.Printf("If the database schema matches the last migration run: tern repair --set-version %d\n", migrationCount)
+		os.Exit(1)
+	default:
+		fmt.Printf("version %d of %d is consistent with the migrations\n", migrationVersion, migrationCount)
+	}
 }
 
 func RenumberStart(cmd *cobra.Command, args []string) {
@@ -971,6 +3025,7 @@ func RenumberFinish(cmd *cobra.Command, args []string) {
 
 	numberPrefixRegexp := regexp.MustCompile(`^\d+`)
 	var lastMigrationNumber int64
+	padWidth := 3
 	for _, s := range originalMigrations {
 		numStr := numberPrefixRegexp.FindString(s)
 		num, err := strconv.ParseInt(numStr, 10, 64)
@@ -981,21 +3036,27 @@ func RenumberFinish(cmd *cobra.Command, args []string) {
 
 		if num > lastMigrationNumber {
 			lastMigrationNumber = num
+			padWidth = len(numStr)
 		}
 	}
 
-	makeMapFromStrings := func(slice []string) map[string]struct{} {
-		m := make(map[string]struct{})
-		for _, s := range slice {
-			m[s] = struct{}{}
+	if cmd.Flags().Changed("pad-width") {
+		if cliOptions.padWidth < 1 {
+			fmt.Fprintln(os.Stderr, "--pad-width must be at least 1")
+			os.Exit(1)
 		}
-		return m
+		padWidth = cliOptions.padWidth
+	}
+
+	// The up and down files of a split migration are matched by their stem so they stay together.
+	originalMigrationsMap := make(map[string]struct{})
+	for _, s := range originalMigrations {
+		originalMigrationsMap[migrationFileStem(s)] = struct{}{}
 	}
-	originalMigrationsMap := makeMapFromStrings(originalMigrations)
 
 	var migrationsToRenumber []string
 	for _, s := range currentMigrations {
-		if _, present := originalMigrationsMap[s]; !present {
+		if _, present := originalMigrationsMap[migrationFileStem(s)]; !present {
 			migrationsToRenumber = append(migrationsToRenumber, s)
 		}
 	}
@@ -1005,13 +3066,23 @@ func RenumberFinish(cmd *cobra.Command, args []string) {
 		iNum, _ := strconv.ParseInt(iStr, 10, 64)
 		jStr := numberPrefixRegexp.FindString(migrationsToRenumber[j])
 		jNum, _ := strconv.ParseInt(jStr, 10, 64)
-		return iNum < jNum
+		if iNum != jNum {
+			return iNum < jNum
+		}
+		return migrationFileStem(migrationsToRenumber[i]) < migrationFileStem(migrationsToRenumber[j])
 	})
 
+	newMigrationNumbers := make(map[string]int64)
 	for _, s := range migrationsToRenumber {
 		numPrefix := numberPrefixRegexp.FindString(s)
-		lastMigrationNumber++
-		newMigrationName := fmt.Sprintf("%03d%s", lastMigrationNumber, s[len(numPrefix):])
+		stem := migrationFileStem(s)
+		newMigrationNumber, present := newMigrationNumbers[stem]
+		if !present {
+			lastMigrationNumber++
+			newMigrationNumber = lastMigrationNumber
+			newMigrationNumbers[stem] = newMigrationNumber
+		}
+		newMigrationName := fmt.Sprintf("%0*d%s", padWidth, newMigrationNumber, s[len(numPrefix):])
 		err := os.Rename(filepath.Join(migrationsPath, s), filepath.Join(migrationsPath, newMigrationName))
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error renaming migration file:\n  %v\n", err)
@@ -1022,10 +3093,22 @@ func RenumberFinish(cmd *cobra.Command, args []string) {
 	os.Remove(renumberFilepath)
 }
 
+// migrationFileStem returns name without its .up.sql, .down.sql, or .sql extension. The up and down files of a split
+// migration have the same stem.
+func migrationFileStem(name string) string {
+	for _, suffix := range []string{".up.sql", ".down.sql", ".sql"} {
+		if strings.HasSuffix(name, suffix) {
+			return strings.TrimSuffix(name, suffix)
+		}
+	}
+	return name
+}
+
 // findMigrationsForRenumber finds migration files. Can't use migrate.FindMigrations because it fails when there are
 // duplicate numbers.
 func findMigrationsForRenumber(path string) ([]string, error) {
-	migrationPattern := regexp.MustCompile(`\A(\d+)_.+\.sql\z`)
+	// This must match the migration file name pattern used by migrate.FindMigrations.
+	migrationPattern := regexp.MustCompile(`\A(\d+)[_.].+\.sql\z`)
 
 	path = strings.TrimRight(path, string(filepath.Separator))
 
@@ -1053,9 +3136,11 @@ func findMigrationsForRenumber(path string) ([]string, error) {
 
 func LoadConfig() (*Config, error) {
 	config := &Config{
-		PGEnvvars:    make(map[string]string),
-		VersionTable: "public.schema_version",
-		Data:         make(map[string]interface{}),
+		PGEnvvars:       make(map[string]string),
+		RuntimeParams:   make(map[string]string),
+		VersionTable:    "public.schema_version",
+		AllowDownToZero: true,
+		Data:            make(map[string]interface{}),
 	}
 	// If no config path was set in CLI argument look in environment.
 	if len(cliOptions.configPaths) == 0 {
@@ -1064,11 +3149,15 @@ func LoadConfig() (*Config, error) {
 		}
 	}
 
-	// If no config path was set in CLI or environment try default location.
+	// If no config path was set in CLI or environment try default locations. Fragments in tern.conf.d override
+	// tern.conf.
 	if len(cliOptions.configPaths) == 0 {
 		if _, err := os.Stat("./tern.conf"); err == nil {
 			cliOptions.configPaths = append(cliOptions.configPaths, "./tern.conf")
 		}
+		if fi, err := os.Stat("./tern.conf.d"); err == nil && fi.IsDir() {
+			cliOptions.configPaths = append(cliOptions.configPaths, "./tern.conf.d")
+		}
 	}
 
 	for _, configFile := range cliOptions.configPaths {
@@ -1106,6 +3195,11 @@ func LoadConfig() (*Config, error) {
 		return nil, err
 	}
 
+	// connect_timeout is only whole seconds so --connect-timeout is applied directly to allow shorter timeouts.
+	if cliOptions.connectTimeout != 0 {
+		config.ConnConfig.ConnectTimeout = cliOptions.connectTimeout
+	}
+
 	if config.SSHConnConfig.User == "" {
 		user, err := user.Current()
 		if err != nil {
@@ -1120,14 +3214,75 @@ func LoadConfig() (*Config, error) {
 		config.SSHConnConfig.Port = "22"
 	}
 
+	// Runtime params are connection defaults so they are preserved by the reset all run after each migration.
+	for key, value := range config.RuntimeParams {
+		config.ConnConfig.RuntimeParams[key] = value
+	}
+
 	if config.ConnConfig.RuntimeParams["application_name"] == "" {
 		config.ConnConfig.RuntimeParams["application_name"] = "tern"
 	}
 
-	return config, nil
+	return config, nil
+}
+
+// databasePassthroughEnvvars maps additional libpq connection parameters that can be set in the database section of
+// the config to the PG* environment variables the PostgreSQL driver reads.
+var databasePassthroughEnvvars = map[string]string{
+	"application_name":     "PGAPPNAME",
+	"connect_timeout":      "PGCONNECT_TIMEOUT",
+	"passfile":             "PGPASSFILE",
+	"service":              "PGSERVICE",
+	"servicefile":          "PGSERVICEFILE",
+	"sslpassword":          "PGSSLPASSWORD",
+	"sslsni":               "PGSSLSNI",
+	"target_session_attrs": "PGTARGETSESSIONATTRS",
+}
+
+// unsupportedDatabaseParams are libpq connection parameters that the PostgreSQL driver used by tern does not
+// implement. They are rejected rather than ignored as they are typically security requirements.
+var unsupportedDatabaseParams = map[string]struct{}{
+	"channel_binding": {},
+	"require_auth":    {},
+	"sslnegotiation":  {},
+}
+
+// appendConfigFromFile loads path into config. If path is a directory every *.conf file in it is loaded in lexical order
+// so settings in later files override earlier ones.
+func appendConfigFromFile(config *Config, path string) error {
+	fi, err := os.Stat(path)
+	if err != nil || !fi.IsDir() {
+		return appendConfigFromFileWithIncludes(config, path, make(map[string]bool))
+	}
+
+	fragments, err := filepath.Glob(filepath.Join(path, "*.conf"))
+	if err != nil {
+		return err
+	}
+	for _, fragment := range fragments {
+		err := appendConfigFromFileWithIncludes(config, fragment, make(map[string]bool))
+		if err != nil {
+			return fmt.Errorf("%s: %w", fragment, err)
+		}
+	}
+
+	return nil
 }
 
-func appendConfigFromFile(config *Config, path string) error {
+// appendConfigFromFileWithIncludes loads path into config. A top-level include directive names another config file,
+// relative to path, that is loaded first so the settings in path override it. including holds the files currently
+// being loaded and is used to detect include cycles.
+func appendConfigFromFileWithIncludes(config *Config, path string, including map[string]bool) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	if including[absPath] {
+		return fmt.Errorf("%s: include cycle detected", path)
+	}
+	including[absPath] = true
+	defer delete(including, absPath)
+
 	fileBytes, err := os.ReadFile(path)
 	if err != nil {
 		return err
@@ -1138,17 +3293,51 @@ func appendConfigFromFile(config *Config, path string) error {
 		return err
 	}
 
-	var buf bytes.Buffer
-	err = confTemplate.Execute(&buf, map[string]interface{}{})
+	// The file is rendered twice. The first render has no data values and is only used to find the include, data, and
+	// data_file settings. The second render has all data values known so far so settings such as version_table can
+	// reference them.
+	file, err := renderConfigFile(confTemplate, map[string]interface{}{})
 	if err != nil {
 		return err
 	}
 
-	file, err := ini.Load(&buf)
+	if include, ok := file.Get("", "include"); ok {
+		if !filepath.IsAbs(include) {
+			include = filepath.Join(filepath.Dir(path), include)
+		}
+		err := appendConfigFromFileWithIncludes(config, include, including)
+		if err != nil {
+			return fmt.Errorf("%s: include: %w", path, err)
+		}
+	}
+
+	for key, value := range file["data"] {
+		config.Data[key] = value
+	}
+
+	if dataFile, ok := file.Get("", "data_file"); ok {
+		if !filepath.IsAbs(dataFile) {
+			dataFile = filepath.Join(filepath.Dir(path), dataFile)
+		}
+		err := appendDataFromFile(config, dataFile)
+		if err != nil {
+			return fmt.Errorf("%s: data_file: %w", path, err)
+		}
+	}
+
+	file, err = renderConfigFile(confTemplate, configTemplateData(config))
 	if err != nil {
 		return err
 	}
 
+	if delims, ok := file.Get("", "template_delims"); ok {
+		fields := strings.Fields(delims)
+		if len(fields) != 2 {
+			return fmt.Errorf("template_delims must be a left and right delimiter separated by a space: %q", delims)
+		}
+		config.TemplateDelims = [2]string{fields[0], fields[1]}
+	}
+
 	if connString, ok := file.Get("database", "conn_string"); ok {
 		config.ConnString = connString
 		if _, err := pgx.ParseConfig(connString); err != nil {
@@ -1182,7 +3371,9 @@ func appendConfigFromFile(config *Config, path string) error {
 	if user, ok := file.Get("database", "user"); ok {
 		config.PGEnvvars["PGUSER"] = user
 	}
-	if password, ok := file.Get("database", "password"); ok {
+	// An empty password, such as from a password = {{env "DB_PASSWORD"}} line when DB_PASSWORD is not set, must not
+	// override PGPASSWORD from the environment or prevent the password from being read from PGPASSFILE or ~/.pgpass.
+	if password, ok := file.Get("database", "password"); ok && password != "" {
 		config.PGEnvvars["PGPASSWORD"] = password
 	}
 
@@ -1190,6 +3381,43 @@ func appendConfigFromFile(config *Config, path string) error {
 		config.VersionTable = vt
 	}
 
+	if ht, ok := file.Get("database", "history_table"); ok {
+		config.HistoryTable = ht
+	}
+
+	if guardSQL, ok := file.Get("database", "guard_sql"); ok {
+		config.GuardSQL = guardSQL
+	}
+
+	if guardMessage, ok := file.Get("database", "guard_message"); ok {
+		config.GuardMessage = guardMessage
+	}
+
+	if notifyChannel, ok := file.Get("database", "notify_channel"); ok {
+		config.NotifyChannel = notifyChannel
+	}
+
+	if allowDownToZero, ok := file.Get("database", "allow_down_to_zero"); ok {
+		config.AllowDownToZero, err = strconv.ParseBool(allowDownToZero)
+		if err != nil {
+			return fmt.Errorf("error while parsing allow_down_to_zero property: %w", err)
+		}
+	}
+
+	if lockIDFromTableName, ok := file.Get("database", "lock_id_from_table_name"); ok {
+		config.LockIDFromTableName, err = strconv.ParseBool(lockIDFromTableName)
+		if err != nil {
+			return fmt.Errorf("error while parsing lock_id_from_table_name property: %w", err)
+		}
+	}
+
+	if notifyAlways, ok := file.Get("database", "notify_always"); ok {
+		config.NotifyAlways, err = strconv.ParseBool(notifyAlways)
+		if err != nil {
+			return fmt.Errorf("error while parsing notify_always property: %w", err)
+		}
+	}
+
 	if sslmode, ok := file.Get("database", "sslmode"); ok {
 		config.PGEnvvars["PGSSLMODE"] = sslmode
 	}
@@ -1198,8 +3426,25 @@ func appendConfigFromFile(config *Config, path string) error {
 		config.PGEnvvars["PGSSLROOTCERT"] = sslrootcert
 	}
 
-	for key, value := range file["data"] {
-		config.Data[key] = value
+	if sslcert, ok := file.Get("database", "sslcert"); ok {
+		config.PGEnvvars["PGSSLCERT"] = sslcert
+	}
+
+	if sslkey, ok := file.Get("database", "sslkey"); ok {
+		config.PGEnvvars["PGSSLKEY"] = sslkey
+	}
+
+	for key, value := range file["database"] {
+		if _, ok := unsupportedDatabaseParams[key]; ok {
+			return fmt.Errorf("%s: %s is not supported by tern because its PostgreSQL driver does not implement it", path, key)
+		}
+		if envvar, ok := databasePassthroughEnvvars[key]; ok {
+			config.PGEnvvars[envvar] = value
+		}
+	}
+
+	for key, value := range file["runtime_params"] {
+		config.RuntimeParams[key] = value
 	}
 
 	if host, ok := file.Get("ssh-tunnel", "host"); ok {
@@ -1225,6 +3470,74 @@ func appendConfigFromFile(config *Config, path string) error {
 	if passphrase, ok := file.Get("ssh-tunnel", "passphrase"); ok {
 		config.SSHConnConfig.Passphrase = passphrase
 	}
+
+	if noAgent, ok := file.Get("ssh-tunnel", "no_agent"); ok {
+		config.SSHConnConfig.NoAgent, err = strconv.ParseBool(noAgent)
+		if err != nil {
+			return fmt.Errorf("error while parsing no_agent property: %w", err)
+		}
+	}
+
+	if agentSock, ok := file.Get("ssh-tunnel", "agent_sock"); ok {
+		config.SSHConnConfig.AgentSock = agentSock
+	}
+	return nil
+}
+
+func renderConfigFile(confTemplate *template.Template, data map[string]interface{}) (ini.File, error) {
+	var buf bytes.Buffer
+	err := confTemplate.Execute(&buf, data)
+	if err != nil {
+		return nil, err
+	}
+
+	return ini.Load(&buf)
+}
+
+// configTemplateData returns the data values available to config file templates. These are the data values loaded so
+// far overridden by any --set values. Malformed --set values are ignored here and reported by appendConfigFromCLIArgs.
+func configTemplateData(config *Config) map[string]interface{} {
+	data := make(map[string]interface{}, len(config.Data)+len(cliOptions.dataValues))
+	for key, value := range config.Data {
+		data[key] = value
+	}
+	for _, dataValue := range cliOptions.dataValues {
+		if key, value, found := strings.Cut(dataValue, "="); found && key != "" {
+			data[key] = value
+		}
+	}
+	return data
+}
+
+// appendDataFromFile merges the top-level keys of a JSON, YAML, or ini file into config.Data. The format is chosen by
+// the file extension. Files with any extension other than .json, .yaml, or .yml are read as ini.
+func appendDataFromFile(config *Config, path string) error {
+	fileBytes, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	data := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		err = json.Unmarshal(fileBytes, &data)
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(fileBytes, &data)
+	default:
+		var file ini.File
+		file, err = ini.Load(bytes.NewReader(fileBytes))
+		for key, value := range file[""] {
+			data[key] = value
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	for key, value := range data {
+		config.Data[key] = value
+	}
+
 	return nil
 }
 
@@ -1257,9 +3570,35 @@ func appendConfigFromCLIArgs(config *Config) error {
 	if cliOptions.sslrootcert != "" {
 		config.PGEnvvars["PGSSLROOTCERT"] = cliOptions.sslrootcert
 	}
+	if cliOptions.sslcert != "" {
+		config.PGEnvvars["PGSSLCERT"] = cliOptions.sslcert
+	}
+	if cliOptions.sslkey != "" {
+		config.PGEnvvars["PGSSLKEY"] = cliOptions.sslkey
+	}
 	if cliOptions.versionTable != "" {
 		config.VersionTable = cliOptions.versionTable
 	}
+	if cliOptions.historyTable != "" {
+		config.HistoryTable = cliOptions.historyTable
+	}
+	if cliOptions.lockIDFromTableName {
+		config.LockIDFromTableName = true
+	}
+	for _, param := range cliOptions.runtimeParams {
+		key, value, found := strings.Cut(param, "=")
+		if !found || key == "" {
+			return fmt.Errorf("runtime-param argument must be in key=value format: %q", param)
+		}
+		config.RuntimeParams[key] = value
+	}
+	for _, dataValue := range cliOptions.dataValues {
+		key, value, found := strings.Cut(dataValue, "=")
+		if !found || key == "" {
+			return fmt.Errorf("set argument must be in key=value format: %q", dataValue)
+		}
+		config.Data[key] = value
+	}
 
 	if cliOptions.sshHost != "" {
 		config.SSHConnConfig.Host = cliOptions.sshHost
@@ -1279,11 +3618,299 @@ func appendConfigFromCLIArgs(config *Config) error {
 	if cliOptions.sshPassphrase != "" {
 		config.SSHConnConfig.Passphrase = cliOptions.sshPassphrase
 	}
+	if cliOptions.sshNoAgent {
+		config.SSHConnConfig.NoAgent = true
+	}
+	if cliOptions.sshAgentSock != "" {
+		config.SSHConnConfig.AgentSock = cliOptions.sshAgentSock
+	}
 
 	return nil
 }
 
+// listedMigration is the JSON representation of a migration printed by tern list. A repeatable migration has no
+// sequence.
+type listedMigration struct {
+	Sequence      int32             `json:"sequence,omitempty"`
+	Name          string            `json:"name"`
+	Repeatable    bool              `json:"repeatable,omitempty"`
+	Reversible    bool              `json:"reversible"`
+	Transactional bool              `json:"transactional"`
+	SQLLength     int               `json:"sql_length"`
+	SHA256        string            `json:"sha256"`
+	Metadata      map[string]string `json:"metadata,omitempty"`
+}
+
+// formatMetadata formats migration metadata as "key: value" pairs sorted by key. e.g. "author: jane, ticket: JIRA-123".
+func formatMetadata(metadata map[string]string) string {
+	keys := make([]string, 0, len(metadata))
+	for k := range metadata {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	pairs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		pairs = append(pairs, k+": "+metadata[k])
+	}
+	return strings.Join(pairs, ", ")
+}
+
+func List(cmd *cobra.Command, args []string) {
+	if cliOptions.format != "text" && cliOptions.format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown format %q (must be text or json)\n", cliOptions.format)
+		os.Exit(1)
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	migrator, err := migrate.NewMigratorEx(context.Background(), nil, config.VersionTable, &migrate.MigratorOptions{Delims: config.TemplateDelims})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
+		os.Exit(1)
+	}
+	migrator.Data = config.Data
+
+	err = migrator.LoadMigrations(os.DirFS(cliOptions.migrationsPath))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading migrations:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	migrations := make([]listedMigration, 0, len(migrator.Migrations))
+	for _, m := range migrator.Migrations {
+		migrations = append(migrations, listedMigration{
+			Sequence:      m.Sequence,
+			Name:          m.Name,
+			Reversible:    m.Reversible(),
+			Transactional: !m.DisableTx("up"),
+			SQLLength:     len(m.UpSQL),
+			SHA256:        m.Checksum(),
+			Metadata:      m.Metadata,
+		})
+	}
+	for _, rm := range migrator.RepeatableMigrations {
+		migrations = append(migrations, listedMigration{
+			Name:          rm.Name,
+			Repeatable:    true,
+			Transactional: true,
+			SQLLength:     len(rm.SQL),
+			SHA256:        rm.Checksum(),
+		})
+	}
+
+	if cliOptions.format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(migrations)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error writing migrations:\n  %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	for _, m := range migrations {
+		if m.Repeatable {
+			fmt.Printf("  R %s\n", m.Name)
+			continue
+		}
+
+		var notes []string
+		if !m.Reversible {
+			notes = append(notes, "irreversible")
+		}
+		if !m.Transactional {
+			notes = append(notes, "disable-tx")
+		}
+		if metadata := formatMetadata(m.Metadata); metadata != "" {
+			notes = append(notes, metadata)
+		}
+
+		if len(notes) > 0 {
+			fmt.Printf("%3d %s (%s)\n", m.Sequence, m.Name, strings.Join(notes, ", "))
+		} else {
+			fmt.Printf("%3d %s\n", m.Sequence, m.Name)
+		}
+	}
+}
+
+func Graph(cmd *cobra.Command, args []string) {
+	if cliOptions.graphFormat != "dot" && cliOptions.graphFormat != "mermaid" {
+		fmt.Fprintf(os.Stderr, "Unknown format %q (must be dot or mermaid)\n", cliOptions.graphFormat)
+		os.Exit(1)
+	}
+
+	config, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	migrator, err := migrate.NewMigratorEx(context.Background(), nil, config.VersionTable, &migrate.MigratorOptions{Delims: config.TemplateDelims})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
+		os.Exit(1)
+	}
+	migrator.Data = config.Data
+
+	err = migrator.LoadMigrations(os.DirFS(cliOptions.migrationsPath))
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading migrations:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	if cliOptions.graphFormat == "mermaid" {
+		writeMermaidGraph(os.Stdout, migrator.Migrations)
+	} else {
+		writeDOTGraph(os.Stdout, migrator.Migrations)
+	}
+}
+
+// graphNotes returns the notes shown under the name of m in a migration graph.
+func graphNotes(m *migrate.Migration) []string {
+	var notes []string
+	if !m.Reversible() {
+		notes = append(notes, "irreversible")
+	}
+	if m.DisableTx("up") {
+		notes = append(notes, "disable-tx")
+	}
+	return notes
+}
+
+func writeDOTGraph(w io.Writer, migrations []*migrate.Migration) {
+	fmt.Fprintln(w, "digraph migrations {")
+	fmt.Fprintln(w, "  rankdir=LR;")
+	fmt.Fprintln(w, "  node [shape=box];")
+	for i, m := range migrations {
+		label := fmt.Sprintf("%d %s", m.Sequence, m.Name)
+		if notes := graphNotes(m); len(notes) > 0 {
+			label += "\n" + strings.Join(notes, ", ")
+		}
+		attrs := []string{"label=" + dotQuote(label)}
+		if !m.Reversible() {
+			attrs = append(attrs, "color=red")
+		}
+		if m.DisableTx("up") {
+			attrs = append(attrs, "style=dashed")
+		}
+		fmt.Fprintf(w, "  m%d [%s];\n", m.Sequence, strings.Join(attrs, ", "))
+		if i > 0 {
+			fmt.Fprintf(w, "  m%d -> m%d;\n", migrations[i-1].Sequence, m.Sequence)
+		}
+	}
+	fmt.Fprintln(w, "}")
+}
+
+// dotQuote returns s as a DOT quoted string.
+func dotQuote(s string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s) + `"`
+}
+
+func writeMermaidGraph(w io.Writer, migrations []*migrate.Migration) {
+	fmt.Fprintln(w, "flowchart LR")
+	var irreversible, disableTx []string
+	for i, m := range migrations {
+		node := fmt.Sprintf("m%d", m.Sequence)
+		label := fmt.Sprintf("%d %s", m.Sequence, m.Name)
+		if notes := graphNotes(m); len(notes) > 0 {
+			label += "<br>" + strings.Join(notes, ", ")
+		}
+		fmt.Fprintf(w, "  %s[\"%s\"]\n", node, strings.ReplaceAll(label, `"`, "#quot;"))
+		if i > 0 {
+			fmt.Fprintf(w, "  m%d --> %s\n", migrations[i-1].Sequence, node)
+		}
+		if !m.Reversible() {
+			irreversible = append(irreversible, node)
+		}
+		if m.DisableTx("up") {
+			disableTx = append(disableTx, node)
+		}
+	}
+	if len(irreversible) > 0 {
+		fmt.Fprintln(w, "  classDef irreversible stroke:red")
+		fmt.Fprintf(w, "  class %s irreversible\n", strings.Join(irreversible, ","))
+	}
+	if len(disableTx) > 0 {
+		fmt.Fprintln(w, "  classDef disableTx stroke-dasharray:5")
+		fmt.Fprintf(w, "  class %s disableTx\n", strings.Join(disableTx, ","))
+	}
+}
+
+func Diff(cmd *cobra.Command, args []string) {
+	config, err := LoadConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Error loading config:\n  %v\n", err)
+		os.Exit(1)
+	}
+
+	loadMigrations := func(dir string) []*migrate.Migration {
+		migrator, err := migrate.NewMigratorEx(context.Background(), nil, config.VersionTable, &migrate.MigratorOptions{Delims: config.TemplateDelims})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
+			os.Exit(1)
+		}
+		migrator.Data = config.Data
+
+		err = migrator.LoadMigrations(os.DirFS(dir))
+		if err != nil && !errors.Is(err, migrate.NoMigrationsFoundError{}) {
+			fmt.Fprintf(os.Stderr, "Error loading migrations from %s:\n  %v\n", dir, err)
+			os.Exit(1)
+		}
+		return migrator.Migrations
+	}
+
+	migrationsA := loadMigrations(args[0])
+	migrationsB := loadMigrations(args[1])
+
+	changed := false
+	for i := 0; i < len(migrationsA) || i < len(migrationsB); i++ {
+		switch {
+		case i >= len(migrationsA):
+			fmt.Printf("added     %s\n", migrationsB[i].Name)
+		case i >= len(migrationsB):
+			fmt.Printf("removed   %s\n", migrationsA[i].Name)
+			changed = true
+		case migrationsA[i].Name != migrationsB[i].Name:
+			fmt.Printf("modified  %s -> %s\n", migrationsA[i].Name, migrationsB[i].Name)
+			changed = true
+		case migrationsA[i].Checksum() != migrationsB[i].Checksum():
+			fmt.Printf("modified  %s\n", migrationsB[i].Name)
+			changed = true
+		}
+	}
+
+	if changed {
+		os.Exit(1)
+	}
+}
+
+// defaultGeneratedAt is the .GeneratedAt used by gengen and print-migrations. A fixed time is used so their output is
+// the same every time they are run.
+const defaultGeneratedAt = "1970-01-01T00:00:00Z"
+
+func mustParseGeneratedAt() time.Time {
+	generatedAt, err := time.Parse(time.RFC3339, cliOptions.generatedAt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Bad generated at time:\n  %v\n", err)
+		os.Exit(1)
+	}
+	return generatedAt
+}
+
 func PrintMigrations(cmd *cobra.Command, args []string) {
+	if cliOptions.format != "text" && cliOptions.format != "json" {
+		fmt.Fprintf(os.Stderr, "Unknown format %q (must be text or json)\n", cliOptions.format)
+		os.Exit(1)
+	}
+	mustValidateLineEndings()
+
+	generatedAt := mustParseGeneratedAt()
 
 	ctx := context.Background()
 
@@ -1307,7 +3934,7 @@ func PrintMigrations(cmd *cobra.Command, args []string) {
 			fmt.Fprintf(os.Stderr, "Error connecting to database:\n  %v\n", err)
 			os.Exit(1)
 		}
-		migrator, err = migrate.NewMigrator(ctx, conn, config.VersionTable)
+		migrator, err = migrate.NewMigratorEx(ctx, conn, config.VersionTable, &migrate.MigratorOptions{Delims: config.TemplateDelims, GeneratedAt: generatedAt, LockIDFromVersionTable: config.LockIDFromTableName})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
 			os.Exit(1)
@@ -1321,7 +3948,7 @@ func PrintMigrations(cmd *cobra.Command, args []string) {
 		}
 		currentVersion = int32(n)
 
-		migrator, err = migrate.NewMigrator(ctx, nil, config.VersionTable)
+		migrator, err = migrate.NewMigratorEx(ctx, nil, config.VersionTable, &migrate.MigratorOptions{Delims: config.TemplateDelims, GeneratedAt: generatedAt})
 		if err != nil {
 			fmt.Fprintf(os.Stderr, "Error initializing migrator:\n  %v\n", err)
 			os.Exit(1)
@@ -1350,17 +3977,64 @@ func PrintMigrations(cmd *cobra.Command, args []string) {
 		os.Exit(1)
 	}
 
-	var out *os.File
-	if cliOptions.outputFile == "" {
-		out = os.Stdout
-	} else {
-		var err error
-		out, err = os.Create(cliOptions.outputFile)
+	// Like tern migrate, repeatable migrations are only run when migrating to the last version. Without a connection
+	// it is not known which have already been run so all are printed.
+	var repeatable []*migrate.RepeatableMigration
+	if cliOptions.destinationVersion == "last" {
+		if cliOptions.currentVersion == "from_db" {
+			repeatable, err = migrator.PendingRepeatable(ctx)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "Error retrieving repeatable migrations:\n  %v\n", err)
+				os.Exit(1)
+			}
+		} else {
+			repeatable = migrator.RepeatableMigrations
+		}
+	}
+
+	out, err := createOutputFile(cliOptions.outputFile)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if out != os.Stdout {
+		defer out.Close()
+	}
+	w := newLineEndingWriter(out)
+
+	if cliOptions.format == "json" {
+		planJSON := printedMigrationPlan{
+			CurrentVersion: plan.CurrentVersion,
+			TargetVersion:  plan.TargetVersion,
+			Direction:      plan.DirectionName,
+			Migrations:     make([]printedMigrationStep, 0, len(plan.Migrations)+len(repeatable)),
+		}
+		for _, step := range plan.Migrations {
+			planJSON.Migrations = append(planJSON.Migrations, printedMigrationStep{
+				Sequence:  step.Migration.Sequence,
+				Name:      step.Name,
+				Direction: plan.DirectionName,
+				SQL:       step.SQL,
+				DisableTx: step.Migration.DisableTx(plan.DirectionName),
+				Metadata:  step.Migration.Metadata,
+			})
+		}
+		for _, rm := range repeatable {
+			planJSON.Migrations = append(planJSON.Migrations, printedMigrationStep{
+				Name:      rm.Name,
+				Direction: "repeatable",
+				SQL:       rm.SQL,
+			})
+		}
+
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(planJSON)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, err)
+			fmt.Fprintln(os.Stderr, "Error generating migration plan:", err)
 			os.Exit(1)
 		}
-		defer out.Close()
+		return
 	}
 
 	printMigrationsTemplate := template.Must(template.New("print-migrations").Parse(
@@ -1371,13 +4045,19 @@ func PrintMigrations(cmd *cobra.Command, args []string) {
 -- {{ .Name }}
 {{ if .SQL }}{{ .SQL }}{{ else }}-- empty migration{{ end }}
 
+{{end }}
+{{- range .Repeatable -}}
+-- {{ .Name }} (repeatable)
+{{ if .SQL }}{{ .SQL }}{{ else }}-- empty migration{{ end }}
+
 {{end }}
 `))
-	err = printMigrationsTemplate.Execute(out, map[string]any{
+	err = printMigrationsTemplate.Execute(w, map[string]any{
 		"Version":      VERSION,
 		"VersionTable": config.VersionTable,
 		"Migrations":   plan.Migrations,
 		"Plan":         plan,
+		"Repeatable":   repeatable,
 	})
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error generating migration script:", err)
@@ -1385,6 +4065,23 @@ func PrintMigrations(cmd *cobra.Command, args []string) {
 	}
 }
 
+// printedMigrationPlan is the print-migrations --format json representation of a MigrationPlan.
+type printedMigrationPlan struct {
+	CurrentVersion int32                  `json:"current_version"`
+	TargetVersion  int32                  `json:"target_version"`
+	Direction      string                 `json:"direction"`
+	Migrations     []printedMigrationStep `json:"migrations"`
+}
+
+type printedMigrationStep struct {
+	Sequence  int32             `json:"sequence"`
+	Name      string            `json:"name"`
+	Direction string            `json:"direction"`
+	SQL       string            `json:"sql"`
+	DisableTx bool              `json:"disable_tx"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
 type MigrationStep struct {
 	migrate.Migration
 	SQL      string
@@ -1405,7 +4102,11 @@ func PlanMigration(migrator *migrate.Migrator, currentVersion, targetVersion int
 		return nil, migrate.BadVersionError(errMsg)
 	}
 
-	if currentVersion < 0 || currentVersion > int32(len(migrator.Migrations)) {
+	if currentVersion > int32(len(migrator.Migrations)) {
+		return nil, migrate.MissingMigrationsError{CurrentVersion: currentVersion, MigrationCount: len(migrator.Migrations)}
+	}
+
+	if currentVersion < 0 {
 		errMsg := fmt.Sprintf("current version %d is outside the valid versions of 0 to %d", currentVersion, len(migrator.Migrations))
 		return nil, migrate.BadVersionError(errMsg)
 	}
@@ -7,27 +7,180 @@ import (
 	"fmt"
 	"io/fs"
 	"path/filepath"
+	"sort"
+	"strings"
 	"text/template"
 
 	"github.com/Masterminds/sprig/v3"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/tern/v2/sqlsplit"
 )
 
+// CodePackage is a set of database code that is dropped and recreated as a whole. A code package is a directory with
+// an install.sql file, a deps.txt file listing the files to install in dependency order, or both.
 type CodePackage struct {
-	tmpl *template.Template
+	tmpl  *template.Template
+	deps  []string
+	files []string
+
+	// Manifest is the objects the code package is expected to create. It is read from the optional manifest.txt file in
+	// the code package. InstallCodePackage fails if any of these objects do not exist after the code package is
+	// installed.
+	Manifest []CodeObject
+}
+
+// CodeObject is a database object listed in the manifest.txt of a code package.
+type CodeObject struct {
+	Kind string // function, table, view, sequence, or index
+	Name string // Name which may be schema qualified
+}
+
+func (o CodeObject) String() string {
+	return o.Kind + " " + o.Name
+}
+
+// MissingCodeObjectsError is returned by InstallCodePackage when objects listed in the manifest do not exist after the
+// code package is installed.
+type MissingCodeObjectsError struct {
+	Objects []CodeObject
+}
+
+func (e MissingCodeObjectsError) Error() string {
+	names := make([]string, len(e.Objects))
+	for i, o := range e.Objects {
+		names[i] = o.String()
+	}
+	return "code package is missing expected objects: " + strings.Join(names, ", ")
+}
+
+// relkinds maps the manifest object kinds that are relations to their pg_class relkinds.
+var relkinds = map[string][]string{
+	"table":    {"r", "p"},
+	"view":     {"v", "m"},
+	"sequence": {"S"},
+	"index":    {"i", "I"},
+}
+
+// parseManifest parses a manifest.txt. Each line is an object kind and a name. e.g. "function add". Blank lines and
+// lines starting with # are ignored.
+func parseManifest(body string) ([]CodeObject, error) {
+	var objects []CodeObject
+	for i, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("manifest.txt line %d: expected object kind and name: %q", i+1, line)
+		}
+
+		kind := strings.ToLower(fields[0])
+		if _, ok := relkinds[kind]; !ok && kind != "function" {
+			return nil, fmt.Errorf("manifest.txt line %d: unknown object kind %q", i+1, fields[0])
+		}
+
+		objects = append(objects, CodeObject{Kind: kind, Name: fields[1]})
+	}
+
+	return objects, nil
+}
+
+// queryRower is implemented by *pgx.Conn and pgx.Tx.
+type queryRower interface {
+	QueryRow(ctx context.Context, sql string, args ...interface{}) pgx.Row
 }
 
+func (o CodeObject) exists(ctx context.Context, tx queryRower) (bool, error) {
+	var exists bool
+	if o.Kind == "function" {
+		schema, name := "", o.Name
+		if i := strings.LastIndexByte(o.Name, '.'); i != -1 {
+			schema, name = o.Name[:i], o.Name[i+1:]
+		}
+		err := tx.QueryRow(ctx, `select exists(
+  select 1
+  from pg_catalog.pg_proc p
+    join pg_catalog.pg_namespace n on p.pronamespace=n.oid
+  where p.proname=$1
+    and (($2='' and pg_catalog.pg_function_is_visible(p.oid)) or n.nspname=$2)
+)`, name, schema).Scan(&exists)
+		return exists, err
+	}
+
+	err := tx.QueryRow(ctx,
+		"select exists(select 1 from pg_catalog.pg_class where oid=to_regclass($1) and relkind::text=any($2))",
+		o.Name, relkinds[o.Kind],
+	).Scan(&exists)
+	return exists, err
+}
+
+// Eval evaluates the code package with data and returns the SQL to install it. The SQL is install.sql followed by each
+// of the files listed in deps.txt in order.
 func (cp *CodePackage) Eval(data map[string]interface{}) (string, error) {
 	buf := &bytes.Buffer{}
-	err := cp.tmpl.Lookup("install.sql").Execute(buf, data)
+	if installTmpl := cp.tmpl.Lookup("install.sql"); installTmpl != nil {
+		err := installTmpl.Execute(buf, data)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	for _, p := range cp.deps {
+		if buf.Len() > 0 {
+			buf.WriteString("\n")
+		}
+		err := cp.tmpl.Lookup(p).Execute(buf, data)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	return buf.String(), nil
+}
+
+// EvalFile evaluates the single file at path in the code package with data. path is slash separated and relative to
+// the root of the code package. e.g. "install.sql" or "functions/add.sql".
+func (cp *CodePackage) EvalFile(path string, data map[string]interface{}) (string, error) {
+	tmpl := cp.tmpl.Lookup(filepath.FromSlash(path))
+	if tmpl == nil {
+		return "", fmt.Errorf("%s not found", path)
+	}
+
+	buf := &bytes.Buffer{}
+	err := tmpl.Execute(buf, data)
 	if err != nil {
 		return "", err
 	}
-
 	return buf.String(), nil
 }
 
+// Files returns the slash separated paths of the .sql files in the code package in sorted order.
+func (cp *CodePackage) Files() []string {
+	files := make([]string, len(cp.files))
+	for i, p := range cp.files {
+		files[i] = filepath.ToSlash(p)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// parseDeps parses a deps.txt. Each line is the path of a file in the code package. Blank lines and lines starting
+// with # are ignored.
+func parseDeps(body string) []string {
+	var paths []string
+	for _, line := range strings.Split(body, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		paths = append(paths, filepath.FromSlash(line))
+	}
+	return paths
+}
+
 func findCodeFiles(fsys fs.FS) ([]string, error) {
 	entries, err := fs.ReadDir(fsys, ".")
 	if err != nil {
@@ -83,32 +236,201 @@ func LoadCodePackage(fsys fs.FS) (*CodePackage, error) {
 		}
 	}
 
-	installTmpl := mainTmpl.Lookup("install.sql")
-	if installTmpl == nil {
+	codePackage := &CodePackage{tmpl: mainTmpl, files: sqlPaths}
+
+	deps, err := fs.ReadFile(fsys, "deps.txt")
+	if err == nil {
+		codePackage.deps = parseDeps(string(deps))
+		for _, p := range codePackage.deps {
+			if mainTmpl.Lookup(p) == nil {
+				return nil, fmt.Errorf("deps.txt: %s not found", filepath.ToSlash(p))
+			}
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	if mainTmpl.Lookup("install.sql") == nil && len(codePackage.deps) == 0 {
 		return nil, errors.New("install.sql not found")
 	}
 
-	codePackage := &CodePackage{tmpl: mainTmpl}
+	manifest, err := fs.ReadFile(fsys, "manifest.txt")
+	if err == nil {
+		codePackage.Manifest, err = parseManifest(string(manifest))
+		if err != nil {
+			return nil, err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
 
 	return codePackage, nil
 }
 
+// InstallCodePackageOptions are options for InstallCodePackageEx.
+type InstallCodePackageOptions struct {
+	// TransactionPerStatement causes each statement in the code package to be run and committed on its own instead of
+	// running the whole code package in a single transaction. This allows re-running a code package that was partially
+	// installed when it is written to be idempotent (e.g. with create or replace).
+	TransactionPerStatement bool
+
+	// ContinueOnError causes the remaining statements to be run when a statement fails. The errors are returned together
+	// after all statements have been attempted. It only applies when TransactionPerStatement or DisableTx is true.
+	ContinueOnError bool
+
+	// DisableTx causes the code package to be run without a transaction. This is required for statements such as
+	// create index concurrently. PostgreSQL runs multiple statements sent together in an implicit transaction so each
+	// statement is run on its own. This is the same as TransactionPerStatement.
+	DisableTx bool
+
+	// OnStatement is called before each statement is run when the statements are run on their own. Otherwise, it is
+	// called once with the SQL of the entire code package before it is run. It can be used to report progress.
+	OnStatement func(sql string)
+
+	// DryRun causes the code package to be run in a transaction while holding the advisory lock and then rolled back
+	// instead of committed. Errors in the SQL and missing manifest objects are still reported. It cannot be used with
+	// TransactionPerStatement or DisableTx.
+	DryRun bool
+
+	// LockID is the advisory lock held while installing the code package. It should be the lock used by migrations of
+	// the same database (e.g. VersionTableLockID when MigratorOptions.LockIDFromVersionTable is set). Zero means the
+	// default migration lock.
+	LockID int64
+}
+
+// InstallCodePackage evaluates codePackage with mergeData and runs it in a transaction. If the code package has a
+// manifest, the transaction is rolled back and a MissingCodeObjectsError is returned if any of the objects in the
+// manifest do not exist after it is run.
 func InstallCodePackage(ctx context.Context, conn *pgx.Conn, mergeData map[string]interface{}, codePackage *CodePackage) (err error) {
+	return InstallCodePackageEx(ctx, conn, mergeData, codePackage, &InstallCodePackageOptions{})
+}
+
+// InstallCodePackageEx evaluates codePackage with mergeData and runs it as configured by opts. When
+// TransactionPerStatement or DisableTx is true the manifest is checked after all statements have run successfully but
+// nothing can be rolled back.
+func InstallCodePackageEx(ctx context.Context, conn *pgx.Conn, mergeData map[string]interface{}, codePackage *CodePackage, opts *InstallCodePackageOptions) (err error) {
+	if opts.DryRun && (opts.TransactionPerStatement || opts.DisableTx) {
+		return errors.New("DryRun cannot be used with TransactionPerStatement or DisableTx")
+	}
+
 	sql, err := codePackage.Eval(mergeData)
 	if err != nil {
 		return err
 	}
 
-	return LockExecTx(ctx, conn, sql)
+	verify := func(q queryRower) error {
+		var missing []CodeObject
+		for _, o := range codePackage.Manifest {
+			exists, err := o.exists(ctx, q)
+			if err != nil {
+				return err
+			}
+			if !exists {
+				missing = append(missing, o)
+			}
+		}
+
+		if len(missing) > 0 {
+			return MissingCodeObjectsError{Objects: missing}
+		}
+		return nil
+	}
+
+	lockID := lockNum
+	if opts.LockID != 0 {
+		lockID = opts.LockID
+	}
+
+	if opts.TransactionPerStatement || opts.DisableTx {
+		err = lockExecStatements(ctx, conn, lockID, sql, opts.ContinueOnError, opts.OnStatement)
+		if err != nil {
+			return err
+		}
+		return verify(conn)
+	}
+
+	var verifyTx func(pgx.Tx) error
+	if len(codePackage.Manifest) > 0 {
+		verifyTx = func(tx pgx.Tx) error { return verify(tx) }
+	}
+
+	return lockExecTx(ctx, conn, lockID, sql, verifyTx, opts.OnStatement, opts.DryRun)
+}
+
+// lockExecStatements runs each statement in sql on its own while holding the advisory lock lockID. If continueOnError is true
+// the remaining statements are run after a statement fails and all errors are returned together. If onStatement is not
+// nil it is called before each statement is run.
+func lockExecStatements(ctx context.Context, conn *pgx.Conn, lockID int64, sql string, continueOnError bool, onStatement func(string)) (err error) {
+	err = acquireAdvisoryLock(ctx, conn, lockID)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		unlockErr := releaseAdvisoryLock(ctx, conn, lockID)
+		if err == nil && unlockErr != nil {
+			err = unlockErr
+		}
+	}()
+
+	var statementErrs []error
+	err = sqlsplit.SplitFunc(sql, func(statement string) error {
+		if onStatement != nil {
+			onStatement(statement)
+		}
+
+		_, execErr := conn.Exec(ctx, statement)
+		if execErr == nil {
+			return nil
+		}
+
+		if pgErr, ok := execErr.(*pgconn.PgError); ok {
+			execErr = MigrationPgError{Sql: statement, PgError: pgErr}
+		}
+		if !continueOnError {
+			return execErr
+		}
+		statementErrs = append(statementErrs, execErr)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return errors.Join(statementErrs...)
+}
+
+// LockExecStatements runs each statement in sql on its own without a transaction while holding the advisory lock. It
+// stops at the first statement that fails.
+func LockExecStatements(ctx context.Context, conn *pgx.Conn, sql string) error {
+	return lockExecStatements(ctx, conn, lockNum, sql, false, nil)
 }
 
 func LockExecTx(ctx context.Context, conn *pgx.Conn, sql string) (err error) {
-	err = acquireAdvisoryLock(ctx, conn)
+	return lockExecTx(ctx, conn, lockNum, sql, nil, nil, false)
+}
+
+// LockExecStatementsWithLockID is like LockExecStatements but holds the advisory lock lockID. Use
+// VersionTableLockID to hold the same lock as a Migrator with MigratorOptions.LockIDFromVersionTable set.
+func LockExecStatementsWithLockID(ctx context.Context, conn *pgx.Conn, lockID int64, sql string) error {
+	return lockExecStatements(ctx, conn, lockID, sql, false, nil)
+}
+
+// LockExecTxWithLockID is like LockExecTx but holds the advisory lock lockID. Use VersionTableLockID to hold the same
+// lock as a Migrator with MigratorOptions.LockIDFromVersionTable set.
+func LockExecTxWithLockID(ctx context.Context, conn *pgx.Conn, lockID int64, sql string) error {
+	return lockExecTx(ctx, conn, lockID, sql, nil, nil, false)
+}
+
+// lockExecTx runs sql in a transaction while holding the advisory lock lockID. If verify is not nil it is called before the
+// transaction is committed and the transaction is rolled back if it returns an error. If onStatement is not nil it is
+// called with sql before it is run. If rollback is true the transaction is rolled back instead of committed.
+func lockExecTx(ctx context.Context, conn *pgx.Conn, lockID int64, sql string, verify func(pgx.Tx) error, onStatement func(string), rollback bool) (err error) {
+	err = acquireAdvisoryLock(ctx, conn, lockID)
 	if err != nil {
 		return err
 	}
 	defer func() {
-		unlockErr := releaseAdvisoryLock(ctx, conn)
+		unlockErr := releaseAdvisoryLock(ctx, conn, lockID)
 		if err == nil && unlockErr != nil {
 			err = unlockErr
 		}
@@ -120,6 +442,10 @@ func LockExecTx(ctx context.Context, conn *pgx.Conn, sql string) (err error) {
 	}
 	defer tx.Rollback(ctx)
 
+	if onStatement != nil {
+		onStatement(sql)
+	}
+
 	_, err = tx.Exec(ctx, sql)
 	if err != nil {
 		if err, ok := err.(*pgconn.PgError); ok {
@@ -128,6 +454,15 @@ func LockExecTx(ctx context.Context, conn *pgx.Conn, sql string) (err error) {
 		return err
 	}
 
-	return tx.Commit(ctx)
+	if verify != nil {
+		err = verify(tx)
+		if err != nil {
+			return err
+		}
+	}
 
+	if rollback {
+		return tx.Rollback(ctx)
+	}
+	return tx.Commit(ctx)
 }
@@ -3,6 +3,7 @@ package migrate_test
 import (
 	"context"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/jackc/tern/v2/migrate"
@@ -16,6 +17,59 @@ func TestLoadCodePackage(t *testing.T) {
 	assert.NotNil(t, codePackage)
 }
 
+func TestLoadCodePackageManifest(t *testing.T) {
+	codePackage, err := migrate.LoadCodePackage(os.DirFS("testdata/code_manifest"))
+	require.NoError(t, err)
+	assert.Equal(t, []migrate.CodeObject{
+		{Kind: "function", Name: "add"},
+		{Kind: "table", Name: "counters"},
+		{Kind: "view", Name: "counter_totals"},
+		{Kind: "function", Name: "public.subtract"},
+	}, codePackage.Manifest)
+}
+
+func TestCodePackageEvalDeps(t *testing.T) {
+	codePackage, err := migrate.LoadCodePackage(os.DirFS("testdata/code_deps"))
+	require.NoError(t, err)
+
+	sql, err := codePackage.Eval(map[string]interface{}{"schema": "code"})
+	require.NoError(t, err)
+	assert.Equal(t, `drop schema if exists code cascade;
+create schema code;
+
+create view code.a as select 1 as n;
+
+create view code.b as select n from code.a;
+
+create view code.c as select n from code.b;
+`, sql)
+}
+
+func TestCodePackageEvalFile(t *testing.T) {
+	codePackage, err := migrate.LoadCodePackage(os.DirFS("testdata/code_deps"))
+	require.NoError(t, err)
+
+	assert.Equal(t, []string{"a.sql", "install.sql", "views/b.sql", "views/c.sql"}, codePackage.Files())
+
+	sql, err := codePackage.EvalFile("views/b.sql", map[string]interface{}{"schema": "code"})
+	require.NoError(t, err)
+	assert.Equal(t, "create view code.b as select n from code.a;\n", sql)
+
+	_, err = codePackage.EvalFile("missing.sql", nil)
+	require.EqualError(t, err, "missing.sql not found")
+}
+
+func TestLoadCodePackageDepsMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "a.sql"), []byte("select 1;"), 0o644)
+	require.NoError(t, err)
+	err = os.WriteFile(filepath.Join(dir, "deps.txt"), []byte("a.sql\nb.sql\n"), 0o644)
+	require.NoError(t, err)
+
+	_, err = migrate.LoadCodePackage(os.DirFS(dir))
+	require.EqualError(t, err, "deps.txt: b.sql not found")
+}
+
 func TestLoadCodePackageNotCodePackage(t *testing.T) {
 	codePackage, err := migrate.LoadCodePackage(os.DirFS("testdata/sample"))
 	assert.EqualError(t, err, "install.sql not found")
@@ -41,3 +95,133 @@ func TestInstallCodePackage(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, 42, n)
 }
+
+func TestInstallCodePackageDryRun(t *testing.T) {
+	codePackage, err := migrate.LoadCodePackage(os.DirFS("testdata/code"))
+	require.NoError(t, err)
+
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	var statements []string
+	err = migrate.InstallCodePackageEx(context.Background(), conn, map[string]interface{}{"magic_number": 42}, codePackage, &migrate.InstallCodePackageOptions{
+		DryRun:      true,
+		OnStatement: func(sql string) { statements = append(statements, sql) },
+	})
+	require.NoError(t, err)
+	require.Len(t, statements, 1)
+	assert.Contains(t, statements[0], "create function add(int, int) returns int")
+
+	var exists bool
+	err = conn.QueryRow(context.Background(), "select exists(select 1 from pg_proc where proname = 'add')").Scan(&exists)
+	require.NoError(t, err)
+	assert.False(t, exists)
+
+	err = migrate.InstallCodePackageEx(context.Background(), conn, nil, codePackage, &migrate.InstallCodePackageOptions{DryRun: true, DisableTx: true})
+	require.EqualError(t, err, "DryRun cannot be used with TransactionPerStatement or DisableTx")
+}
+
+func TestInstallCodePackageLockID(t *testing.T) {
+	dir := t.TempDir()
+	err := os.WriteFile(filepath.Join(dir, "install.sql"), []byte("create table code_locks as select classid::int8, objid::int8 from pg_locks where locktype = 'advisory' and pid = pg_backend_pid();"), 0o644)
+	require.NoError(t, err)
+	codePackage, err := migrate.LoadCodePackage(os.DirFS(dir))
+	require.NoError(t, err)
+
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	lockID := migrate.VersionTableLockID("billing.schema_version")
+	err = migrate.InstallCodePackageEx(context.Background(), conn, nil, codePackage, &migrate.InstallCodePackageOptions{LockID: lockID})
+	require.NoError(t, err)
+
+	var classID, objID int64
+	err = conn.QueryRow(context.Background(), "select classid, objid from code_locks").Scan(&classID, &objID)
+	require.NoError(t, err)
+	assert.EqualValues(t, uint32(uint64(lockID)>>32), classID)
+	assert.EqualValues(t, uint32(lockID), objID)
+}
+
+func TestInstallCodePackageManifestMissingObjects(t *testing.T) {
+	codePackage, err := migrate.LoadCodePackage(os.DirFS("testdata/code_manifest"))
+	require.NoError(t, err)
+
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	err = migrate.InstallCodePackage(context.Background(), conn, nil, codePackage)
+	var missingErr migrate.MissingCodeObjectsError
+	require.ErrorAs(t, err, &missingErr)
+	assert.Equal(t, []migrate.CodeObject{
+		{Kind: "view", Name: "counter_totals"},
+		{Kind: "function", Name: "public.subtract"},
+	}, missingErr.Objects)
+	assert.EqualError(t, err, "code package is missing expected objects: view counter_totals, function public.subtract")
+
+	// The install is rolled back.
+	assert.False(t, tableExists(t, conn, "counters"))
+}
+
+func TestInstallCodePackageTransactionPerStatement(t *testing.T) {
+	codePackage, err := migrate.LoadCodePackage(os.DirFS("testdata/code_rerunnable"))
+	require.NoError(t, err)
+
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	// Simulate a previous partial install.
+	mustExec(t, conn, "create table widgets(id serial primary key, name text not null)")
+
+	// Without per statement transactions the whole install fails.
+	err = migrate.InstallCodePackage(context.Background(), conn, nil, codePackage)
+	require.Error(t, err)
+	assert.False(t, tableExists(t, conn, "gadgets"))
+
+	// Per statement transactions stop at the first failure but earlier statements are kept.
+	opts := &migrate.InstallCodePackageOptions{TransactionPerStatement: true}
+	err = migrate.InstallCodePackageEx(context.Background(), conn, nil, codePackage, opts)
+	var mgErr migrate.MigrationPgError
+	require.ErrorAs(t, err, &mgErr)
+	assert.Equal(t, "42P07", mgErr.Code) // duplicate_table
+	assert.Equal(t, "create table widgets(id serial primary key, name text not null);", mgErr.Sql)
+	assert.False(t, tableExists(t, conn, "gadgets"))
+
+	// With ContinueOnError the remaining statements are run.
+	opts.ContinueOnError = true
+	err = migrate.InstallCodePackageEx(context.Background(), conn, nil, codePackage, opts)
+	require.ErrorAs(t, err, &mgErr)
+	assert.True(t, tableExists(t, conn, "gadgets"))
+
+	var n int64
+	err = conn.QueryRow(context.Background(), "select widget_count()").Scan(&n)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, n)
+}
+
+func TestInstallCodePackageDisableTx(t *testing.T) {
+	codePackage, err := migrate.LoadCodePackage(os.DirFS("testdata/code_disable_tx"))
+	require.NoError(t, err)
+
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	// create index concurrently cannot be run in a transaction.
+	var statements []string
+	opts := &migrate.InstallCodePackageOptions{OnStatement: func(sql string) { statements = append(statements, sql) }}
+	err = migrate.InstallCodePackageEx(context.Background(), conn, nil, codePackage, opts)
+	var mgErr migrate.MigrationPgError
+	require.ErrorAs(t, err, &mgErr)
+	assert.Equal(t, "25001", mgErr.Code) // active_sql_transaction
+	require.Len(t, statements, 1)
+	assert.False(t, tableExists(t, conn, "things"))
+
+	statements = nil
+	opts.DisableTx = true
+	err = migrate.InstallCodePackageEx(context.Background(), conn, nil, codePackage, opts)
+	require.NoError(t, err)
+	assert.Equal(t, []string{
+		"create table things(id int);",
+		"create index concurrently things_id_idx on things(id);",
+	}, statements)
+	assert.True(t, tableExists(t, conn, "things"))
+}
@@ -3,34 +3,45 @@ package migrate
 import (
 	"fmt"
 	"strings"
+	"unicode/utf8"
 )
 
+// ErrorLineExtract is the location of an error in SQL source. It contains what is needed to render a psql style error
+// pointer. e.g.
+//
+//	LINE 2: selct 1;
+//	        ^
 type ErrorLineExtract struct {
 	LineNum   int    // Line number starting with 1
-	ColumnNum int    // Column number starting with 1
+	ColumnNum int    // Column number in characters starting with 1
 	Text      string // Text of the line without a new line character.
 }
 
 // ExtractErrorLine takes source and character position extracts the line
 // number, column number, and the line of text.
 //
-// The first character is position 1.
+// The first character is position 1. position is measured in characters rather
+// than bytes, which matches the Position field of a *pgconn.PgError. It is
+// typically used with a MigrationPgError:
+//
+//	ele, err := migrate.ExtractErrorLine(mgErr.Sql, int(mgErr.Position))
 func ExtractErrorLine(source string, position int) (ErrorLineExtract, error) {
 	ele := ErrorLineExtract{LineNum: 1}
 
-	if position > len(source) {
-		return ele, fmt.Errorf("position (%d) is greater than source length (%d)", position, len(source))
+	if sourceLen := utf8.RuneCountInString(source); position > sourceLen {
+		return ele, fmt.Errorf("position (%d) is greater than source length (%d)", position, sourceLen)
 	}
 
 	lines := strings.SplitAfter(source, "\n")
 	for _, ele.Text = range lines {
-		if position-len(ele.Text) < 1 {
+		lineLen := utf8.RuneCountInString(ele.Text)
+		if position-lineLen < 1 {
 			ele.ColumnNum = position
 			break
 		}
 
 		ele.LineNum += 1
-		position -= len(ele.Text)
+		position -= lineLen
 	}
 
 	ele.Text = strings.TrimSuffix(ele.Text, "\n")
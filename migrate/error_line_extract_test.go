@@ -79,6 +79,36 @@ error`,
 			},
 			errMsg: "",
 		},
+		{
+			source: `create table t1(
+  id serial primary key,
+  name tezt not null
+);`,
+			position: 50,
+			ele: ErrorLineExtract{
+				LineNum:   3,
+				ColumnNum: 8,
+				Text:      "  name tezt not null",
+			},
+			errMsg: "",
+		},
+		{
+			source: `select 'ünïcödé';
+selct 1;`,
+			position: 19,
+			ele: ErrorLineExtract{
+				LineNum:   2,
+				ColumnNum: 1,
+				Text:      "selct 1;",
+			},
+			errMsg: "",
+		},
+		{
+			source:   "héllo",
+			position: 6,
+			ele:      ErrorLineExtract{},
+			errMsg:   "position (6) is greater than source length (5)",
+		},
 	}
 
 	for i, tt := range tests {
@@ -3,28 +3,128 @@ package migrate
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"hash/fnv"
 	"io/fs"
+	"os"
+	"path"
 	"path/filepath"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"text/template"
+	"time"
+	"unicode"
 
 	"github.com/Masterminds/sprig/v3"
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
-	"github.com/jackc/tern/v2/migrate/internal/sqlsplit"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"github.com/jackc/tern/v2/sqlsplit"
 )
 
 var (
-	migrationPattern = regexp.MustCompile(`\A(\d+)_.+\.sql\z`)
-	disableTxPattern = regexp.MustCompile(`(?m)^---- tern: disable-tx ----$`)
+	// migrationPattern matches migration file names. A migration file name is a sequence number followed by an
+	// underscore or a period, a name, and a .sql extension. e.g. 001_create_people.sql or 001.create_people.sql. The
+	// underscore is preferred and is used by tern new.
+	migrationPattern = regexp.MustCompile(`\A(?P<version>\d+)[_.].+\.sql\z`)
+	// disableTxPattern matches "---- tern: disable-tx ----" and the older "---- disable-tx ----" spelling. A trailing
+	// \r is allowed so files with Windows line endings are handled.
+	disableTxPattern = regexp.MustCompile(`(?m)^---- (?:tern: )?disable-tx ----\r?$`)
+	// requireEnvPattern matches "---- tern: require-env NAME [NAME...] ----". It declares environment variables that must
+	// be set for a migration to be loaded.
+	requireEnvPattern = regexp.MustCompile(`(?m)^---- tern: require-env (.+?) ----\r?$`)
+	// requireDataPattern matches "---- tern: require-data prefix,region ----". It declares Migrator.Data keys that must
+	// be set for a migration to be loaded.
+	requireDataPattern = regexp.MustCompile(`(?m)^---- tern: require-data (.+?) ----\r?$`)
+	// environmentsPattern matches "---- tern: environments dev,staging ----". It restricts a migration to the listed
+	// environments.
+	environmentsPattern = regexp.MustCompile(`(?m)^---- tern: environments (.+?) ----\r?$`)
+	// tagsPattern matches "---- tern: tags experimental,billing ----". It tags a migration so it can be included or
+	// skipped with MigratorOptions.IncludeTags and MigratorOptions.ExcludeTags.
+	tagsPattern = regexp.MustCompile(`(?m)^---- tern: tags (.+?) ----\r?$`)
+	// idempotentPattern matches "---- tern: idempotent ----". It declares that a migration section can safely be run
+	// again after it was interrupted partway through.
+	idempotentPattern = regexp.MustCompile(`(?m)^---- tern: idempotent ----\r?$`)
+	// batchPattern matches "---- tern: batch 1000 ----". It declares that a migration section is a single DML statement
+	// that is run repeatedly in batches of the given size.
+	batchPattern = regexp.MustCompile(`(?m)^---- tern: batch (\d+) ----\r?$`)
+	// metadataPattern matches a "-- @key: value" metadata line in a migration header.
+	metadataPattern = regexp.MustCompile(`\A--\s*@([\w.-]+):\s*(.*?)\s*\z`)
+	// repeatableMigrationPattern matches repeatable migration file names. e.g. R__people_view.sql.
+	repeatableMigrationPattern = regexp.MustCompile(`\AR__.+\.sql\z`)
 )
 
+// Migrations may optionally be split into a pair of files per version in the style of golang-migrate. e.g.
+// 001_create_t1.up.sql and 001_create_t1.down.sql.
+const (
+	upMigrationSuffix   = ".up.sql"
+	downMigrationSuffix = ".down.sql"
+)
+
+const migrationSeparator = "---- create above / drop below ----"
+
 var ErrNoFwMigration = errors.New("no sql in forward migration step")
 
+// ErrReadOnlyDatabase is returned by MigrateTo when the connection is read-only. This usually means the connection is
+// to a replica.
+var ErrReadOnlyDatabase = errors.New("database is read-only (connected to a replica or transaction_read_only is on)")
+
+// GuardFailedError is returned by MigrateTo when the MigratorOptions.GuardSQL query does not return true.
+type GuardFailedError struct {
+	Message string
+}
+
+func (e GuardFailedError) Error() string {
+	return "guard failed: " + e.Message
+}
+
+// StateDriftError is returned by Migrator.CheckCurrentMigration when the down and up SQL of the current migration
+// cannot be run. This usually means the schema has been changed outside of migrations. e.g. a table created by the
+// migration was dropped manually.
+type StateDriftError struct {
+	CurrentVersion int32
+	MigrationName  string
+	Err            error
+}
+
+func (e StateDriftError) Error() string {
+	return fmt.Sprintf("schema does not match version %d: %s could not be migrated down and up again: %v", e.CurrentVersion, e.MigrationName, e.Err)
+}
+
+func (e StateDriftError) Unwrap() error {
+	return e.Err
+}
+
+// IncompleteMigrationError is returned by MigrateTo when a migration that does not run in a transaction was started by
+// a previous run but did not finish and MigrateTo would run it or migrate past it, unless it is marked idempotent and is
+// the next migration to run. It is also returned when MigrateTo would run another migration that does not run in a
+// transaction as that would replace the record. Its changes may have been partially applied. See
+// Migrator.IncompleteMigration.
+type IncompleteMigrationError struct {
+	MigrationName string
+}
+
+func (e IncompleteMigrationError) Error() string {
+	return fmt.Sprintf("%s: migration did not finish on a previous run and may be partially applied (repair the database and then set the version it is at with tern repair --set-version, or mark the migration idempotent if it is safe to run again)", e.MigrationName)
+}
+
+// ExcludedEnvironmentError is returned by MigrateTo when a migration is not allowed to run in the current environment
+// and MigratorOptions.FailOnExcludedEnvironment is set.
+type ExcludedEnvironmentError struct {
+	MigrationName string
+	Environment   string
+	Environments  []string
+}
+
+func (e ExcludedEnvironmentError) Error() string {
+	return fmt.Sprintf("%s: migration is restricted to environments %s but the environment is %q", e.MigrationName, strings.Join(e.Environments, ","), e.Environment)
+}
+
 type BadVersionError string
 
 func (e BadVersionError) Error() string {
@@ -39,6 +139,32 @@ func (e IrreversibleMigrationError) Error() string {
 	return fmt.Sprintf("Irreversible migration: %d - %s", e.m.Sequence, e.m.Name)
 }
 
+// MissingMigrationsError is returned when the current version of the database is greater than the number of
+// migrations. This usually means that migration files that have already been applied were deleted.
+type MissingMigrationsError struct {
+	CurrentVersion int32
+	MigrationCount int
+}
+
+func (e MissingMigrationsError) Error() string {
+	return fmt.Sprintf("current version %d is greater than the %d migrations found: the files of applied migrations %d to %d appear to be missing (restore them or set the version with tern repair --set-version)",
+		e.CurrentVersion, e.MigrationCount, e.MigrationCount+1, e.CurrentVersion)
+}
+
+// MigrationFileError is an error in a particular migration file.
+type MigrationFileError struct {
+	Name string
+	Err  error
+}
+
+func (e MigrationFileError) Error() string {
+	return fmt.Sprintf("%s: %v", e.Name, e.Err)
+}
+
+func (e MigrationFileError) Unwrap() error {
+	return e.Err
+}
+
 type NoMigrationsFoundError struct{}
 
 func (e NoMigrationsFoundError) Error() string {
@@ -67,20 +193,388 @@ type Migration struct {
 	Name     string
 	UpSQL    string
 	DownSQL  string
+
+	// Metadata is parsed from "-- @key: value" comment lines in the header of the up SQL. e.g. -- @author: jane. The
+	// header is the comments and blank lines before the first SQL statement. It is nil if there are no metadata lines.
+	Metadata map[string]string
+}
+
+// Reversible reports whether the migration has down SQL. Migrating down past an irreversible migration fails with an
+// IrreversibleMigrationError.
+func (m *Migration) Reversible() bool {
+	return m.DownSQL != ""
+}
+
+// DisableTx reports whether the SQL for direction ("up" or "down") contains the disable-tx magic comment. Each
+// direction is independent: a magic comment in the down SQL does not affect the up migration and vice versa.
+func (m *Migration) DisableTx(direction string) bool {
+	if direction == "down" {
+		return disableTxPattern.MatchString(m.DownSQL)
+	}
+	return disableTxPattern.MatchString(m.UpSQL)
+}
+
+// Idempotent reports whether the SQL for direction ("up" or "down") contains the "---- tern: idempotent ----" magic
+// comment. It declares that the section can be run again after it was interrupted partway through, such as a section
+// of only create index concurrently if not exists statements. tern does not check this; it is up to the author of the
+// migration. Only sections that do not run in a transaction can be partially applied so only they need it.
+func (m *Migration) Idempotent(direction string) bool {
+	if direction == "down" {
+		return idempotentPattern.MatchString(m.DownSQL)
+	}
+	return idempotentPattern.MatchString(m.UpSQL)
+}
+
+// BatchSize returns the batch size declared by a "---- tern: batch N ----" magic comment in the section for direction.
+// It returns 0 if the section is not a batch migration.
+func (m *Migration) BatchSize(direction string) int {
+	sql := m.UpSQL
+	if direction == "down" {
+		sql = m.DownSQL
+	}
+
+	matches := batchPattern.FindStringSubmatch(sql)
+	if matches == nil {
+		return 0
+	}
+	n, _ := strconv.Atoi(matches[1])
+	return n
+}
+
+// Environments returns the environments listed in the environments magic comment of m. e.g.
+// ---- tern: environments dev,staging ----. It returns nil if m is not restricted to any environments.
+func (m *Migration) Environments() []string {
+	matches := environmentsPattern.FindStringSubmatch(m.UpSQL + "\n" + m.DownSQL)
+	if matches == nil {
+		return nil
+	}
+
+	var environments []string
+	for _, env := range strings.Split(matches[1], ",") {
+		if env = strings.TrimSpace(env); env != "" {
+			environments = append(environments, env)
+		}
+	}
+	return environments
+}
+
+// RunsInEnvironment reports whether m should be run in environment. A migration that is not restricted to any
+// environments runs in every environment. A restricted migration never runs when environment is empty.
+func (m *Migration) RunsInEnvironment(environment string) bool {
+	environments := m.Environments()
+	if environments == nil {
+		return true
+	}
+
+	for _, env := range environments {
+		if env == environment {
+			return true
+		}
+	}
+	return false
+}
+
+// Tags returns the tags listed in the tags magic comment of m. e.g. ---- tern: tags experimental,billing ----. Tags
+// may be separated by commas or spaces. It returns nil if m is not tagged.
+func (m *Migration) Tags() []string {
+	matches := tagsPattern.FindStringSubmatch(m.UpSQL + "\n" + m.DownSQL)
+	if matches == nil {
+		return nil
+	}
+
+	return strings.FieldsFunc(matches[1], func(r rune) bool { return r == ',' || unicode.IsSpace(r) })
+}
+
+// RunsWithTags reports whether m should be run when include and exclude are the tags selected with
+// MigratorOptions.IncludeTags and MigratorOptions.ExcludeTags. An untagged migration always runs. A tagged migration
+// does not run if any of its tags are in exclude. Otherwise, if include is not empty, it only runs if one of its tags
+// is in include.
+func (m *Migration) RunsWithTags(include, exclude []string) bool {
+	tags := m.Tags()
+	if tags == nil {
+		return true
+	}
+
+	for _, tag := range tags {
+		if slices.Contains(exclude, tag) {
+			return false
+		}
+	}
+
+	if len(include) == 0 {
+		return true
+	}
+	for _, tag := range tags {
+		if slices.Contains(include, tag) {
+			return true
+		}
+	}
+	return false
+}
+
+// Checksum returns a checksum of the up and down SQL of m.
+func (m *Migration) Checksum() string {
+	sum := sha256.Sum256([]byte(m.UpSQL + "\n" + migrationSeparator + "\n" + m.DownSQL))
+	return hex.EncodeToString(sum[:])
+}
+
+// RepeatableMigration is a migration that is run again whenever its SQL changes instead of once in the version
+// sequence. It is typically used for views and functions that are replaced with create or replace.
+type RepeatableMigration struct {
+	Name string
+	SQL  string
+}
+
+// Checksum returns the checksum used to detect when the SQL of rm has changed.
+func (rm *RepeatableMigration) Checksum() string {
+	sum := sha256.Sum256([]byte(rm.SQL))
+	return hex.EncodeToString(sum[:])
 }
 
 type MigratorOptions struct {
 	// DisableTx causes the Migrator not to run migrations in a transaction.
 	DisableTx bool
+
+	// ContinueOnError causes MigrateTo to continue with the remaining migrations when a migration fails. Each failed
+	// migration is rolled back (unless it runs without a transaction) and the errors are returned together when all
+	// migrations have been attempted. The version table is only advanced through the last migration before the first
+	// failure, so migrations that succeeded after a failure will be run again on the next migration.
+	//
+	// WARNING: This is only intended for development. It can leave the database in a state that does not correspond to
+	// any migration version.
+	ContinueOnError bool
+
+	// RepeatableTable is the table used to track the checksums of applied repeatable migrations. It defaults to the
+	// version table name with a "_repeatable" suffix. It is only created when there are repeatable migrations to run.
+	RepeatableTable string
+
+	// SkipReadOnlyCheck disables the check that MigrateTo performs before migrating that the connection is not
+	// read-only.
+	SkipReadOnlyCheck bool
+
+	// HistoryTable is the table each successfully run migration is recorded in. It is created if it does not exist. If
+	// it is empty no history is recorded.
+	HistoryTable string
+
+	// VersionConn is an optional separate connection for the version table. e.g. a central catalog database that records
+	// the version of many shard databases. All other statements, including the advisory lock, use the main connection.
+	// Each database migrated this way needs its own version table.
+	//
+	// The version cannot be updated in the same transaction as the migration. It is updated after the migration is
+	// committed. If the version update fails the migration will have been applied but not recorded and it will be run
+	// again on the next migration.
+	VersionConn *pgx.Conn
+
+	// FilenamePattern matches migration file names. It must have a named capture group "version" that matches the
+	// sequence number of the migration. e.g. `\AV(?P<version>\d+)__.+\.sql\z` matches Flyway style V1__name.sql file
+	// names. If nil, the default pattern that matches file names like 001_create_people.sql is used.
+	FilenamePattern *regexp.Regexp
+
+	// RecursiveMigrations causes LoadMigrations and Validate to also find migration files and repeatable migration
+	// files in subdirectories of the migration directory. e.g. 2023/001_create_people.sql, 2024/002_add_email.sql, and
+	// views/R__people_view.sql. See FindMigrationsRecursive and FindRepeatableMigrationsRecursive. Other .sql files in
+	// subdirectories are still available as shared templates.
+	RecursiveMigrations bool
+
+	// GuardSQL is a query that MigrateTo runs while holding the advisory lock before running any migrations. It must
+	// return a single boolean. If it does not return true no migrations are run and a GuardFailedError with
+	// GuardMessage is returned. e.g. "select not exists (select 1 from deployments where active)".
+	GuardSQL string
+
+	// GuardMessage is the message of the GuardFailedError returned when GuardSQL does not return true.
+	GuardMessage string
+
+	// GeneratedAt is the time available to migration templates as .GeneratedAt. Every migration loaded by
+	// LoadMigrations sees the same value so migrations can reference a consistent timestamp. e.g. for a created_at
+	// column in seed data. If it is the zero time the time LoadMigrations is called is used. Set it to get stable
+	// output. e.g. when generating SQL or in tests.
+	GeneratedAt time.Time
+
+	// MaxRetries is the number of times a migration that runs in a transaction is retried when it fails with a deadlock
+	// (40P01) or serialization failure (40001). A migration that does not run in a transaction is never retried because
+	// it may have been partially applied.
+	MaxRetries int
+
+	// RetryBackoff is how long to wait before the first retry. It is doubled for each following retry.
+	RetryBackoff time.Duration
+
+	// MigrationTimeout, if greater than 0, is the longest each migration may run, including any retries. A migration
+	// that takes longer is canceled and MigrateTo returns an error that wraps context.DeadlineExceeded. As with any
+	// canceled query, pgx sends a cancel request and closes the connection, which rolls back the transaction of a
+	// transactional migration.
+	// Migrations that already finished remain applied. A migration that does not run in a transaction may be partially
+	// applied. The Migrator cannot be used again after a timeout because its connection is closed.
+	MigrationTimeout time.Duration
+
+	// NotifyChannel is a channel that MigrateTo notifies with pg_notify after it successfully migrates. The payload is
+	// the new version. e.g. so an application can wait for migrations to complete during a deploy. The notification is
+	// sent while holding the advisory lock.
+	NotifyChannel string
+
+	// NotifyWhenUnchanged causes MigrateTo to notify NotifyChannel even when the database is already at the target
+	// version.
+	NotifyWhenUnchanged bool
+
+	// AnnotateApplicationName causes the application_name of the connection to be set to "tern:" followed by the name
+	// of the migration (without the .sql extension) while the migration runs. e.g. tern:003_create_orders. This shows
+	// which migration is running in pg_stat_activity. The original application_name is restored after the migration.
+	AnnotateApplicationName bool
+
+	// Delims are the left and right delimiters used by LoadMigrations to parse migrations and shared templates. e.g.
+	// [2]string{"<<", ">>"}. This is useful when migrations contain literal {{ or }}. An empty delimiter uses the
+	// default {{ or }}.
+	Delims [2]string
+
+	// Environment is the environment migrations are being run in. e.g. "dev" or "production". A migration can be
+	// restricted to certain environments with the ---- tern: environments dev,staging ---- magic comment. When a migration
+	// is not allowed to run in Environment its SQL is not run, but the version is still advanced so the version numbers
+	// mean the same thing in every environment. The same applies when migrating down. A restricted migration is never
+	// run when Environment is empty.
+	Environment string
+
+	// FailOnExcludedEnvironment causes MigrateTo to return an ExcludedEnvironmentError instead of skipping a migration
+	// that is not allowed to run in Environment.
+	FailOnExcludedEnvironment bool
+
+	// IncludeTags and ExcludeTags select which tagged migrations are run. A migration is tagged with the
+	// ---- tern: tags experimental ---- magic comment. See Migration.RunsWithTags. As with Environment, a migration that is
+	// not selected is skipped: its SQL is not run, but the version is still advanced. Selecting the tag later does not
+	// run a migration that was skipped. Untagged migrations are always run.
+	IncludeTags []string
+	ExcludeTags []string
+
+	// AssumedCurrentVersion, if not nil, is used by the first call to MigrateTo as the current version instead of the
+	// version in the version table. It is intended for disaster recovery when the version table is known to be wrong but
+	// the schema is at a known version. The version table is not read or changed to plan the migration, but it is
+	// updated as usual as each migration is run. Later calls to MigrateTo use the version table.
+	AssumedCurrentVersion *int32
+
+	// InitialVersion is the version the version table is set to when NewMigrator creates it. It allows an existing
+	// database whose schema already matches the first InitialVersion migrations to be baselined in one step. It has no
+	// effect when the version table already exists. It cannot be used with VersionStore.
+	InitialVersion int32
+
+	// VersionStore reads and writes the current version. If nil, the version is kept in the version table given to
+	// NewMigrator.
+	VersionStore VersionStore
+
+	// Tracer is used to trace MigrateTo with spans. See Tracer. If nil, no spans are started.
+	Tracer Tracer
+
+	// LockIDFromVersionTable causes the advisory lock that prevents concurrent migrations to be derived from the version
+	// table name with VersionTableLockID instead of using a single fixed id. Migrators with different version tables,
+	// such as one per schema, then do not wait for each other. Every Migrator that uses the same version table must use
+	// the same setting or they will not exclude each other.
+	LockIDFromVersionTable bool
+
+	// OnLockWait, OnLockAcquired, and OnLockReleased are called with the lock id around the advisory lock that prevents
+	// concurrent migrations. OnLockWait is only called when the lock is held by another session, so it reports that
+	// this Migrator is blocked until the other session releases it. They are options rather than Migrator fields
+	// because NewMigrator takes the lock to create the version table.
+	OnLockWait     func(lockID int64)
+	OnLockAcquired func(lockID int64)
+	OnLockReleased func(lockID int64)
+}
+
+// HistoryEntry is a record of a migration being run.
+type HistoryEntry struct {
+	ID          int64
+	Sequence    int32  // Sequence of the migration that was run
+	Name        string // Name of the migration that was run
+	Direction   string // "up" or "down"
+	AppliedBy   string // current_user when the migration was run
+	SessionUser string // session_user when the migration was run. It differs from AppliedBy when set role was used.
+	AppliedAt   time.Time
+}
+
+// Conn is the database connection a Migrator runs migrations on. *pgx.Conn implements Conn. It can be implemented by
+// a fake to test code that runs migrations without a PostgreSQL server.
+type Conn interface {
+	Exec(ctx context.Context, sql string, arguments ...any) (pgconn.CommandTag, error)
+	Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error)
+	QueryRow(ctx context.Context, sql string, args ...any) pgx.Row
+	Begin(ctx context.Context) (pgx.Tx, error)
+}
+
+// VersionStore reads and writes the current version of the migrations. The default VersionStore keeps the version in
+// the single row of the version table given to NewMigrator. A custom VersionStore can be set with
+// MigratorOptions.VersionStore to use other table semantics, such as a table with one row per component. The Migrator
+// still handles the advisory lock, ordering, and transactions.
+//
+// conn is the connection the version is stored on. It is MigratorOptions.VersionConn if set. Otherwise, SetVersion is
+// given the migration connection while the transaction of a transactional migration is open so the version is
+// committed with the migration.
+type VersionStore interface {
+	// EnsureExists creates the storage for the version if it does not exist and initializes the version to 0. It is
+	// called while holding the advisory lock when the Migrator is created.
+	EnsureExists(ctx context.Context, conn Conn) error
+
+	// GetVersion returns the current version.
+	GetVersion(ctx context.Context, conn Conn) (int32, error)
+
+	// SetVersion sets the current version.
+	SetVersion(ctx context.Context, conn Conn, version int32) error
+}
+
+// InProgressStore is an optional interface a VersionStore can implement to record a migration that does not run in a
+// transaction while it is running. If such a migration is interrupted its changes may have been partially applied
+// while the version still says it has not been run. The record is left behind so the next run can warn about it. The
+// default VersionStore implements InProgressStore with an in_progress column in the version table.
+type InProgressStore interface {
+	// SetInProgress records that the migration named name is running. An empty name clears the record.
+	SetInProgress(ctx context.Context, conn Conn, name string) error
+
+	// GetInProgress returns the name of the migration recorded as running or an empty string if there is none.
+	GetInProgress(ctx context.Context, conn Conn) (string, error)
 }
 
 type Migrator struct {
-	conn         *pgx.Conn
+	conn         Conn
+	pooledConn   *pgxpool.Conn // set when the Migrator owns a connection acquired from a pool.
+	assumedUsed  bool          // set when MigratorOptions.AssumedCurrentVersion has been used.
 	versionTable string
 	options      *MigratorOptions
 	Migrations   []*Migration
 	OnStart      func(int32, string, string, string) // OnStart is called when a migration is run with the sequence, name, direction, and SQL
 	Data         map[string]interface{}              // Data available to use in migrations
+
+	// OnFinish is called when a migration has been run successfully with the sequence, name, direction, and how long
+	// the migration took to run.
+	OnFinish func(sequence int32, name, direction string, duration time.Duration)
+
+	// OnSkip is called when a migration is skipped because it is not allowed to run in MigratorOptions.Environment or
+	// it is not selected by MigratorOptions.IncludeTags and MigratorOptions.ExcludeTags.
+	OnSkip func(sequence int32, name, direction string)
+
+	// OnBatch is called after each batch of a batch migration has been committed with the sequence, name, batch number
+	// (starting at 1), and the number of rows affected by the batch.
+	OnBatch func(sequence int32, name string, batch int, rowsAffected int64)
+
+	// RepeatableMigrations are run by Migrate after all versioned migrations whenever their SQL has changed.
+	RepeatableMigrations []*RepeatableMigration
+
+	// SQLTransform is called with the direction, name, and SQL of each migration before it is run. The returned SQL is
+	// run instead and is passed to OnStart. It is applied after the disable-tx magic comment has been removed and before
+	// the SQL is split into statements for a migration that does not run in a transaction. The direction is
+	// "repeatable" for a repeatable migration.
+	SQLTransform func(direction, name, sql string) (string, error)
+
+	// PreMigrateCheck is called by MigrateTo while holding the advisory lock before any migrations are run. If it returns
+	// an error no migrations are run and the error is returned. It is not called when there is nothing to migrate. It can
+	// be used to detect schema drift before migrating on top of a broken schema. e.g. m.PreMigrateCheck =
+	// m.CheckCurrentMigration.
+	PreMigrateCheck func(ctx context.Context, conn Conn) error
+
+	// OnIncompleteMigration is called by MigrateTo with the name of a migration that does not run in a transaction when
+	// a previous run started it but did not finish it (e.g. the previous run was interrupted) and MigrateTo is about to
+	// run it again because it is marked idempotent. It is only called when the VersionStore implements InProgressStore.
+	OnIncompleteMigration func(name string)
+
+	// OnIncompleteMigrationWarning is called by MigrateTo with the name of a migration that did not finish on a previous
+	// run when the migration steps to the target version neither run it nor migrate past it (e.g. there is nothing to
+	// migrate). MigrateTo continues and the record is kept until the database is repaired. It is only called when the
+	// VersionStore implements InProgressStore.
+	OnIncompleteMigrationWarning func(name string)
 }
 
 // NewMigrator initializes a new Migrator. It is highly recommended that versionTable be schema qualified.
@@ -90,6 +584,43 @@ func NewMigrator(ctx context.Context, conn *pgx.Conn, versionTable string) (m *M
 
 // NewMigratorEx initializes a new Migrator. It is highly recommended that versionTable be schema qualified.
 func NewMigratorEx(ctx context.Context, conn *pgx.Conn, versionTable string, opts *MigratorOptions) (m *Migrator, err error) {
+	// A nil *pgx.Conn must not become a non-nil Conn.
+	if conn == nil {
+		return NewMigratorWithConn(ctx, nil, versionTable, opts)
+	}
+	return NewMigratorWithConn(ctx, conn, versionTable, opts)
+}
+
+// NewMigratorFromPool initializes a new Migrator on a connection acquired from pool. The connection is pinned to the
+// Migrator until Close is called, which returns it to the pool. The advisory lock that prevents concurrent migrations is
+// held by a database session so it must be acquired, used, and released on the same connection. Running each query on
+// whatever connection the pool provides would lose the lock. A connection that is acquired from a pool is never closed
+// by the pool, even when MaxConnLifetime passes, so the lock is held for the whole run.
+func NewMigratorFromPool(ctx context.Context, pool *pgxpool.Pool, versionTable string, opts *MigratorOptions) (*Migrator, error) {
+	pooledConn, err := pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := NewMigratorWithConn(ctx, pooledConn.Conn(), versionTable, opts)
+	if err != nil {
+		pooledConn.Release()
+		return nil, err
+	}
+	m.pooledConn = pooledConn
+
+	return m, nil
+}
+
+// NewMigratorWithConn is like NewMigratorEx but accepts any Conn instead of only a *pgx.Conn.
+func NewMigratorWithConn(ctx context.Context, conn Conn, versionTable string, opts *MigratorOptions) (m *Migrator, err error) {
+	if opts.InitialVersion < 0 {
+		return nil, fmt.Errorf("initial version must not be negative: %d", opts.InitialVersion)
+	}
+	if opts.InitialVersion != 0 && opts.VersionStore != nil {
+		return nil, errors.New("initial version cannot be used with a version store")
+	}
+
 	m = &Migrator{conn: conn, versionTable: versionTable, options: opts}
 
 	// This is a bit of a kludge for the gengen command. A migrator without a conn is normally not allowed. However, the
@@ -99,230 +630,824 @@ func NewMigratorEx(ctx context.Context, conn *pgx.Conn, versionTable string, opt
 		err = m.ensureSchemaVersionTableExists(ctx)
 	}
 	m.Migrations = make([]*Migration, 0)
+	m.RepeatableMigrations = make([]*RepeatableMigration, 0)
 	m.Data = make(map[string]interface{})
 	return
 }
 
-// FindMigrations finds all migration files in fsys.
+// FindMigrations finds all migration files in fsys. When a migration is split into .up.sql and .down.sql files only
+// the .up.sql file is returned. Every .up.sql file must have a matching .down.sql file. An empty .down.sql file marks
+// the migration as irreversible.
 func FindMigrations(fsys fs.FS) ([]string, error) {
-	fileInfos, err := fs.ReadDir(fsys, ".")
+	return FindMigrationsWithPattern(fsys, migrationPattern)
+}
+
+// FindMigrationsWithPattern is like FindMigrations but finds the migration files whose names match pattern. pattern
+// must have a named capture group "version" that matches the sequence number of the migration.
+func FindMigrationsWithPattern(fsys fs.FS, pattern *regexp.Regexp) ([]string, error) {
+	return findMigrations(fsys, pattern, false)
+}
+
+// FindMigrationsRecursive is like FindMigrationsWithPattern but also finds migration files in subdirectories of fsys.
+// e.g. 2023/001_create_people.sql and 2024/002_add_email.sql. The migrations in every directory are ordered by their
+// sequence numbers as one sequence, so a sequence number may only be used once across all directories. The returned
+// paths are slash separated and relative to fsys. The snapshots directory used by tern code snapshot is not searched.
+func FindMigrationsRecursive(fsys fs.FS, pattern *regexp.Regexp) ([]string, error) {
+	return findMigrations(fsys, pattern, true)
+}
+
+func findMigrations(fsys fs.FS, pattern *regexp.Regexp, recursive bool) ([]string, error) {
+	versionIdx := pattern.SubexpIndex("version")
+	if versionIdx < 0 {
+		return nil, fmt.Errorf("migration filename pattern %q does not have a named capture group \"version\"", pattern.String())
+	}
+
+	filePaths, err := migrationDirFiles(fsys, recursive)
 	if err != nil {
 		return nil, err
 	}
 
-	paths := make([]string, 0, len(fileInfos))
+	paths := make([]string, 0, len(filePaths))
+	downPaths := make(map[int64]string)
 
-	for _, fi := range fileInfos {
-		if fi.IsDir() {
-			continue
+	// duplicateErr names both files when the migrations are in different directories as that is harder to spot.
+	duplicateErr := func(n int64, a, b string) error {
+		if recursive {
+			return fmt.Errorf("Duplicate migration %d: %s and %s", n, a, b)
 		}
+		return fmt.Errorf("Duplicate migration %d", n)
+	}
 
-		matches := migrationPattern.FindStringSubmatch(fi.Name())
-		if len(matches) != 2 {
+	for _, p := range filePaths {
+		matches := pattern.FindStringSubmatch(path.Base(p))
+		if matches == nil {
 			continue
 		}
 
-		n, err := strconv.ParseInt(matches[1], 10, 32)
+		n, err := strconv.ParseInt(matches[versionIdx], 10, 32)
 		if err != nil {
-			// The regexp already validated that the prefix is all digits so this *should* never fail
-			return nil, err
+			return nil, fmt.Errorf("%s: invalid migration version: %w", p, err)
+		}
+
+		if strings.HasSuffix(p, downMigrationSuffix) {
+			if other, present := downPaths[n]; present {
+				return nil, duplicateErr(n, other, p)
+			}
+			downPaths[n] = p
+			continue
 		}
 
 		if n-1 < int64(len(paths)) && paths[n-1] != "" {
-			return nil, fmt.Errorf("Duplicate migration %d", n)
+			return nil, duplicateErr(n, paths[n-1], p)
 		}
 
 		// Set at specific index, so that paths are properly sorted
-		paths = setAt(paths, fi.Name(), n-1)
+		paths = setAt(paths, p, n-1)
 	}
 
 	for i, path := range paths {
 		if path == "" {
 			return nil, fmt.Errorf("Missing migration %d", i+1)
 		}
+
+		if strings.HasSuffix(path, upMigrationSuffix) {
+			downPath := strings.TrimSuffix(path, upMigrationSuffix) + downMigrationSuffix
+			if downPaths[int64(i+1)] != downPath {
+				return nil, fmt.Errorf("Missing down migration %s for %s (use an empty file for an irreversible migration)", downPath, path)
+			}
+		} else if downPath, present := downPaths[int64(i+1)]; present {
+			return nil, fmt.Errorf("Missing up migration for %s", downPath)
+		}
+	}
+
+	for n, downPath := range downPaths {
+		if n > int64(len(paths)) {
+			return nil, fmt.Errorf("Missing up migration for %s", downPath)
+		}
 	}
 
 	return paths, nil
 }
 
-func (m *Migrator) LoadMigrations(fsys fs.FS) error {
-	mainTmpl := template.New("main").Funcs(sprig.TxtFuncMap()).Funcs(
-		template.FuncMap{
-			"install_snapshot": func(name string) (string, error) {
-				codePackageFSys, err := fs.Sub(fsys, "snapshots/"+name)
-				if err != nil {
-					return "", err
-				}
-				codePackage, err := LoadCodePackage(codePackageFSys)
-				if err != nil {
-					return "", err
-				}
-
-				return codePackage.Eval(m.Data)
-			},
-		},
-	)
-
-	var sharedPaths []string
-	fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
-		if (!d.IsDir()) &&
-			(filepath.Dir(path) != ".") &&
-			(filepath.Ext(path) == ".sql") {
-			sharedPaths = append(sharedPaths, path)
-		}
-		return nil
-	})
-
-	for _, p := range sharedPaths {
-		body, err := fs.ReadFile(fsys, p)
+// migrationDirFiles returns the paths of the files in fsys that may be migrations. Subdirectories other than snapshots
+// are only searched when recursive is true.
+func migrationDirFiles(fsys fs.FS, recursive bool) ([]string, error) {
+	var filePaths []string
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return err
 		}
-
-		_, err = mainTmpl.New(p).Parse(string(body))
-		if err != nil {
-			return err
+		if d.IsDir() {
+			if p != "." && (!recursive || p == "snapshots") {
+				return fs.SkipDir
+			}
+			return nil
 		}
-	}
-
-	paths, err := FindMigrations(fsys)
+		filePaths = append(filePaths, p)
+		return nil
+	})
 	if err != nil {
-		return err
+		return nil, err
 	}
+	return filePaths, nil
+}
 
-	if len(paths) == 0 {
-		return NoMigrationsFoundError{}
+// StrayMigrationFiles returns the files in fsys that look like migrations but are not loaded because their names do
+// not match the migration file name pattern. e.g. 001_create_people.sql.bak, 001_create_people.sql~, or the
+// .001_create_people.sql.swp swap file of an editor. These are usually accidental misnamings. .sql.example files such
+// as the one created by tern init are intentionally ignored and are not returned.
+func (m *Migrator) StrayMigrationFiles(fsys fs.FS) ([]string, error) {
+	pattern := m.filenamePattern()
+
+	filePaths, err := migrationDirFiles(fsys, m.options.RecursiveMigrations)
+	if err != nil {
+		return nil, err
 	}
 
-	for _, p := range paths {
-		body, err := fs.ReadFile(fsys, p)
-		if err != nil {
-			return err
+	var stray []string
+	for _, p := range filePaths {
+		name := path.Base(p)
+		if pattern.MatchString(name) || strings.HasSuffix(name, ".sql.example") {
+			continue
 		}
 
-		pieces := strings.SplitN(string(body), "---- create above / drop below ----", 2)
-		var upSQL, downSQL string
-		upSQL = strings.TrimSpace(pieces[0])
-		upSQL, err = m.evalMigration(mainTmpl.New(filepath.Base(p)+" up"), upSQL)
-		if err != nil {
-			return err
+		// Remove the decorations added by editors and backup tools and anything after the .sql extension.
+		candidate := strings.TrimRight(strings.TrimLeft(name, ".#"), "~#")
+		if i := strings.Index(strings.ToLower(candidate), ".sql"); i >= 0 {
+			candidate = candidate[:i] + ".sql"
 		}
-		// Make sure there is SQL in the forward migration step.
-		containsSQL := false
-		for _, v := range strings.Split(upSQL, "\n") {
-			// Only account for regular single line comment, empty line and space/comment combination
-			cleanString := strings.TrimSpace(v)
-			if len(cleanString) != 0 &&
-				!strings.HasPrefix(cleanString, "--") {
-				containsSQL = true
-				break
-			}
-		}
-		if !containsSQL {
-			return ErrNoFwMigration
+		if pattern.MatchString(candidate) {
+			stray = append(stray, p)
 		}
+	}
 
-		if len(pieces) == 2 {
-			downSQL = strings.TrimSpace(pieces[1])
-			downSQL, err = m.evalMigration(mainTmpl.New(filepath.Base(p)+" down"), downSQL)
-			if err != nil {
-				return err
-			}
-		}
+	return stray, nil
+}
 
-		m.AppendMigration(filepath.Base(p), upSQL, downSQL)
-	}
+// FindRepeatableMigrations finds all repeatable migration files in fsys. Repeatable migration files are named R__ followed
+// by a name and a .sql extension. e.g. R__people_view.sql. They are returned sorted by name which is the order they are
+// run.
+func FindRepeatableMigrations(fsys fs.FS) ([]string, error) {
+	return findRepeatableMigrations(fsys, false)
+}
 
-	return nil
+// FindRepeatableMigrationsRecursive is like FindRepeatableMigrations but also finds repeatable migration files in
+// subdirectories of fsys. e.g. views/R__people_view.sql. The returned paths are slash separated and relative to fsys and
+// are sorted by path. The snapshots directory used by tern code snapshot is not searched.
+func FindRepeatableMigrationsRecursive(fsys fs.FS) ([]string, error) {
+	return findRepeatableMigrations(fsys, true)
 }
 
-func (m *Migrator) evalMigration(tmpl *template.Template, sql string) (string, error) {
-	tmpl, err := tmpl.Parse(sql)
+func findRepeatableMigrations(fsys fs.FS, recursive bool) ([]string, error) {
+	filePaths, err := migrationDirFiles(fsys, recursive)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
-	var buf bytes.Buffer
-	err = tmpl.Execute(&buf, m.Data)
-	if err != nil {
-		return "", err
+	var paths []string
+	for _, p := range filePaths {
+		if repeatableMigrationPattern.MatchString(path.Base(p)) {
+			paths = append(paths, p)
+		}
 	}
+	slices.Sort(paths)
 
-	return buf.String(), nil
+	return paths, nil
 }
 
-func (m *Migrator) AppendMigration(name, upSQL, downSQL string) {
-	m.Migrations = append(
-		m.Migrations,
-		&Migration{
-			Sequence: int32(len(m.Migrations)) + 1,
-			Name:     name,
-			UpSQL:    upSQL,
-			DownSQL:  downSQL,
-		})
-	return
-}
+// readMigration reads the up and down SQL for the migration at path in fsys. The SQL is not evaluated as a template.
+func readMigration(fsys fs.FS, path string) (upSQL, downSQL string, err error) {
+	body, err := readSQLFile(fsys, path)
+	if err != nil {
+		return "", "", err
+	}
 
-// Migrate runs pending migrations
-// It calls m.OnStart when it begins a migration
-func (m *Migrator) Migrate(ctx context.Context) error {
-	return m.MigrateTo(ctx, int32(len(m.Migrations)))
-}
+	if strings.HasSuffix(path, upMigrationSuffix) {
+		downBody, err := readSQLFile(fsys, strings.TrimSuffix(path, upMigrationSuffix)+downMigrationSuffix)
+		if err != nil {
+			return "", "", err
+		}
+		return strings.TrimSpace(body), strings.TrimSpace(downBody), nil
+	}
 
-// Lock to ensure multiple migrations cannot occur simultaneously
-const lockNum = int64(9628173550095224) // arbitrary random number
+	// Any whitespace around the separator, including a \r of a Windows line ending, is removed by trimming the pieces.
+	pieces := strings.SplitN(body, migrationSeparator, 2)
+	upSQL = strings.TrimSpace(pieces[0])
+	if len(pieces) == 2 {
+		downSQL = strings.TrimSpace(pieces[1])
+	}
 
-func acquireAdvisoryLock(ctx context.Context, conn *pgx.Conn) error {
-	_, err := conn.Exec(ctx, "select pg_advisory_lock($1)", lockNum)
-	return err
+	return upSQL, downSQL, nil
 }
 
-func releaseAdvisoryLock(ctx context.Context, conn *pgx.Conn) error {
-	_, err := conn.Exec(ctx, "select pg_advisory_unlock($1)", lockNum)
-	return err
+// readSQLFile reads the SQL file at path in fsys. A leading UTF-8 byte order mark, which some Windows editors write, is
+// removed so it is not sent to the server and does not hide a magic comment on the first line.
+func readSQLFile(fsys fs.FS, path string) (string, error) {
+	body, err := fs.ReadFile(fsys, path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(string(body), "\ufeff"), nil
 }
 
-// MigrateTo migrates to targetVersion
-func (m *Migrator) MigrateTo(ctx context.Context, targetVersion int32) (err error) {
-	err = acquireAdvisoryLock(ctx, m.conn)
+// LoadMigrations loads the migrations in fsys. Any .sql files in subdirectories of fsys are parsed as shared templates
+// named by their slash separated path relative to fsys (e.g. "shared/v1_001.sql"). Migrations can use them with the
+// template action or the include function. e.g. {{ template "shared/v1_001.sql" . }} or
+// {{ include "shared/v1_001.sql" . }}. include returns the result as a string so it can be used in a pipeline.
+//
+// A migration can declare the environment variables it requires with a magic comment. e.g.
+// ---- tern: require-env APP_SCHEMA APP_OWNER ----. LoadMigrations returns an error listing any that are not set or
+// are empty instead of producing SQL with empty substitutions.
+//
+// Metadata such as the author of a migration can be given with "-- @key: value" comment lines at the top of the up
+// SQL. See Migration.Metadata.
+//
+// Migrations are evaluated with m.Data and .GeneratedAt (see MigratorOptions.GeneratedAt). A GeneratedAt key in m.Data
+// takes precedence.
+func (m *Migrator) LoadMigrations(fsys fs.FS) error {
+	l, err := m.newMigrationLoader(fsys)
 	if err != nil {
 		return err
 	}
-	defer func() {
-		unlockErr := releaseAdvisoryLock(ctx, m.conn)
-		if err == nil && unlockErr != nil {
-			err = unlockErr
-		}
-	}()
 
-	currentVersion, err := m.GetCurrentVersion(ctx)
+	paths, err := m.findMigrations(fsys)
 	if err != nil {
 		return err
 	}
 
-	if targetVersion < 0 || int32(len(m.Migrations)) < targetVersion {
-		errMsg := fmt.Sprintf("destination version %d is outside the valid versions of 0 to %d", targetVersion, len(m.Migrations))
-		return BadVersionError(errMsg)
+	if len(paths) == 0 {
+		return NoMigrationsFoundError{}
 	}
 
-	if currentVersion < 0 || int32(len(m.Migrations)) < currentVersion {
-		errMsg := fmt.Sprintf("current version %d is outside the valid versions of 0 to %d", currentVersion, len(m.Migrations))
-		return BadVersionError(errMsg)
+	for _, p := range paths {
+		upSQL, downSQL, err := l.loadMigration(p)
+		if err != nil {
+			return err
+		}
+
+		m.AppendMigration(filepath.Base(p), upSQL, downSQL)
 	}
 
-	var direction int32
-	if currentVersion < targetVersion {
-		direction = 1
-	} else {
-		direction = -1
+	repeatablePaths, err := m.findRepeatableMigrations(fsys)
+	if err != nil {
+		return err
 	}
 
-	for currentVersion != targetVersion {
-		var current *Migration
-		var sql, directionName string
-		var sequence int32
-		if direction == 1 {
-			current = m.Migrations[currentVersion]
+	for _, p := range repeatablePaths {
+		sql, err := l.loadRepeatableMigration(p)
+		if err != nil {
+			return err
+		}
+
+		m.AppendRepeatableMigration(p, sql)
+	}
+
+	return nil
+}
+
+// Validate checks the migrations in fsys without connecting to the database. Each migration is evaluated as a template
+// with m.Data like LoadMigrations and the resulting SQL is checked for unterminated quoted strings, quoted identifiers,
+// and comments. Unlike LoadMigrations it does not stop at the first error. An error that is specific to a migration
+// file is a MigrationFileError. The migrations are not added to m.
+func (m *Migrator) Validate(fsys fs.FS) []error {
+	l, err := m.newMigrationLoader(fsys)
+	if err != nil {
+		return []error{err}
+	}
+
+	paths, err := m.findMigrations(fsys)
+	if err != nil {
+		return []error{err}
+	}
+
+	if len(paths) == 0 {
+		return []error{NoMigrationsFoundError{}}
+	}
+
+	var errs []error
+	addErr := func(name string, err error) {
+		var fileErr MigrationFileError
+		if !errors.As(err, &fileErr) {
+			err = MigrationFileError{Name: name, Err: err}
+		}
+		errs = append(errs, err)
+	}
+
+	for _, p := range paths {
+		upSQL, downSQL, err := l.loadMigration(p)
+		if err == nil {
+			err = checkSQL("up", upSQL)
+		}
+		if err == nil {
+			err = checkSQL("down", downSQL)
+		}
+		if err != nil {
+			addErr(filepath.Base(p), err)
+		}
+	}
+
+	repeatablePaths, err := m.findRepeatableMigrations(fsys)
+	if err != nil {
+		return append(errs, err)
+	}
+
+	for _, p := range repeatablePaths {
+		sql, err := l.loadRepeatableMigration(p)
+		if err == nil {
+			err = checkSQL("repeatable", sql)
+		}
+		if err != nil {
+			addErr(p, err)
+		}
+	}
+
+	return errs
+}
+
+// checkSQL returns an error if sql ends inside a quoted string, quoted identifier, or comment.
+func checkSQL(direction, sql string) error {
+	err := sqlsplit.Check(sql)
+	if err != nil {
+		return fmt.Errorf("%s: %w", direction, err)
+	}
+	return nil
+}
+
+// findMigrations finds the migration files in fsys with the options of m.
+func (m *Migrator) findMigrations(fsys fs.FS) ([]string, error) {
+	return findMigrations(fsys, m.filenamePattern(), m.options.RecursiveMigrations)
+}
+
+func (m *Migrator) findRepeatableMigrations(fsys fs.FS) ([]string, error) {
+	return findRepeatableMigrations(fsys, m.options.RecursiveMigrations)
+}
+
+func (m *Migrator) filenamePattern() *regexp.Regexp {
+	if m.options.FilenamePattern != nil {
+		return m.options.FilenamePattern
+	}
+	return migrationPattern
+}
+
+// migrationLoader reads and evaluates migration files as templates.
+type migrationLoader struct {
+	fsys fs.FS
+	tmpl *template.Template
+	data map[string]interface{}
+	m    *Migrator
+}
+
+// newMigrationLoader prepares the template data and parses the shared templates in fsys.
+func (m *Migrator) newMigrationLoader(fsys fs.FS) (*migrationLoader, error) {
+	generatedAt := m.options.GeneratedAt
+	if generatedAt.IsZero() {
+		generatedAt = time.Now()
+	}
+	data := make(map[string]interface{}, len(m.Data)+1)
+	data["GeneratedAt"] = generatedAt
+	for k, v := range m.Data {
+		data[k] = v
+	}
+
+	var mainTmpl *template.Template
+	mainTmpl = template.New("main").Delims(m.options.Delims[0], m.options.Delims[1]).Funcs(sprig.TxtFuncMap()).Funcs(
+		template.FuncMap{
+			"include": func(name string, data interface{}) (string, error) {
+				var buf bytes.Buffer
+				err := mainTmpl.ExecuteTemplate(&buf, name, data)
+				if err != nil {
+					return "", err
+				}
+				return buf.String(), nil
+			},
+			"install_snapshot": func(name string) (string, error) {
+				codePackageFSys, err := fs.Sub(fsys, "snapshots/"+name)
+				if err != nil {
+					return "", err
+				}
+				codePackage, err := LoadCodePackage(codePackageFSys)
+				if err != nil {
+					return "", err
+				}
+
+				return codePackage.Eval(m.Data)
+			},
+		},
+	)
+
+	// fs.FS paths always use forward slashes so the path package is used instead of filepath. This ensures shared
+	// templates have the same name on every platform.
+	var sharedPaths []string
+	err := fs.WalkDir(fsys, ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if (!d.IsDir()) &&
+			(path.Dir(p) != ".") &&
+			(path.Ext(p) == ".sql") {
+			sharedPaths = append(sharedPaths, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	for _, p := range sharedPaths {
+		body, err := readSQLFile(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+
+		_, err = mainTmpl.New(p).Parse(body)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &migrationLoader{fsys: fsys, tmpl: mainTmpl, data: data, m: m}, nil
+}
+
+// loadMigration reads the migration at p and evaluates its up and down SQL.
+func (l *migrationLoader) loadMigration(p string) (upSQL, downSQL string, err error) {
+	upSQL, downSQL, err = readMigration(l.fsys, p)
+	if err != nil {
+		return "", "", err
+	}
+
+	err = checkRequiredEnv(upSQL + "\n" + downSQL)
+	if err != nil {
+		return "", "", MigrationFileError{Name: filepath.Base(p), Err: err}
+	}
+
+	err = checkRequiredData(upSQL+"\n"+downSQL, l.data)
+	if err != nil {
+		return "", "", MigrationFileError{Name: filepath.Base(p), Err: err}
+	}
+
+	upSQL, err = l.m.evalMigration(l.tmpl.New(filepath.Base(p)+" up"), upSQL, l.data)
+	if err != nil {
+		return "", "", err
+	}
+	// Make sure there is SQL in the forward migration step.
+	containsSQL := false
+	for _, v := range strings.Split(upSQL, "\n") {
+		// Only account for regular single line comment, empty line and space/comment combination
+		cleanString := strings.TrimSpace(v)
+		if len(cleanString) != 0 &&
+			!strings.HasPrefix(cleanString, "--") {
+			containsSQL = true
+			break
+		}
+	}
+	if !containsSQL {
+		return "", "", ErrNoFwMigration
+	}
+
+	if downSQL != "" {
+		downSQL, err = l.m.evalMigration(l.tmpl.New(filepath.Base(p)+" down"), downSQL, l.data)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	return upSQL, downSQL, nil
+}
+
+// loadRepeatableMigration reads the repeatable migration at p and evaluates its SQL.
+func (l *migrationLoader) loadRepeatableMigration(p string) (string, error) {
+	body, err := readSQLFile(l.fsys, p)
+	if err != nil {
+		return "", err
+	}
+
+	err = checkRequiredEnv(body)
+	if err != nil {
+		return "", MigrationFileError{Name: p, Err: err}
+	}
+
+	err = checkRequiredData(body, l.data)
+	if err != nil {
+		return "", MigrationFileError{Name: p, Err: err}
+	}
+
+	return l.m.evalMigration(l.tmpl.New(p), strings.TrimSpace(body), l.data)
+}
+
+// checkRequiredEnv returns an error listing the environment variables declared with the require-env magic comment in
+// body that are not set or are empty.
+func checkRequiredEnv(body string) error {
+	var missing []string
+	for _, matches := range requireEnvPattern.FindAllStringSubmatch(body, -1) {
+		for _, envvar := range strings.Fields(matches[1]) {
+			if os.Getenv(envvar) == "" {
+				missing = append(missing, envvar)
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required environment variables: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkRequiredData returns an error listing the data keys declared with the require-data magic comment in body that
+// are not in data. A key that is set to an empty value is present.
+func checkRequiredData(body string, data map[string]interface{}) error {
+	var missing []string
+	for _, matches := range requireDataPattern.FindAllStringSubmatch(body, -1) {
+		for _, key := range strings.Split(matches[1], ",") {
+			key = strings.TrimSpace(key)
+			if _, ok := data[key]; !ok && key != "" {
+				missing = append(missing, key)
+			}
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("missing required data: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func (m *Migrator) evalMigration(tmpl *template.Template, sql string, data map[string]interface{}) (string, error) {
+	tmpl, err := tmpl.Parse(sql)
+	if err != nil {
+		return "", err
+	}
+
+	var buf bytes.Buffer
+	err = tmpl.Execute(&buf, data)
+	if err != nil {
+		return "", err
+	}
+
+	return buf.String(), nil
+}
+
+func (m *Migrator) AppendMigration(name, upSQL, downSQL string) {
+	m.Migrations = append(
+		m.Migrations,
+		&Migration{
+			Sequence: int32(len(m.Migrations)) + 1,
+			Name:     name,
+			UpSQL:    upSQL,
+			DownSQL:  downSQL,
+			Metadata: parseMetadata(upSQL),
+		})
+	return
+}
+
+// parseMetadata returns the "-- @key: value" lines in the header of sql. The header ends at the first line that is not
+// blank or a comment.
+func parseMetadata(sql string) map[string]string {
+	var metadata map[string]string
+	for _, line := range strings.Split(sql, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if !strings.HasPrefix(line, "--") {
+			break
+		}
+
+		if matches := metadataPattern.FindStringSubmatch(line); matches != nil {
+			if metadata == nil {
+				metadata = make(map[string]string)
+			}
+			metadata[matches[1]] = matches[2]
+		}
+	}
+
+	return metadata
+}
+
+func (m *Migrator) AppendRepeatableMigration(name, sql string) {
+	m.RepeatableMigrations = append(m.RepeatableMigrations, &RepeatableMigration{Name: name, SQL: sql})
+}
+
+// IrreversibleMigrations returns the loaded migrations that do not have down SQL.
+func (m *Migrator) IrreversibleMigrations() []*Migration {
+	var irreversible []*Migration
+	for _, migration := range m.Migrations {
+		if !migration.Reversible() {
+			irreversible = append(irreversible, migration)
+		}
+	}
+	return irreversible
+}
+
+// Migrate runs pending migrations and then any repeatable migrations that have changed.
+// It calls m.OnStart when it begins a migration
+func (m *Migrator) Migrate(ctx context.Context) error {
+	err := m.MigrateTo(ctx, int32(len(m.Migrations)))
+	if err != nil {
+		return err
+	}
+
+	return m.MigrateRepeatable(ctx)
+}
+
+// Lock to ensure multiple migrations cannot occur simultaneously
+const lockNum = int64(9628173550095224) // arbitrary random number
+
+// VersionTableLockID returns the advisory lock id used when MigratorOptions.LockIDFromVersionTable is set. It is the
+// 64-bit FNV-1a hash of versionTable exactly as given. The same name always produces the same id so runs against the
+// same version table still serialize, even from different versions of tern. Names that differ only in spelling (e.g.
+// schema_version and public.schema_version) produce different ids.
+func VersionTableLockID(versionTable string) int64 {
+	h := fnv.New64a()
+	h.Write([]byte(versionTable))
+	return int64(h.Sum64())
+}
+
+// lockID returns the advisory lock id of m.
+func (m *Migrator) lockID() int64 {
+	if m.options.LockIDFromVersionTable {
+		return VersionTableLockID(m.versionTable)
+	}
+	return lockNum
+}
+
+// acquireLock acquires the advisory lock of m and calls the lock callbacks of m.options.
+func (m *Migrator) acquireLock(ctx context.Context, conn Conn) error {
+	lockID := m.lockID()
+
+	acquired := false
+	if m.options.OnLockWait != nil {
+		err := conn.QueryRow(ctx, "select pg_try_advisory_lock($1)", lockID).Scan(&acquired)
+		if err != nil {
+			return err
+		}
+		if !acquired {
+			m.options.OnLockWait(lockID)
+		}
+	}
+
+	if !acquired {
+		err := acquireAdvisoryLock(ctx, conn, lockID)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.options.OnLockAcquired != nil {
+		m.options.OnLockAcquired(lockID)
+	}
+	return nil
+}
+
+// releaseLock releases the advisory lock of m and calls the lock callbacks of m.options.
+func (m *Migrator) releaseLock(ctx context.Context, conn Conn) error {
+	lockID := m.lockID()
+	err := releaseAdvisoryLock(ctx, conn, lockID)
+	if err != nil {
+		return err
+	}
+
+	if m.options.OnLockReleased != nil {
+		m.options.OnLockReleased(lockID)
+	}
+	return nil
+}
+
+func acquireAdvisoryLock(ctx context.Context, conn Conn, lockID int64) error {
+	_, err := conn.Exec(ctx, "select pg_advisory_lock($1)", lockID)
+	return err
+}
+
+func releaseAdvisoryLock(ctx context.Context, conn Conn, lockID int64) error {
+	_, err := conn.Exec(ctx, "select pg_advisory_unlock($1)", lockID)
+	return err
+}
+
+// checkGuard runs the GuardSQL query and returns a GuardFailedError if it does not return true.
+func (m *Migrator) checkGuard(ctx context.Context, conn Conn) error {
+	var passed *bool
+	err := conn.QueryRow(ctx, m.options.GuardSQL).Scan(&passed)
+	if err != nil {
+		return fmt.Errorf("guard query failed: %w", err)
+	}
+
+	if passed == nil || !*passed {
+		message := m.options.GuardMessage
+		if message == "" {
+			message = "guard query did not return true"
+		}
+		return GuardFailedError{Message: message}
+	}
+
+	return nil
+}
+
+// MigrateTo migrates to targetVersion. It returns ErrReadOnlyDatabase without doing anything if the connection is
+// read-only unless SkipReadOnlyCheck is set.
+//
+// Multiple processes can safely migrate the same database at the same time. MigrateTo holds an advisory lock while it
+// reads the current version and runs migrations so each migration is only run once. The other processes wait for the
+// lock and then find the database already migrated.
+func (m *Migrator) MigrateTo(ctx context.Context, targetVersion int32) error {
+	return m.migrateTo(ctx, m.conn, targetVersion, false)
+}
+
+// migrateTo migrates to targetVersion on conn. If inTx is true conn is a transaction given to MigrateToTx and every
+// migration that would be run must be transactional.
+func (m *Migrator) migrateTo(ctx context.Context, conn Conn, targetVersion int32, inTx bool) (err error) {
+	ctx, span := m.startSpan(ctx, "tern.migrate")
+	span.SetAttribute("tern.target_version", targetVersion)
+	defer func() { span.End(err) }()
+
+	if !m.options.SkipReadOnlyCheck {
+		var readOnly string
+		err = conn.QueryRow(ctx, "select current_setting('transaction_read_only')").Scan(&readOnly)
+		if err != nil {
+			return err
+		}
+		if readOnly == "on" {
+			return ErrReadOnlyDatabase
+		}
+	}
+
+	err = m.acquireLock(ctx, conn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		unlockErr := m.releaseLock(ctx, conn)
+		if err == nil && unlockErr != nil {
+			err = unlockErr
+		}
+	}()
+
+	if m.options.GuardSQL != "" {
+		err = m.checkGuard(ctx, conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	currentVersion, err := m.plannedCurrentVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	span.SetAttribute("tern.current_version", currentVersion)
+
+	if int32(len(m.Migrations)) < currentVersion {
+		return MissingMigrationsError{CurrentVersion: currentVersion, MigrationCount: len(m.Migrations)}
+	}
+
+	if targetVersion < 0 || int32(len(m.Migrations)) < targetVersion {
+		errMsg := fmt.Sprintf("destination version %d is outside the valid versions of 0 to %d", targetVersion, len(m.Migrations))
+		return BadVersionError(errMsg)
+	}
+
+	if currentVersion < 0 {
+		errMsg := fmt.Sprintf("current version %d is outside the valid versions of 0 to %d", currentVersion, len(m.Migrations))
+		return BadVersionError(errMsg)
+	}
+
+	var direction int32
+	if currentVersion < targetVersion {
+		direction = 1
+	} else {
+		direction = -1
+	}
+
+	migrated := currentVersion != targetVersion
+
+	if inTx {
+		err = m.checkTransactional(currentVersion, targetVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	incomplete, err := m.incompleteMigration(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if incomplete != "" {
+		err = m.checkIncompleteMigration(incomplete, currentVersion, targetVersion)
+		if err != nil {
+			return err
+		}
+	}
+
+	if migrated && m.PreMigrateCheck != nil {
+		err = m.PreMigrateCheck(ctx, conn)
+		if err != nil {
+			return err
+		}
+	}
+
+	var migrationErrs []error
+	for currentVersion != targetVersion {
+		var current *Migration
+		var sql, directionName string
+		var sequence int32
+		if direction == 1 {
+			current = m.Migrations[currentVersion]
 			sequence = current.Sequence
 			sql = current.UpSQL
 			directionName = "up"
@@ -331,113 +1456,952 @@ func (m *Migrator) MigrateTo(ctx context.Context, targetVersion int32) (err erro
 			sequence = current.Sequence - 1
 			sql = current.DownSQL
 			directionName = "down"
-			if current.DownSQL == "" {
+			if !current.Reversible() {
+				if len(migrationErrs) > 0 {
+					return errors.Join(append(migrationErrs, IrreversibleMigrationError{m: current})...)
+				}
 				return IrreversibleMigrationError{m: current}
 			}
 		}
 
-		useTx := !m.options.DisableTx
-		var sqlStatements []string
-		if disableTxPattern.MatchString(sql) {
-			useTx = false
-			sql = disableTxPattern.ReplaceAllLiteralString(sql, "")
+		migrationCtx, migrationSpan := m.startSpan(ctx, "tern.migration")
+		migrationSpan.SetAttribute("tern.migration.sequence", current.Sequence)
+		migrationSpan.SetAttribute("tern.migration.name", current.Name)
+		migrationSpan.SetAttribute("tern.migration.direction", directionName)
+		migrationSpan.SetAttribute("tern.migration.disable_tx", !m.useTx(current, directionName))
+		startTime := time.Now()
+		err = m.runMigrationWithTimeout(migrationCtx, conn, current, directionName, sql, sequence, len(migrationErrs) == 0)
+		migrationSpan.SetAttribute("tern.migration.duration_seconds", time.Since(startTime).Seconds())
+		migrationSpan.End(err)
+		if err != nil {
+			if !m.options.ContinueOnError {
+				return err
+			}
+			migrationErrs = append(migrationErrs, err)
+
+			// A later step that does not run in a transaction would replace the record of this one and then clear it.
+			if m.marksInProgress(current, directionName) {
+				incomplete, checkErr := m.incompleteMigration(ctx, conn)
+				if checkErr != nil {
+					return errors.Join(append(migrationErrs, checkErr)...)
+				}
+				if incomplete != "" {
+					return errors.Join(migrationErrs...)
+				}
+			}
+		}
+
+		currentVersion = currentVersion + direction
+	}
+
+	if len(migrationErrs) > 0 {
+		return errors.Join(migrationErrs...)
+	}
+
+	if m.options.NotifyChannel != "" && (migrated || m.options.NotifyWhenUnchanged) {
+		_, err = conn.Exec(ctx, "select pg_notify($1, $2)", m.options.NotifyChannel, strconv.FormatInt(int64(targetVersion), 10))
+		if err != nil {
+			return fmt.Errorf("failed to notify %s: %w", m.options.NotifyChannel, err)
+		}
+	}
+
+	return nil
+}
+
+// runMigrationWithRetry runs a single migration step with runMigration. A migration that runs in a transaction is
+// retried up to MaxRetries times when it fails with a deadlock or serialization failure.
+func (m *Migrator) runMigrationWithRetry(ctx context.Context, conn Conn, current *Migration, directionName, sql string, sequence int32, updateVersion bool) error {
+	backoff := m.options.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := m.runMigration(ctx, conn, current, directionName, sql, sequence, updateVersion)
+		if err == nil || attempt >= m.options.MaxRetries || !m.useTx(current, directionName) || !isRetryableError(err) {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// runMigrationWithTimeout runs the migration step with runMigrationWithRetry. It is canceled if it runs longer than
+// MigrationTimeout.
+func (m *Migrator) runMigrationWithTimeout(ctx context.Context, conn Conn, current *Migration, directionName, sql string, sequence int32, updateVersion bool) error {
+	if m.options.MigrationTimeout <= 0 {
+		return m.runMigrationWithRetry(ctx, conn, current, directionName, sql, sequence, updateVersion)
+	}
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, m.options.MigrationTimeout)
+	defer cancel()
+
+	err := m.runMigrationWithRetry(timeoutCtx, conn, current, directionName, sql, sequence, updateVersion)
+	if err != nil && ctx.Err() == nil && errors.Is(timeoutCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("%s: migration did not finish within %v: %w", current.Name, m.options.MigrationTimeout, context.DeadlineExceeded)
+	}
+	return err
+}
+
+// isRetryableError reports whether err is a deadlock or serialization failure from running or committing a migration.
+func isRetryableError(err error) bool {
+	var pgErr *pgconn.PgError
+	return errors.As(err, &pgErr) && (pgErr.Code == "40P01" || pgErr.Code == "40001")
+}
+
+// MigrateToTx migrates to targetVersion in tx, a transaction begun by the caller. The caller controls whether the
+// migrations are committed or rolled back. e.g. a test can migrate and roll back afterward to leave the database
+// unchanged. Each migration is run in a savepoint of tx. The Migrator's own connection is not used. Every migration
+// that would be run must be transactional. A migration that disables its transaction or runs in batches causes an error
+// before any migration is run unless it is skipped because of the environment or tags. Like MigrateTo the migrations
+// are planned from MigratorOptions.AssumedCurrentVersion if it is set. It is also an error if MigratorOptions.DisableTx
+// or MigratorOptions.VersionConn is set as the version would not be updated in tx.
+func (m *Migrator) MigrateToTx(ctx context.Context, tx pgx.Tx, targetVersion int32) error {
+	if m.options.DisableTx {
+		return errors.New("MigrateToTx cannot be used with DisableTx")
+	}
+	if m.options.VersionConn != nil {
+		return errors.New("MigrateToTx cannot be used with VersionConn")
+	}
+
+	return m.migrateTo(ctx, tx, targetVersion, true)
+}
+
+// checkTransactional returns an error if a migration step from currentVersion to targetVersion does not run in a
+// transaction. Steps that are skipped because of the environment or tags are not run so they are not checked.
+func (m *Migrator) checkTransactional(currentVersion, targetVersion int32) error {
+	for v := currentVersion; v != targetVersion; {
+		var current *Migration
+		var directionName string
+		if v < targetVersion {
+			current, directionName = m.Migrations[v], "up"
+			v++
+		} else {
+			current, directionName = m.Migrations[v-1], "down"
+			v--
+		}
+		if !m.selected(current) {
+			continue
+		}
+		if !m.useTx(current, directionName) {
+			return fmt.Errorf("%s: migration cannot be run in the transaction given to MigrateToTx because it is not transactional", current.Name)
+		}
+	}
+	return nil
+}
+
+// selected reports whether the SQL of the migration is run rather than skipped because of the environment or tags.
+func (m *Migrator) selected(current *Migration) bool {
+	return current.RunsInEnvironment(m.options.Environment) && current.RunsWithTags(m.options.IncludeTags, m.options.ExcludeTags)
+}
+
+// CheckCurrentMigration checks that the schema on conn matches the current version in the version table by running
+// the down SQL and then the up SQL of the current migration in a transaction that is always rolled back. It returns a
+// StateDriftError if either fails. It is intended to be used as PreMigrateCheck. The check is skipped when the version
+// is 0 or the current migration is irreversible or not transactional as it cannot be safely undone.
+//
+// This only detects drift that causes the SQL of the current migration to fail. e.g. dropping a table that was dropped
+// manually. Running the SQL may take locks and time proportional to the work the migration does.
+func (m *Migrator) CheckCurrentMigration(ctx context.Context, conn Conn) error {
+	currentVersion, err := m.GetCurrentVersion(ctx)
+	if err != nil {
+		return err
+	}
+	if currentVersion <= 0 || int(currentVersion) > len(m.Migrations) {
+		return nil
+	}
+
+	current := m.Migrations[currentVersion-1]
+	if !current.Reversible() || !m.useTx(current, "down") || !m.useTx(current, "up") {
+		return nil
+	}
+
+	tx, err := conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	for _, sql := range []string{current.DownSQL, current.UpSQL} {
+		_, err = tx.Exec(ctx, sql)
+		if err != nil {
+			return StateDriftError{CurrentVersion: currentVersion, MigrationName: current.Name, Err: err}
+		}
+	}
+
+	return nil
+}
+
+// plannedCurrentVersion returns the version MigrateTo migrates from. It is MigratorOptions.AssumedCurrentVersion the
+// first time it is called and the version in the version table after that.
+func (m *Migrator) plannedCurrentVersion(ctx context.Context, conn Conn) (int32, error) {
+	if m.options.AssumedCurrentVersion != nil && !m.assumedUsed {
+		m.assumedUsed = true
+		return *m.options.AssumedCurrentVersion, nil
+	}
+	return m.versionStore().GetVersion(ctx, m.versionConn(conn))
+}
+
+// useTx reports whether the migration step runs in a transaction. A batch migration never runs in a single
+// transaction as each batch is committed separately.
+func (m *Migrator) useTx(current *Migration, directionName string) bool {
+	return !m.options.DisableTx && !current.DisableTx(directionName) && current.BatchSize(directionName) == 0
+}
+
+// marksInProgress reports whether the migration step is recorded as in progress while it runs. That is the case for a
+// step that does not run in a transaction and is not a batch migration.
+func (m *Migrator) marksInProgress(current *Migration, directionName string) bool {
+	return !m.useTx(current, directionName) && current.BatchSize(directionName) == 0
+}
+
+// runMigration runs a single migration step. If updateVersion is true the version table is set to sequence in the same
+// transaction as the migration.
+func (m *Migrator) runMigration(ctx context.Context, conn Conn, current *Migration, directionName, sql string, sequence int32, updateVersion bool) (err error) {
+	if !current.RunsInEnvironment(m.options.Environment) {
+		if m.options.FailOnExcludedEnvironment {
+			return ExcludedEnvironmentError{
+				MigrationName: current.Name,
+				Environment:   m.options.Environment,
+				Environments:  current.Environments(),
+			}
+		}
+		return m.skipMigration(ctx, conn, current, directionName, sequence, updateVersion)
+	}
+	if !current.RunsWithTags(m.options.IncludeTags, m.options.ExcludeTags) {
+		return m.skipMigration(ctx, conn, current, directionName, sequence, updateVersion)
+	}
+
+	useTx := m.useTx(current, directionName)
+	if current.DisableTx(directionName) {
+		sql = disableTxPattern.ReplaceAllLiteralString(sql, "")
+	}
+	sql = idempotentPattern.ReplaceAllLiteralString(sql, "")
+	batchSize := current.BatchSize(directionName)
+	if batchSize > 0 {
+		sql = batchPattern.ReplaceAllLiteralString(sql, "")
+	}
+
+	if m.SQLTransform != nil {
+		sql, err = m.SQLTransform(directionName, current.Name, sql)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.options.AnnotateApplicationName {
+		restore, err := m.annotateApplicationName(ctx, conn, current.Name)
+		if err != nil {
+			return err
+		}
+		// Deferred before the transaction is started so it runs after the transaction has been committed or rolled back.
+		defer restore()
+	}
+
+	var tx pgx.Tx
+	if useTx {
+		tx, err = conn.Begin(ctx)
+		if err != nil {
+			return err
+		}
+		defer tx.Rollback(ctx)
+	}
+
+	// Without a transaction an interrupted migration can leave its changes partially applied. Record that it is
+	// running so the next run can warn about it.
+	markInProgress := m.marksInProgress(current, directionName)
+	if markInProgress {
+		err = m.setInProgress(ctx, conn, current.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Fire on start callback
+	startTime := time.Now()
+	if m.OnStart != nil {
+		m.OnStart(current.Sequence, current.Name, directionName, sql)
+	}
+
+	// Execute the migration
+	execStatement := func(statement string) error {
+		_, err := conn.Exec(ctx, statement)
+		if err != nil {
+			if err, ok := err.(*pgconn.PgError); ok {
+				return MigrationPgError{MigrationName: current.Name, Sql: statement, PgError: err}
+			}
+			return err
+		}
+		return nil
+	}
+
+	if batchSize > 0 {
+		err = m.execBatches(ctx, conn, current, sql, batchSize)
+	} else if useTx {
+		err = execStatement(sql)
+	} else {
+		// Without a transaction each statement must be run separately. Statements are executed as they are split so a
+		// large migration does not need to be split into memory all at once.
+		var executed int
+		err = sqlsplit.SplitFunc(sql, func(statement string) error {
+			err := execStatement(statement)
+			if err == nil {
+				executed++
+			}
+			return err
+		})
+
+		// When the first statement fails with an SQL error nothing was applied so the migration can simply be run again.
+		var pgErr *pgconn.PgError
+		if err != nil && markInProgress && executed == 0 && errors.As(err, &pgErr) {
+			if clearErr := m.setInProgress(ctx, conn, ""); clearErr != nil {
+				return errors.Join(err, clearErr)
+			}
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	// Reset all database connection settings. Important to do before updating version as search_path may have been changed.
+	conn.Exec(ctx, "reset all")
+
+	if updateVersion && m.options.VersionConn == nil {
+		err = m.versionStore().SetVersion(ctx, conn, sequence)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = m.recordHistory(ctx, conn, current, directionName)
+	if err != nil {
+		return err
+	}
+
+	if useTx {
+		err = tx.Commit(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if updateVersion && m.options.VersionConn != nil {
+		err = m.versionStore().SetVersion(ctx, m.options.VersionConn, sequence)
+		if err != nil {
+			return fmt.Errorf("migration %s was applied but the version could not be updated: %w", current.Name, err)
+		}
+	}
+
+	if markInProgress {
+		err = m.setInProgress(ctx, conn, "")
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.OnFinish != nil {
+		m.OnFinish(current.Sequence, current.Name, directionName, time.Since(startTime))
+	}
+
+	return nil
+}
+
+// execBatches runs the single statement in sql with $1 set to batchSize until it affects no rows. Each batch is run
+// and committed in its own implicit transaction. The statement must only affect rows that have not yet been
+// processed (e.g. where new_column is null) or it would never finish.
+//
+// The version is only updated after the last batch. If the migration is interrupted the batches that were already
+// committed remain and the migration is run again from the start by the next migrate. Because the statement only
+// affects rows that remain to be processed, it resumes where it left off.
+func (m *Migrator) execBatches(ctx context.Context, conn Conn, current *Migration, sql string, batchSize int) error {
+	statements := sqlsplit.Split(sql)
+	if len(statements) != 1 {
+		return fmt.Errorf("%s: batch migration must contain exactly one statement but has %d", current.Name, len(statements))
+	}
+	statement := statements[0]
+
+	for batch := 1; ; batch++ {
+		commandTag, err := conn.Exec(ctx, statement, batchSize)
+		if err != nil {
+			if err, ok := err.(*pgconn.PgError); ok {
+				return MigrationPgError{MigrationName: current.Name, Sql: statement, PgError: err}
+			}
+			return err
+		}
+
+		rowsAffected := commandTag.RowsAffected()
+		if rowsAffected == 0 {
+			return nil
 		}
 
-		if useTx {
-			sqlStatements = []string{sql}
-		} else {
-			sqlStatements = sqlsplit.Split(sql)
+		if m.OnBatch != nil {
+			m.OnBatch(current.Sequence, current.Name, batch, rowsAffected)
 		}
+	}
+}
 
-		var tx pgx.Tx
-		if useTx {
-			tx, err = m.conn.Begin(ctx)
-			if err != nil {
-				return err
-			}
-			defer tx.Rollback(ctx)
+// annotateApplicationName sets application_name to include the migration name. It returns a function that restores
+// the original application_name. It is set at the session level, so it is not undone when the migration is rolled back,
+// and it is explicitly restored because a migration may change it or reset it with reset all.
+func (m *Migrator) annotateApplicationName(ctx context.Context, conn Conn, name string) (restore func(), err error) {
+	var original string
+	err = conn.QueryRow(ctx, "select current_setting('application_name')").Scan(&original)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = conn.Exec(ctx, "select set_config('application_name', $1, false)", "tern:"+strings.TrimSuffix(name, ".sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	restore = func() {
+		// ctx may have been canceled by MigrationTimeout but the annotation must still be undone.
+		conn.Exec(context.WithoutCancel(ctx), "select set_config('application_name', $1, false)", original)
+	}
+	return restore, nil
+}
+
+// skipMigration advances the version past a migration that is not allowed to run in the current environment or is not
+// selected by tags without running its SQL.
+func (m *Migrator) skipMigration(ctx context.Context, conn Conn, current *Migration, directionName string, sequence int32, updateVersion bool) error {
+	if updateVersion {
+		err := m.versionStore().SetVersion(ctx, m.versionConn(conn), sequence)
+		if err != nil {
+			return err
 		}
+	}
+
+	if m.OnSkip != nil {
+		m.OnSkip(current.Sequence, current.Name, directionName)
+	}
+
+	return nil
+}
+
+func (m *Migrator) recordHistory(ctx context.Context, conn Conn, current *Migration, directionName string) error {
+	if m.options.HistoryTable == "" {
+		return nil
+	}
 
-		// Fire on start callback
-		if m.OnStart != nil {
-			m.OnStart(current.Sequence, current.Name, directionName, sql)
+	_, err := conn.Exec(ctx,
+		"insert into "+m.options.HistoryTable+"(sequence, name, direction, applied_by, session_user_name) values($1, $2, $3, current_user, session_user)",
+		current.Sequence, current.Name, directionName,
+	)
+	return err
+}
+
+// History returns the migrations recorded in the history table that were run at or after since, most recent first. If
+// since is the zero time all entries are returned. If limit is greater than 0 at most limit entries are returned.
+func (m *Migrator) History(ctx context.Context, since time.Time, limit int) ([]*HistoryEntry, error) {
+	if m.options.HistoryTable == "" {
+		return nil, errors.New("no history table is configured")
+	}
+
+	sql := "select id, sequence, name, direction, applied_by, session_user_name, applied_at from " + m.options.HistoryTable +
+		" where applied_at >= $1 order by id desc"
+	args := []interface{}{since}
+	if limit > 0 {
+		sql += " limit $2"
+		args = append(args, limit)
+	}
+
+	rows, err := m.conn.Query(ctx, sql, args...)
+	if err != nil {
+		return nil, err
+	}
+
+	return pgx.CollectRows(rows, func(row pgx.CollectableRow) (*HistoryEntry, error) {
+		var e HistoryEntry
+		err := row.Scan(&e.ID, &e.Sequence, &e.Name, &e.Direction, &e.AppliedBy, &e.SessionUser, &e.AppliedAt)
+		return &e, err
+	})
+}
+
+// MigrateRepeatable runs the repeatable migrations that have not been run or whose checksum has changed since they were
+// last run. Each repeatable migration is run in its own transaction along with the update of its checksum. OnStart is
+// called with a sequence of 0 and a direction of "repeatable".
+func (m *Migrator) MigrateRepeatable(ctx context.Context) (err error) {
+	if len(m.RepeatableMigrations) == 0 {
+		return nil
+	}
+
+	err = m.acquireLock(ctx, m.conn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		unlockErr := m.releaseLock(ctx, m.conn)
+		if err == nil && unlockErr != nil {
+			err = unlockErr
 		}
+	}()
 
-		// Execute the migration
-		for _, statement := range sqlStatements {
-			_, err = m.conn.Exec(ctx, statement)
-			if err != nil {
-				if err, ok := err.(*pgconn.PgError); ok {
-					return MigrationPgError{MigrationName: current.Name, Sql: statement, PgError: err}
-				}
-				return err
-			}
+	_, err = m.conn.Exec(ctx, fmt.Sprintf(`create table if not exists %s(
+  name text primary key,
+  checksum text not null,
+  applied_at timestamptz not null default now()
+)`, m.repeatableTable()))
+	if err != nil {
+		return err
+	}
+
+	for _, rm := range m.RepeatableMigrations {
+		checksum := rm.Checksum()
+
+		appliedChecksum, err := m.appliedRepeatableChecksum(ctx, rm)
+		if err != nil {
+			return err
+		}
+		if appliedChecksum == checksum {
+			continue
+		}
+
+		err = m.runRepeatableMigration(ctx, rm, checksum)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// appliedRepeatableChecksum returns the checksum of rm when it was last run or an empty string if it has not been run.
+func (m *Migrator) appliedRepeatableChecksum(ctx context.Context, rm *RepeatableMigration) (string, error) {
+	var checksum string
+	err := m.conn.QueryRow(ctx, "select checksum from "+m.repeatableTable()+" where name=$1", rm.Name).Scan(&checksum)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return "", err
+	}
+	return checksum, nil
+}
+
+// PendingRepeatable returns the repeatable migrations that MigrateRepeatable would run because they have not been run or
+// their checksum has changed since they were last run. Unlike MigrateRepeatable it does not create the table that
+// tracks the checksums.
+func (m *Migrator) PendingRepeatable(ctx context.Context) ([]*RepeatableMigration, error) {
+	pending := []*RepeatableMigration{}
+	if len(m.RepeatableMigrations) == 0 {
+		return pending, nil
+	}
+
+	var exists bool
+	err := m.conn.QueryRow(ctx, "select to_regclass($1) is not null", m.repeatableTable()).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return append(pending, m.RepeatableMigrations...), nil
+	}
+
+	for _, rm := range m.RepeatableMigrations {
+		appliedChecksum, err := m.appliedRepeatableChecksum(ctx, rm)
+		if err != nil {
+			return nil, err
 		}
+		if appliedChecksum != rm.Checksum() {
+			pending = append(pending, rm)
+		}
+	}
 
-		// Reset all database connection settings. Important to do before updating version as search_path may have been changed.
-		m.conn.Exec(ctx, "reset all")
+	return pending, nil
+}
 
-		// Add one to the version
-		_, err = m.conn.Exec(ctx, "update "+m.versionTable+" set version=$1", sequence)
+func (m *Migrator) runRepeatableMigration(ctx context.Context, rm *RepeatableMigration, checksum string) error {
+	sql := rm.SQL
+	if m.SQLTransform != nil {
+		var err error
+		sql, err = m.SQLTransform("repeatable", rm.Name, sql)
 		if err != nil {
 			return err
 		}
+	}
 
-		if useTx {
-			err = tx.Commit(ctx)
-			if err != nil {
-				return err
-			}
+	tx, err := m.conn.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	startTime := time.Now()
+	if m.OnStart != nil {
+		m.OnStart(0, rm.Name, "repeatable", sql)
+	}
+
+	_, err = tx.Exec(ctx, sql)
+	if err != nil {
+		if err, ok := err.(*pgconn.PgError); ok {
+			return MigrationPgError{MigrationName: rm.Name, Sql: sql, PgError: err}
 		}
+		return err
+	}
 
-		currentVersion = currentVersion + direction
+	// Reset all database connection settings. Important to do before updating the checksum as search_path may have been
+	// changed.
+	tx.Exec(ctx, "reset all")
+
+	_, err = tx.Exec(ctx, fmt.Sprintf(`insert into %s(name, checksum) values($1, $2)
+on conflict (name) do update set checksum=excluded.checksum, applied_at=now()`, m.repeatableTable()), rm.Name, checksum)
+	if err != nil {
+		return err
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return err
+	}
+
+	if m.OnFinish != nil {
+		m.OnFinish(0, rm.Name, "repeatable", time.Since(startTime))
 	}
 
 	return nil
 }
 
+func (m *Migrator) repeatableTable() string {
+	if m.options.RepeatableTable != "" {
+		return m.options.RepeatableTable
+	}
+	return m.versionTable + "_repeatable"
+}
+
+// Close releases any advisory lock still held by the Migrator on its connection. A lock can be left behind when a
+// migration is interrupted before the lock could be released. The connection is owned by the caller of NewMigrator and
+// is not closed. If the Migrator was created with NewMigratorFromPool its pinned connection is returned to the pool. The
+// Migrator should not be used after Close is called.
+func (m *Migrator) Close(ctx context.Context) error {
+	err := m.releaseAllAdvisoryLocks(ctx)
+
+	if m.pooledConn != nil {
+		if err != nil {
+			// The session may still hold the lock so it must not be returned to the pool. Closing it releases the lock.
+			m.pooledConn.Hijack().Close(ctx)
+		} else {
+			m.pooledConn.Release()
+		}
+		m.pooledConn = nil
+	}
+
+	return err
+}
+
+func (m *Migrator) releaseAllAdvisoryLocks(ctx context.Context) error {
+	if m.conn == nil {
+		return nil
+	}
+	if conn, ok := m.conn.(interface{ IsClosed() bool }); ok && conn.IsClosed() {
+		return nil
+	}
+
+	// Advisory locks can be acquired multiple times by the same session. Each acquisition must be released.
+	for {
+		var released bool
+		err := m.conn.QueryRow(ctx, "select pg_advisory_unlock($1)", m.lockID()).Scan(&released)
+		if err != nil {
+			return err
+		}
+		if !released {
+			return nil
+		}
+	}
+}
+
 func (m *Migrator) GetCurrentVersion(ctx context.Context) (v int32, err error) {
-	err = m.conn.QueryRow(ctx, "select version from "+m.versionTable).Scan(&v)
-	return v, err
+	return m.versionStore().GetVersion(ctx, m.versionConn(m.conn))
+}
+
+// SetVersion sets the version table to version without running any migrations. It is intended for repairing a
+// version table that no longer matches the migrations or the actual state of the database. version must be between 0
+// and the number of migrations.
+func (m *Migrator) SetVersion(ctx context.Context, version int32) (err error) {
+	if version < 0 || int32(len(m.Migrations)) < version {
+		errMsg := fmt.Sprintf("version %d is outside the valid versions of 0 to %d", version, len(m.Migrations))
+		return BadVersionError(errMsg)
+	}
+
+	err = m.acquireLock(ctx, m.conn)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		unlockErr := m.releaseLock(ctx, m.conn)
+		if err == nil && unlockErr != nil {
+			err = unlockErr
+		}
+	}()
+
+	err = m.versionStore().SetVersion(ctx, m.versionConn(m.conn), version)
+	if err != nil {
+		return err
+	}
+
+	// Setting the version is how an incomplete migration is repaired.
+	return m.setInProgress(ctx, m.conn, "")
+}
+
+// IncompleteMigration returns the name of a migration that does not run in a transaction that was started but did not
+// finish. Its changes may have been partially applied. It returns an empty string if there is no such migration or the
+// VersionStore does not implement InProgressStore. The record is cleared when the migration next succeeds or the
+// version is set with SetVersion.
+func (m *Migrator) IncompleteMigration(ctx context.Context) (string, error) {
+	return m.incompleteMigration(ctx, m.conn)
+}
+
+func (m *Migrator) incompleteMigration(ctx context.Context, conn Conn) (string, error) {
+	store, ok := m.versionStore().(InProgressStore)
+	if !ok {
+		return "", nil
+	}
+	return store.GetInProgress(ctx, m.versionConn(conn))
+}
+
+// checkIncompleteMigration decides whether MigrateTo may run when the migration named name did not finish on a previous
+// run. It returns an IncompleteMigrationError if the migration steps to targetVersion would run that migration or
+// migrate past it, unless it is the first step and is marked idempotent. It also does so if a step would record itself
+// as in progress as that would replace the record. Otherwise the record is kept and reported with
+// OnIncompleteMigrationWarning.
+func (m *Migrator) checkIncompleteMigration(name string, currentVersion, targetVersion int32) error {
+	var recordedSequence int32
+	for _, mig := range m.Migrations {
+		if mig.Name == name {
+			recordedSequence = mig.Sequence
+			break
+		}
+	}
+
+	if currentVersion < targetVersion {
+		if next := m.Migrations[currentVersion]; next.Name == name && next.Idempotent("up") {
+			if m.OnIncompleteMigration != nil {
+				m.OnIncompleteMigration(name)
+			}
+			return nil
+		}
+		// A down migration that was interrupted leaves the version at its own sequence.
+		if recordedSequence != 0 && currentVersion <= recordedSequence && recordedSequence <= targetVersion {
+			return IncompleteMigrationError{MigrationName: name}
+		}
+		for _, mig := range m.Migrations[currentVersion:targetVersion] {
+			if m.selected(mig) && m.marksInProgress(mig, "up") {
+				return IncompleteMigrationError{MigrationName: name}
+			}
+		}
+	} else if currentVersion > targetVersion {
+		if next := m.Migrations[currentVersion-1]; next.Name == name && next.Idempotent("down") {
+			if m.OnIncompleteMigration != nil {
+				m.OnIncompleteMigration(name)
+			}
+			return nil
+		}
+		if recordedSequence != 0 && targetVersion < recordedSequence && recordedSequence <= currentVersion {
+			return IncompleteMigrationError{MigrationName: name}
+		}
+		for _, mig := range m.Migrations[targetVersion:currentVersion] {
+			if m.selected(mig) && m.marksInProgress(mig, "down") {
+				return IncompleteMigrationError{MigrationName: name}
+			}
+		}
+	}
+
+	if m.OnIncompleteMigrationWarning != nil {
+		m.OnIncompleteMigrationWarning(name)
+	}
+	return nil
+}
+
+// setInProgress records name as the running migration if the VersionStore implements InProgressStore.
+func (m *Migrator) setInProgress(ctx context.Context, conn Conn, name string) error {
+	store, ok := m.versionStore().(InProgressStore)
+	if !ok {
+		return nil
+	}
+	return store.SetInProgress(ctx, m.versionConn(conn), name)
+}
+
+// IsUpToDate reports whether the current version is the last loaded migration. It only reads the version and does not
+// acquire the advisory lock so it is cheap enough to call at application startup. A database that is ahead of the loaded
+// migrations is not up to date.
+func (m *Migrator) IsUpToDate(ctx context.Context) (bool, error) {
+	currentVersion, err := m.GetCurrentVersion(ctx)
+	if err != nil {
+		return false, err
+	}
+	return currentVersion == int32(len(m.Migrations)), nil
+}
+
+// PendingCount returns the number of migrations that have not been applied.
+func (m *Migrator) PendingCount(ctx context.Context) (int, error) {
+	pending, err := m.Pending(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return len(pending), nil
+}
+
+// Pending returns the migrations that have not been applied.
+func (m *Migrator) Pending(ctx context.Context) ([]*Migration, error) {
+	currentVersion, err := m.GetCurrentVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if currentVersion < 0 {
+		currentVersion = 0
+	}
+	if currentVersion >= int32(len(m.Migrations)) {
+		return []*Migration{}, nil
+	}
+
+	return m.Migrations[currentVersion:], nil
 }
 
+// ensureSchemaVersionTableExists creates the version table if it does not exist. The advisory lock prevents concurrent
+// migrators on a new database from racing to create and initialize it. The lock is released before MigrateTo acquires
+// it again. This is safe because the version table is initialized only when it is empty and MigrateTo reads the
+// current version after it has acquired the lock. Any migrations run by another process in between are seen and are
+// not run again.
 func (m *Migrator) ensureSchemaVersionTableExists(ctx context.Context) (err error) {
-	err = acquireAdvisoryLock(ctx, m.conn)
+	err = m.acquireLock(ctx, m.conn)
 	if err != nil {
 		return err
 	}
 	defer func() {
-		unlockErr := releaseAdvisoryLock(ctx, m.conn)
+		unlockErr := m.releaseLock(ctx, m.conn)
 		if err == nil && unlockErr != nil {
 			err = unlockErr
 		}
 	}()
 
-	if ok, err := m.versionTableExists(ctx); err != nil || ok {
+	if m.options.HistoryTable != "" {
+		err = m.ensureHistoryTableExists(ctx)
+		if err != nil {
+			return err
+		}
+	}
+
+	if m.options.VersionStore == nil {
+		return versionTableStore(m.versionTable).ensureExists(ctx, m.versionConn(m.conn), m.options.InitialVersion)
+	}
+	return m.versionStore().EnsureExists(ctx, m.versionConn(m.conn))
+}
+
+func (m *Migrator) ensureHistoryTableExists(ctx context.Context) error {
+	// create table if not exists fails on a read-only connection even when the table exists.
+	var exists bool
+	err := m.conn.QueryRow(ctx, "select to_regclass($1) is not null", m.options.HistoryTable).Scan(&exists)
+	if err != nil || exists {
+		return err
+	}
+
+	_, err = m.conn.Exec(ctx, fmt.Sprintf(`create table %s(
+  id bigserial primary key,
+  sequence int4 not null,
+  name text not null,
+  direction text not null,
+  applied_by text not null,
+  session_user_name text not null,
+  applied_at timestamptz not null default now()
+)`, m.options.HistoryTable))
+	return err
+}
+
+// versionConn returns the connection the version table is on when migrating on conn.
+func (m *Migrator) versionConn(conn Conn) Conn {
+	if m.options.VersionConn != nil {
+		return m.options.VersionConn
+	}
+	return conn
+}
+
+// versionStore returns the VersionStore of m.
+func (m *Migrator) versionStore() VersionStore {
+	if m.options.VersionStore != nil {
+		return m.options.VersionStore
+	}
+	return versionTableStore(m.versionTable)
+}
+
+// versionTableStore is the default VersionStore. It keeps the version in the single row of the named table.
+type versionTableStore string
+
+func (table versionTableStore) EnsureExists(ctx context.Context, conn Conn) error {
+	return table.ensureExists(ctx, conn, 0)
+}
+
+// ensureExists creates the version table at initialVersion if it does not exist.
+func (table versionTableStore) ensureExists(ctx context.Context, conn Conn, initialVersion int32) error {
+	if ok, err := table.exists(ctx, conn); err != nil || ok {
 		return err
 	}
 
-	_, err = m.conn.Exec(ctx, fmt.Sprintf(`
-    create table if not exists %s(version int4 not null);
+	_, err := conn.Exec(ctx, fmt.Sprintf(`
+    create table if not exists %s(version int4 not null, in_progress text);
 
     insert into %s(version)
-    select 0
+    select %d
     where 0=(select count(*) from %s);
-  `, m.versionTable, m.versionTable, m.versionTable))
+  `, table, table, initialVersion, table))
 	return err
 }
 
-func (m *Migrator) versionTableExists(ctx context.Context) (ok bool, err error) {
+func (table versionTableStore) exists(ctx context.Context, conn Conn) (ok bool, err error) {
 	var count int
-	if i := strings.IndexByte(m.versionTable, '.'); i == -1 {
-		err = m.conn.QueryRow(ctx, "select count(*) from pg_catalog.pg_class where relname=$1 and relkind='r' and pg_table_is_visible(oid)", m.versionTable).Scan(&count)
+	if i := strings.IndexByte(string(table), '.'); i == -1 {
+		err = conn.QueryRow(ctx, "select count(*) from pg_catalog.pg_class where relname=$1 and relkind='r' and pg_table_is_visible(oid)", string(table)).Scan(&count)
 	} else {
-		schema, table := m.versionTable[:i], m.versionTable[i+1:]
-		err = m.conn.QueryRow(ctx, "select count(*) from pg_catalog.pg_tables where schemaname=$1 and tablename=$2", schema, table).Scan(&count)
+		schema, name := table[:i], table[i+1:]
+		err = conn.QueryRow(ctx, "select count(*) from pg_catalog.pg_tables where schemaname=$1 and tablename=$2", string(schema), string(name)).Scan(&count)
 	}
 	return count > 0, err
 }
 
+func (table versionTableStore) GetVersion(ctx context.Context, conn Conn) (v int32, err error) {
+	err = conn.QueryRow(ctx, "select version from "+string(table)).Scan(&v)
+	return v, err
+}
+
+func (table versionTableStore) SetVersion(ctx context.Context, conn Conn, version int32) error {
+	_, err := conn.Exec(ctx, "update "+string(table)+" set version=$1", version)
+	return err
+}
+
+// SetInProgress records name in the in_progress column. Version tables created by older versions of tern do not have
+// the column. It is added when a migration is first recorded which requires ownership of the version table.
+func (table versionTableStore) SetInProgress(ctx context.Context, conn Conn, name string) error {
+	var hasColumn bool
+	err := conn.QueryRow(ctx, "select to_jsonb(t) ? 'in_progress' from "+string(table)+" t").Scan(&hasColumn)
+	if err != nil {
+		return err
+	}
+
+	if name == "" {
+		// Nothing can have been recorded if the column does not exist.
+		if !hasColumn {
+			return nil
+		}
+		_, err = conn.Exec(ctx, "update "+string(table)+" set in_progress=null")
+		return err
+	}
+
+	if !hasColumn {
+		_, err = conn.Exec(ctx, "alter table "+string(table)+" add column if not exists in_progress text")
+		if err != nil {
+			return err
+		}
+	}
+	_, err = conn.Exec(ctx, "update "+string(table)+" set in_progress=$1", name)
+	return err
+}
+
+// GetInProgress reads the in_progress column through to_jsonb so it works whether or not the column exists.
+func (table versionTableStore) GetInProgress(ctx context.Context, conn Conn) (string, error) {
+	var name *string
+	err := conn.QueryRow(ctx, "select to_jsonb(t)->>'in_progress' from "+string(table)+" t").Scan(&name)
+	if err != nil || name == nil {
+		return "", err
+	}
+	return *name, nil
+}
+
 func setAt(strs []string, value string, pos int64) []string {
 	// If pos > length - 1, append empty strings to make it the right size
 	if pos > int64(len(strs))-1 {
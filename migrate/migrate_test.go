@@ -2,13 +2,20 @@ package migrate_test
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"testing/fstest"
+	"time"
 
 	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgconn"
+	"github.com/jackc/pgx/v5/pgxpool"
 	"github.com/jackc/tern/v2/migrate"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -104,6 +111,37 @@ func TestNewMigrator(t *testing.T) {
 	require.EqualValues(t, 0, initialVersion)
 }
 
+func TestNewMigratorInitialVersion(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{InitialVersion: 2})
+	require.NoError(t, err)
+	require.EqualValues(t, 2, currentVersion(t, conn))
+
+	// Only the first migrations are skipped.
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+	m.AppendMigration("Create t3", "create table t3(id serial);", "drop table t3;")
+	err = m.MigrateTo(context.Background(), 3)
+	require.NoError(t, err)
+	require.False(t, tableExists(t, conn, "t1"))
+	require.True(t, tableExists(t, conn, "t3"))
+
+	// Ignored when the version table already exists.
+	_, err = migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{InitialVersion: 1})
+	require.NoError(t, err)
+	require.EqualValues(t, 3, currentVersion(t, conn))
+}
+
+func TestNewMigratorInitialVersionErrors(t *testing.T) {
+	_, err := migrate.NewMigratorWithConn(context.Background(), &fakeConn{}, versionTable, &migrate.MigratorOptions{InitialVersion: -1})
+	require.EqualError(t, err, "initial version must not be negative: -1")
+
+	_, err = migrate.NewMigratorWithConn(context.Background(), &fakeConn{}, versionTable, &migrate.MigratorOptions{InitialVersion: 1, VersionStore: componentVersionStore{component: "app"}})
+	require.EqualError(t, err, "initial version cannot be used with a version store")
+}
+
 func TestAppendMigration(t *testing.T) {
 	conn := connectConn(t)
 	defer conn.Close(context.Background())
@@ -162,11 +200,195 @@ func TestFindMigrationsUnsorted(t *testing.T) {
 	assert.Equal(t, "10_empty.sql", migrations[9])
 }
 
+func TestFindMigrationsSeparators(t *testing.T) {
+	migrations, err := migrate.FindMigrations(os.DirFS("testdata/dot_separator"))
+	require.NoError(t, err)
+	// 004create_x.sql has no separator after the sequence number so it is ignored.
+	require.Equal(t, []string{"001.create_t1.sql", "002_create_t2.sql", "003.create.t3.sql"}, migrations)
+}
+
 func TestFindMigrationsWithDuplicate(t *testing.T) {
 	_, err := migrate.FindMigrations(os.DirFS("testdata/duplicate"))
 	require.EqualError(t, err, "Duplicate migration 2")
 }
 
+func TestFindMigrationsRecursive(t *testing.T) {
+	migrations, err := migrate.FindMigrationsRecursive(os.DirFS("testdata/recursive"), regexp.MustCompile(`\A(?P<version>\d+)[_.].+\.sql\z`))
+	require.NoError(t, err)
+	require.Equal(t, []string{"2023/001_create_t1.sql", "2023/002_create_t2.sql", "2024/003_create_t3.sql", "004_index_t3.sql"}, migrations)
+
+	// Without recursion only the top level is searched.
+	_, err = migrate.FindMigrations(os.DirFS("testdata/recursive"))
+	require.EqualError(t, err, "Missing migration 1")
+}
+
+func TestFindMigrationsRecursiveWithDuplicate(t *testing.T) {
+	_, err := migrate.FindMigrationsRecursive(os.DirFS("testdata/recursive_duplicate"), regexp.MustCompile(`\A(?P<version>\d+)[_.].+\.sql\z`))
+	require.EqualError(t, err, "Duplicate migration 2: 2023/002_create_t2.sql and 2024/002_create_t3.sql")
+}
+
+func TestLoadMigrationsRecursive(t *testing.T) {
+	m, err := migrate.NewMigratorEx(context.Background(), nil, versionTable, &migrate.MigratorOptions{RecursiveMigrations: true})
+	require.NoError(t, err)
+
+	err = m.LoadMigrations(os.DirFS("testdata/recursive"))
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 4)
+	assert.Equal(t, "001_create_t1.sql", m.Migrations[0].Name)
+	assert.Equal(t, "003_create_t3.sql", m.Migrations[2].Name)
+	assert.Equal(t, "create table t3(\n  id serial primary key\n);", m.Migrations[2].UpSQL)
+	assert.Equal(t, "004_index_t3.sql", m.Migrations[3].Name)
+	require.Len(t, m.RepeatableMigrations, 1)
+	assert.Equal(t, "views/R__t3_ids.sql", m.RepeatableMigrations[0].Name)
+	assert.Equal(t, "create or replace view t3_ids as select id from t3;", m.RepeatableMigrations[0].SQL)
+}
+
+func TestFindRepeatableMigrationsRecursive(t *testing.T) {
+	fsys := fstest.MapFS{
+		"001_create_t1.sql":            &fstest.MapFile{},
+		"R__t1_ids.sql":                &fstest.MapFile{},
+		"views/R__people.sql":          &fstest.MapFile{},
+		"functions/R__add.sql":         &fstest.MapFile{},
+		"snapshots/002/R__ignored.sql": &fstest.MapFile{},
+	}
+
+	repeatable, err := migrate.FindRepeatableMigrationsRecursive(fsys)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"R__t1_ids.sql", "functions/R__add.sql", "views/R__people.sql"}, repeatable)
+
+	// Without recursion only the top level is searched.
+	repeatable, err = migrate.FindRepeatableMigrations(fsys)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"R__t1_ids.sql"}, repeatable)
+}
+
+func TestStrayMigrationFiles(t *testing.T) {
+	fsys := fstest.MapFS{
+		"001_create_t1.sql":          &fstest.MapFile{},
+		"001_create_t1.sql.bak":      &fstest.MapFile{},
+		"002_create_t2.sql~":         &fstest.MapFile{},
+		".002_create_t2.sql.swp":     &fstest.MapFile{},
+		"003_create_t3.SQL":          &fstest.MapFile{},
+		"004_create_t4.sql.example":  &fstest.MapFile{},
+		"notes.txt":                  &fstest.MapFile{},
+		"shared/001_columns.sql.bak": &fstest.MapFile{},
+	}
+
+	m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+	stray, err := m.StrayMigrationFiles(fsys)
+	require.NoError(t, err)
+	assert.Equal(t, []string{".002_create_t2.sql.swp", "001_create_t1.sql.bak", "002_create_t2.sql~", "003_create_t3.SQL"}, stray)
+
+	// Subdirectories are searched for recursive migrations.
+	m, err = migrate.NewMigratorEx(context.Background(), nil, versionTable, &migrate.MigratorOptions{RecursiveMigrations: true})
+	require.NoError(t, err)
+	stray, err = m.StrayMigrationFiles(fsys)
+	require.NoError(t, err)
+	assert.Contains(t, stray, "shared/001_columns.sql.bak")
+}
+
+func TestFindMigrationsUpDown(t *testing.T) {
+	migrations, err := migrate.FindMigrations(os.DirFS("testdata/updown"))
+	require.NoError(t, err)
+	require.Equal(t, []string{"001_create_t1.up.sql", "002_create_t2.up.sql", "003_irreversible.up.sql"}, migrations)
+}
+
+func TestFindMigrationsUpDownMissingDown(t *testing.T) {
+	_, err := migrate.FindMigrations(os.DirFS("testdata/updown_missing_down"))
+	require.EqualError(t, err, "Missing down migration 001_create_t1.down.sql for 001_create_t1.up.sql (use an empty file for an irreversible migration)")
+}
+
+func TestFindMigrationsUpDownMissingUp(t *testing.T) {
+	_, err := migrate.FindMigrations(os.DirFS("testdata/updown_missing_up"))
+	require.EqualError(t, err, "Missing up migration for 002_create_t2.down.sql")
+}
+
+func TestFindMigrationsWithPattern(t *testing.T) {
+	pattern := regexp.MustCompile(`\AV(?P<version>\d+)__.+\.sql\z`)
+	migrations, err := migrate.FindMigrationsWithPattern(os.DirFS("testdata/flyway"), pattern)
+	require.NoError(t, err)
+	require.Equal(t, []string{"V1__create_t1.sql", "V2__create_t2.sql"}, migrations)
+
+	_, err = migrate.FindMigrationsWithPattern(os.DirFS("testdata/flyway"), regexp.MustCompile(`\AV(\d+)__.+\.sql\z`))
+	require.EqualError(t, err, `migration filename pattern "\\AV(\\d+)__.+\\.sql\\z" does not have a named capture group "version"`)
+}
+
+func TestLoadMigrationsDelims(t *testing.T) {
+	m, err := migrate.NewMigratorEx(context.Background(), nil, versionTable, &migrate.MigratorOptions{Delims: [2]string{"<<", ">>"}})
+	require.NoError(t, err)
+	m.Data = map[string]interface{}{"prefix": "app_"}
+
+	err = m.LoadMigrations(os.DirFS("testdata/delims"))
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 1)
+	assert.Equal(t, `create table app_settings(data jsonb not null default '{"template": "{{ name }}"}');`, m.Migrations[0].UpSQL)
+	assert.Equal(t, "drop table app_settings;", m.Migrations[0].DownSQL)
+}
+
+func TestLoadMigrationsGeneratedAt(t *testing.T) {
+	fsys := fstest.MapFS{
+		"001_seed_a.sql": &fstest.MapFile{Data: []byte(`insert into a(created_at) values ('{{ .GeneratedAt.Format "2006-01-02T15:04:05Z07:00" }}');`)},
+		"002_seed_b.sql": &fstest.MapFile{Data: []byte(`insert into b(created_at) values ('{{ .GeneratedAt.Format "2006-01-02T15:04:05Z07:00" }}');`)},
+	}
+
+	generatedAt := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+	m, err := migrate.NewMigratorEx(context.Background(), nil, versionTable, &migrate.MigratorOptions{GeneratedAt: generatedAt})
+	require.NoError(t, err)
+
+	err = m.LoadMigrations(fsys)
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 2)
+	assert.Equal(t, "insert into a(created_at) values ('2024-03-01T12:30:00Z');", m.Migrations[0].UpSQL)
+	assert.Equal(t, "insert into b(created_at) values ('2024-03-01T12:30:00Z');", m.Migrations[1].UpSQL)
+
+	// Without a pinned time every migration still sees the same time.
+	m, err = migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+
+	err = m.LoadMigrations(fsys)
+	require.NoError(t, err)
+	assert.Equal(t, strings.TrimPrefix(m.Migrations[0].UpSQL, "insert into a"), strings.TrimPrefix(m.Migrations[1].UpSQL, "insert into b"))
+}
+
+func TestLoadMigrationsMetadata(t *testing.T) {
+	fsys := fstest.MapFS{
+		"001_create_t1.sql": &fstest.MapFile{Data: []byte(`-- @author: jane
+-- Creates t1.
+--@ticket:JIRA-123
+
+-- @description: first table
+create table t1(id int);
+-- @author: not header
+`)},
+		"002_create_t2.sql": &fstest.MapFile{Data: []byte("create table t2(id int);\n")},
+	}
+
+	m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+
+	err = m.LoadMigrations(fsys)
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 2)
+	assert.Equal(t, map[string]string{"author": "jane", "ticket": "JIRA-123", "description": "first table"}, m.Migrations[0].Metadata)
+	assert.Nil(t, m.Migrations[1].Metadata)
+}
+
+func TestLoadMigrationsFilenamePattern(t *testing.T) {
+	m, err := migrate.NewMigratorEx(context.Background(), nil, versionTable, &migrate.MigratorOptions{
+		FilenamePattern: regexp.MustCompile(`\AV(?P<version>\d+)__.+\.sql\z`),
+	})
+	require.NoError(t, err)
+
+	err = m.LoadMigrations(os.DirFS("testdata/flyway"))
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 2)
+	assert.Equal(t, "V1__create_t1.sql", m.Migrations[0].Name)
+	assert.Equal(t, int32(1), m.Migrations[0].Sequence)
+	assert.Equal(t, "V2__create_t2.sql", m.Migrations[1].Name)
+	assert.Equal(t, int32(2), m.Migrations[1].Sequence)
+}
+
 func TestLoadMigrations(t *testing.T) {
 	conn := connectConn(t)
 	defer conn.Close(context.Background())
@@ -197,11 +419,196 @@ func TestLoadMigrations(t *testing.T) {
 	assert.Equal(t, "create table foo_bar(id serial primary key);", m.Migrations[3].UpSQL)
 	assert.Equal(t, "drop table foo_bar;", m.Migrations[3].DownSQL)
 
+	assert.Equal(t, "005_template_inclusion.sql", m.Migrations[4].Name)
+	assert.Equal(t, "create view foov1 as select * from t1;\n", m.Migrations[4].UpSQL)
+	assert.Equal(t, "drop view foov1;", m.Migrations[4].DownSQL)
+
 	assert.Equal(t, "006_sprig.sql", m.Migrations[5].Name)
 	assert.Equal(t, "create table baz_42(id serial primary key);", m.Migrations[5].UpSQL)
 	assert.Equal(t, "drop table baz_42;", m.Migrations[5].DownSQL)
 }
 
+func TestLoadMigrationsInclude(t *testing.T) {
+	m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+
+	m.Data = map[string]interface{}{"prefix": "foo"}
+	err = m.LoadMigrations(os.DirFS("testdata/include"))
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 1)
+
+	assert.Equal(t, "001_include.sql", m.Migrations[0].Name)
+	assert.Equal(t, "create table foo_included(id serial primary key);", m.Migrations[0].UpSQL)
+	assert.Equal(t, "drop table foo_included;", m.Migrations[0].DownSQL)
+}
+
+func TestLoadMigrationsUpDown(t *testing.T) {
+	m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+
+	m.Data = map[string]interface{}{"prefix": "foo"}
+	err = m.LoadMigrations(os.DirFS("testdata/updown"))
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 3)
+
+	assert.Equal(t, "001_create_t1.up.sql", m.Migrations[0].Name)
+	assert.Equal(t, `create table t1(
+  id serial primary key
+);`, m.Migrations[0].UpSQL)
+	assert.Equal(t, "drop table t1;", m.Migrations[0].DownSQL)
+
+	assert.Equal(t, "002_create_t2.up.sql", m.Migrations[1].Name)
+	assert.Equal(t, "create table foo_t2(id serial primary key);", m.Migrations[1].UpSQL)
+	assert.Equal(t, "drop table foo_t2;", m.Migrations[1].DownSQL)
+
+	assert.Equal(t, "003_irreversible.up.sql", m.Migrations[2].Name)
+	assert.Equal(t, "drop table t1;", m.Migrations[2].UpSQL)
+	assert.Equal(t, "", m.Migrations[2].DownSQL)
+}
+
+func TestLoadMigrationsSeparatorWhitespace(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		body string
+	}{
+		{"lf", "create table t1(id int);\n---- create above / drop below ----\ndrop table t1;\n"},
+		{"trailing spaces", "create table t1(id int);\n---- create above / drop below ----   \ndrop table t1;\n"},
+		{"trailing tab", "create table t1(id int);\n---- create above / drop below ----\t\ndrop table t1;\n"},
+		{"leading whitespace", "create table t1(id int);\n \t---- create above / drop below ----\ndrop table t1;\n"},
+		{"crlf", "create table t1(id int);\r\n---- create above / drop below ----\r\ndrop table t1;\r\n"},
+		{"crlf trailing spaces", "create table t1(id int);\r\n---- create above / drop below ---- \t\r\ndrop table t1;\r\n"},
+		{"blank lines", "\n\n\tcreate table t1(id int);\n\n---- create above / drop below ----\n\n\tdrop table t1;\n\n"},
+		{"byte order mark", "\ufeffcreate table t1(id int);\n---- create above / drop below ----\ndrop table t1;\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+			require.NoError(t, err)
+			err = m.LoadMigrations(fstest.MapFS{"001_create_t1.sql": &fstest.MapFile{Data: []byte(tt.body)}})
+			require.NoError(t, err)
+			require.Len(t, m.Migrations, 1)
+			assert.Equal(t, "create table t1(id int);", m.Migrations[0].UpSQL)
+			assert.Equal(t, "drop table t1;", m.Migrations[0].DownSQL)
+		})
+	}
+}
+
+func TestLoadMigrationsByteOrderMark(t *testing.T) {
+	m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+	err = m.LoadMigrations(fstest.MapFS{
+		"001_index_t1.up.sql":   &fstest.MapFile{Data: []byte("\ufeff---- tern: disable-tx ----\r\ncreate index concurrently t1_idx on t1(id);\r\n")},
+		"001_index_t1.down.sql": &fstest.MapFile{Data: []byte("\ufeffdrop index t1_idx;\r\n")},
+		"R__view.sql":           &fstest.MapFile{Data: []byte("\ufeffcreate or replace view v as select 1;\n")},
+	})
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 1)
+	assert.True(t, m.Migrations[0].DisableTx("up"))
+	assert.Equal(t, "drop index t1_idx;", m.Migrations[0].DownSQL)
+	require.Len(t, m.RepeatableMigrations, 1)
+	assert.Equal(t, "create or replace view v as select 1;", m.RepeatableMigrations[0].SQL)
+}
+
+func TestLoadMigrationsOnlyComments(t *testing.T) {
+	m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+	err = m.LoadMigrations(fstest.MapFS{"001_empty.sql": &fstest.MapFile{Data: []byte("\ufeff-- nothing yet\r\n\t\r\n---- create above / drop below ----  \r\ndrop table t1;\r\n")}})
+	require.ErrorIs(t, err, migrate.ErrNoFwMigration)
+}
+
+func TestIrreversibleMigrations(t *testing.T) {
+	m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+	m.Data = map[string]interface{}{"prefix": "foo"}
+	err = m.LoadMigrations(os.DirFS("testdata/updown"))
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 3)
+
+	assert.True(t, m.Migrations[0].Reversible())
+	assert.True(t, m.Migrations[1].Reversible())
+	assert.False(t, m.Migrations[2].Reversible())
+
+	irreversible := m.IrreversibleMigrations()
+	require.Len(t, irreversible, 1)
+	assert.Equal(t, "003_irreversible.up.sql", irreversible[0].Name)
+}
+
+func TestLoadMigrationsRepeatable(t *testing.T) {
+	m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+
+	m.Data = map[string]interface{}{"prefix": "foo_"}
+	err = m.LoadMigrations(os.DirFS("testdata/repeatable"))
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 1)
+	require.Len(t, m.RepeatableMigrations, 2)
+
+	assert.Equal(t, "R__functions.sql", m.RepeatableMigrations[0].Name)
+	assert.Equal(t, "R__t1_ids.sql", m.RepeatableMigrations[1].Name)
+	assert.Equal(t, "create or replace view foo_t1_ids as select id from t1;", m.RepeatableMigrations[1].SQL)
+}
+
+func TestLoadMigrationsRequireEnv(t *testing.T) {
+	m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+
+	t.Setenv("TERN_TEST_SCHEMA", "")
+	t.Setenv("TERN_TEST_OWNER", "")
+	err = m.LoadMigrations(os.DirFS("testdata/require_env"))
+	require.EqualError(t, err, "001_create_schema.sql: missing required environment variables: TERN_TEST_SCHEMA, TERN_TEST_OWNER")
+
+	t.Setenv("TERN_TEST_SCHEMA", "app")
+	err = m.LoadMigrations(os.DirFS("testdata/require_env"))
+	require.EqualError(t, err, "001_create_schema.sql: missing required environment variables: TERN_TEST_OWNER")
+
+	t.Setenv("TERN_TEST_OWNER", "app_owner")
+	err = m.LoadMigrations(os.DirFS("testdata/require_env"))
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 1)
+	assert.Equal(t, "---- tern: require-env TERN_TEST_SCHEMA TERN_TEST_OWNER ----\ncreate schema app authorization app_owner;", m.Migrations[0].UpSQL)
+	assert.Equal(t, "drop schema app;", m.Migrations[0].DownSQL)
+}
+
+func TestLoadMigrationsRequireData(t *testing.T) {
+	m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+
+	err = m.LoadMigrations(os.DirFS("testdata/require_data"))
+	require.EqualError(t, err, "001_create_orders.sql: missing required data: prefix, region")
+
+	m.Data["prefix"] = "app"
+	err = m.LoadMigrations(os.DirFS("testdata/require_data"))
+	require.EqualError(t, err, "001_create_orders.sql: missing required data: region")
+
+	// An empty value is present.
+	m.Data["region"] = ""
+	err = m.LoadMigrations(os.DirFS("testdata/require_data"))
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 1)
+	assert.Equal(t, "---- tern: require-data prefix, region ----\ncreate table app_orders(id int, region text default '');", m.Migrations[0].UpSQL)
+	assert.Equal(t, "drop table app_orders;", m.Migrations[0].DownSQL)
+}
+
+func TestValidate(t *testing.T) {
+	m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+
+	errs := m.Validate(os.DirFS("testdata/validate"))
+	require.Len(t, errs, 3)
+	assert.Contains(t, errs[0].Error(), "002_create_t2.sql: template: 002_create_t2.sql up:1:")
+	assert.Contains(t, errs[0].Error(), "executing")
+	assert.EqualError(t, errs[1], "003_create_f.sql: up: unterminated dollar-quoted string starting at line 1")
+	assert.EqualError(t, errs[2], "R__rv.sql: repeatable: unterminated quoted string starting at line 1")
+	for _, err := range errs {
+		var fileErr migrate.MigrationFileError
+		assert.ErrorAs(t, err, &fileErr)
+	}
+	assert.Empty(t, m.Migrations)
+
+	m.Data["region"] = "us"
+	errs = m.Validate(os.DirFS("testdata/validate"))
+	require.Len(t, errs, 2)
+}
+
 func TestLoadMigrationsNoForward(t *testing.T) {
 	conn := connectConn(t)
 	defer conn.Close(context.Background())
@@ -225,6 +632,46 @@ func TestMigrate(t *testing.T) {
 	assert.EqualValues(t, 3, currentVersion)
 }
 
+func TestPending(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createSampleMigrator(t, conn)
+
+	pendingCount, err := m.PendingCount(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 3, pendingCount)
+
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+
+	pendingCount, err = m.PendingCount(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 2, pendingCount)
+
+	pending, err := m.Pending(context.Background())
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.Equal(t, "Create t2", pending[0].Name)
+	assert.Equal(t, "Create t3", pending[1].Name)
+
+	err = m.Migrate(context.Background())
+	require.NoError(t, err)
+
+	pendingCount, err = m.PendingCount(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, pendingCount)
+
+	pending, err = m.Pending(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+
+	// Version beyond the known migrations is clamped
+	mustExec(t, conn, "update "+versionTable+" set version=4")
+	pendingCount, err = m.PendingCount(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 0, pendingCount)
+}
+
 func TestMigrateToLifeCycle(t *testing.T) {
 	conn := connectConn(t)
 	defer conn.Close(context.Background())
@@ -322,10 +769,39 @@ func TestMigrateToBoundaries(t *testing.T) {
 	err = m.MigrateTo(context.Background(), int32(1))
 	require.EqualError(t, err, "current version -1 is outside the valid versions of 0 to 3")
 
-	// When schema version says it is negative
-	mustExec(t, conn, "update "+versionTable+" set version=4")
+	// When schema version is greater than the number of migrations because applied migration files were deleted
+	mustExec(t, conn, "update "+versionTable+" set version=5")
 	err = m.MigrateTo(context.Background(), int32(1))
-	require.EqualError(t, err, "current version 4 is outside the valid versions of 0 to 3")
+	var missingErr migrate.MissingMigrationsError
+	require.ErrorAs(t, err, &missingErr)
+	assert.EqualValues(t, 5, missingErr.CurrentVersion)
+	assert.Equal(t, 3, missingErr.MigrationCount)
+	require.EqualError(t, err, "current version 5 is greater than the 3 migrations found: the files of applied migrations 4 to 5 appear to be missing (restore them or set the version with tern repair --set-version)")
+}
+
+func TestSetVersion(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createSampleMigrator(t, conn)
+
+	// Over range stored version
+	mustExec(t, conn, "update "+versionTable+" set version=4")
+	err := m.SetVersion(context.Background(), 3)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, currentVersion(t, conn))
+
+	// Under range stored version
+	mustExec(t, conn, "update "+versionTable+" set version=-1")
+	err = m.SetVersion(context.Background(), 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, currentVersion(t, conn))
+
+	// Out of range destination
+	err = m.SetVersion(context.Background(), -1)
+	require.EqualError(t, err, "version -1 is outside the valid versions of 0 to 3")
+	err = m.SetVersion(context.Background(), 4)
+	require.EqualError(t, err, "version 4 is outside the valid versions of 0 to 3")
+	assert.EqualValues(t, 0, currentVersion(t, conn))
 }
 
 func TestMigrateToIrreversible(t *testing.T) {
@@ -369,6 +845,42 @@ func TestMigrateToDisableTxInTx(t *testing.T) {
 	require.False(t, tableExists(t, conn, "t3"))
 }
 
+func TestMigrateToTx(t *testing.T) {
+	conn := connectConn(t)
+	ctx := context.Background()
+	defer conn.Close(ctx)
+
+	m, err := migrate.NewMigratorEx(ctx, conn, versionTable, &migrate.MigratorOptions{})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+
+	tx, err := conn.Begin(ctx)
+	require.NoError(t, err)
+
+	err = m.MigrateToTx(ctx, tx, 2)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, currentVersion(t, conn))
+	require.True(t, tableExists(t, conn, "t1"))
+	require.True(t, tableExists(t, conn, "t2"))
+
+	err = tx.Rollback(ctx)
+	require.NoError(t, err)
+	require.EqualValues(t, 0, currentVersion(t, conn))
+	require.False(t, tableExists(t, conn, "t1"))
+	require.False(t, tableExists(t, conn, "t2"))
+
+	// A migration that is not transactional is refused before anything is run.
+	m.AppendMigration("Create index", "---- tern: disable-tx ----\ncreate index concurrently on t1(id);", "drop index t1_id_idx;")
+	tx, err = conn.Begin(ctx)
+	require.NoError(t, err)
+	defer tx.Rollback(ctx)
+
+	err = m.MigrateToTx(ctx, tx, 3)
+	require.EqualError(t, err, "Create index: migration cannot be run in the transaction given to MigrateToTx because it is not transactional")
+	require.False(t, tableExists(t, conn, "t1"))
+}
+
 func TestMigrateToDisableTx(t *testing.T) {
 	conn := connectConn(t)
 	defer conn.Close(context.Background())
@@ -416,30 +928,1646 @@ syntax error;`,
 	require.True(t, tableExists(t, conn, "t1"))
 }
 
-// // https://github.com/jackc/tern/issues/18
-func TestNotCreatingVersionTableIfAlreadyVisibleInSearchPath(t *testing.T) {
+func TestMigrateToDisableTxVacuum(t *testing.T) {
 	conn := connectConn(t)
 	defer conn.Close(context.Background())
-	m := createSampleMigrator(t, conn)
 
-	err := m.Migrate(context.Background())
-	assert.NoError(t, err)
-	currentVersion := currentVersion(t, conn)
-	require.EqualValues(t, 3, currentVersion)
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id int); insert into t1 select generate_series(1, 10);", "drop table t1;")
+	m.AppendMigration("Vacuum t1", "---- tern: disable-tx ----\ndelete from t1 where id > 5;\nvacuum (analyze) t1;\n", "")
 
-	var currentUser string
-	err = conn.QueryRow(context.Background(), "select current_user").Scan(&currentUser)
-	assert.NoError(t, err)
-	_, err = conn.Exec(context.Background(), fmt.Sprintf("create schema %s", currentUser))
-	assert.NoError(t, err)
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	require.EqualValues(t, 2, currentVersion(t, conn))
 
-	m = createSampleMigrator(t, conn)
-	mCurrentVersion, err := m.GetCurrentVersion(context.Background())
-	assert.NoError(t, err)
-	require.EqualValues(t, 3, mCurrentVersion)
+	// vacuum cannot run in a transaction.
+	m.AppendMigration("Vacuum t1 again", "vacuum t1;", "")
+	err = m.MigrateTo(context.Background(), 3)
+	require.ErrorContains(t, err, "VACUUM cannot run inside a transaction block")
+	require.EqualValues(t, 2, currentVersion(t, conn))
+}
+
+func TestMigrateToDisableTxVacuumWithFakeConn(t *testing.T) {
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{})
+	require.NoError(t, err)
+	m.AppendMigration("Vacuum t1", "---- tern: disable-tx ----\ndelete from t1 where id > 5;\n-- reclaim the space\nvacuum (analyze) t1;\n", "")
+
+	conn.log = nil
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+
+	// Each statement is run on its own outside of a transaction.
+	assert.NotContains(t, conn.log, "begin")
+	assert.Contains(t, conn.log, "delete from t1 where id > 5;")
+	assert.Contains(t, conn.log, "-- reclaim the space\nvacuum (analyze) t1;")
+}
+
+func TestMigrationDisableTxPerDirection(t *testing.T) {
+	fsys := fstest.MapFS{
+		"001_create_t1.sql": &fstest.MapFile{Data: []byte("create table t1(id int);\ncreate index t1_id_idx on t1(id);\n---- create above / drop below ----\n---- tern: disable-tx ----\ndrop index concurrently t1_id_idx;\ndrop table t1;\n")},
+		"002_index_t1.sql":  &fstest.MapFile{Data: []byte("---- tern: disable-tx ----\ncreate index concurrently t1_id2_idx on t1(id);\n---- create above / drop below ----\ndrop index t1_id2_idx;\n")},
+	}
+
+	m, err := migrate.NewMigrator(context.Background(), nil, versionTable)
+	require.NoError(t, err)
+	err = m.LoadMigrations(fsys)
+	require.NoError(t, err)
+	require.Len(t, m.Migrations, 2)
+
+	assert.False(t, m.Migrations[0].DisableTx("up"))
+	assert.True(t, m.Migrations[0].DisableTx("down"))
+	assert.True(t, m.Migrations[1].DisableTx("up"))
+	assert.False(t, m.Migrations[1].DisableTx("down"))
+}
+
+func TestMigrateToDisableTxPerDirection(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigrator(context.Background(), conn, versionTable)
+	require.NoError(t, err)
+	// Up runs in a transaction but down must not as drop index concurrently cannot run in a transaction.
+	m.AppendMigration("Create t1", "create table t1(id int);\ncreate index t1_id_idx on t1(id);", "---- tern: disable-tx ----\ndrop index concurrently t1_id_idx;\ndrop table t1;")
+	// Up must not run in a transaction but down does.
+	m.AppendMigration("Index t1", "---- tern: disable-tx ----\ncreate index concurrently t1_id2_idx on t1(id);", "drop index t1_id2_idx;\ncreate table t2(id int);\nsyntax error;")
+
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, currentVersion(t, conn))
+
+	// The down of the second migration runs in a transaction so the table it creates is rolled back.
+	err = m.MigrateTo(context.Background(), 1)
+	require.Error(t, err)
+	assert.EqualValues(t, 2, currentVersion(t, conn))
+	assert.False(t, tableExists(t, conn, "t2"))
+
+	m.Migrations[1].DownSQL = "drop index t1_id2_idx;"
+	err = m.MigrateTo(context.Background(), 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, currentVersion(t, conn))
+	assert.False(t, tableExists(t, conn, "t1"))
+}
+
+func TestMigrateToContinueOnError(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{ContinueOnError: true})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Bad syntax", "create table t2(id serial); syntax error;", "drop table t2;")
+	m.AppendMigration("Create t3", "create table t3(id serial);", "drop table t3;")
+	m.AppendMigration("Missing table", "select * from missing_table;", "")
+
+	err = m.MigrateTo(context.Background(), 4)
+	require.Error(t, err)
+
+	joinedErr, ok := err.(interface{ Unwrap() []error })
+	require.True(t, ok)
+	errs := joinedErr.Unwrap()
+	require.Len(t, errs, 2)
+
+	var mgErr migrate.MigrationPgError
+	require.ErrorAs(t, errs[0], &mgErr)
+	assert.Equal(t, "Bad syntax", mgErr.MigrationName)
+	require.ErrorAs(t, errs[1], &mgErr)
+	assert.Equal(t, "Missing table", mgErr.MigrationName)
+
+	// Version only reflects the migrations before the first failure
+	assert.EqualValues(t, 1, currentVersion(t, conn))
+	assert.True(t, tableExists(t, conn, "t1"))
+	assert.False(t, tableExists(t, conn, "t2"))
+	assert.True(t, tableExists(t, conn, "t3"))
+}
+
+func TestMigrateToSQLTransform(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create t2", `---- tern: disable-tx ----
+create table t2(id serial);
+create index on t2(id);`, "drop table t2;")
+
+	// Quoting the uppercased table names makes them case sensitive so it is possible to see the transform was applied.
+	upperIdentifiers := regexp.MustCompile(`\bt\d\b`)
+	var transformCalls []string
+	m.SQLTransform = func(direction, name, sql string) (string, error) {
+		transformCalls = append(transformCalls, direction+" "+name)
+		return upperIdentifiers.ReplaceAllStringFunc(sql, func(s string) string { return `"` + strings.ToUpper(s) + `"` }), nil
+	}
+
+	var onStartSQL []string
+	m.OnStart = func(_ int32, _, _, sql string) {
+		onStartSQL = append(onStartSQL, sql)
+	}
+
+	err := m.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"up Create t1", "up Create t2"}, transformCalls)
+	assert.Equal(t, `create table "T1"(id serial);`, onStartSQL[0])
+	assert.True(t, tableExists(t, conn, "T1"))
+	assert.True(t, tableExists(t, conn, "T2"))
+	assert.False(t, tableExists(t, conn, "t1"))
+
+	err = m.MigrateTo(context.Background(), 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"up Create t1", "up Create t2", "down Create t2", "down Create t1"}, transformCalls)
+	assert.False(t, tableExists(t, conn, "T1"))
+	assert.False(t, tableExists(t, conn, "T2"))
+
+	m.SQLTransform = func(direction, name, sql string) (string, error) {
+		return "", errors.New("transform failed")
+	}
+	err = m.Migrate(context.Background())
+	require.EqualError(t, err, "transform failed")
+	assert.EqualValues(t, 0, currentVersion(t, conn))
+}
+
+func TestMigrateToDisableTxInMigrationSpellings(t *testing.T) {
+	for _, magicComment := range []string{"---- tern: disable-tx ----", "---- disable-tx ----"} {
+		t.Run(magicComment, func(t *testing.T) {
+			conn := connectConn(t)
+			defer conn.Close(context.Background())
+
+			m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{})
+			assert.NoError(t, err)
+			m.AppendMigration(
+				"Create t1",
+				magicComment+`
+create table t1(id serial);
+syntax error;`,
+				``)
+
+			var onStartSQL string
+			m.OnStart = func(_ int32, _, _, sql string) {
+				onStartSQL = sql
+			}
+
+			err = m.MigrateTo(context.Background(), 1)
+			assert.Error(t, err)
+			require.EqualValues(t, 0, currentVersion(t, conn))
+			// The first statement was not rolled back so the migration was not run in a transaction.
+			require.True(t, tableExists(t, conn, "t1"))
+			require.NotContains(t, onStartSQL, "disable-tx")
+		})
+	}
+}
+
+func TestMigrateToDisableTxInMigrationWithCRLF(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{})
+	assert.NoError(t, err)
+	m.AppendMigration(
+		"Create t1",
+		"---- tern: disable-tx ----\r\ncreate table t1(id serial);\r\nsyntax error;\r\n",
+		``)
+
+	err = m.MigrateTo(context.Background(), 1)
+	assert.Error(t, err)
+	require.EqualValues(t, 0, currentVersion(t, conn))
+	require.True(t, tableExists(t, conn, "t1"))
+}
+
+// // https://github.com/jackc/tern/issues/18
+func TestNotCreatingVersionTableIfAlreadyVisibleInSearchPath(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createSampleMigrator(t, conn)
+
+	err := m.Migrate(context.Background())
+	assert.NoError(t, err)
+	currentVersion := currentVersion(t, conn)
+	require.EqualValues(t, 3, currentVersion)
+
+	var currentUser string
+	err = conn.QueryRow(context.Background(), "select current_user").Scan(&currentUser)
+	assert.NoError(t, err)
+	_, err = conn.Exec(context.Background(), fmt.Sprintf("create schema %s", currentUser))
+	assert.NoError(t, err)
+
+	m = createSampleMigrator(t, conn)
+	mCurrentVersion, err := m.GetCurrentVersion(context.Background())
+	assert.NoError(t, err)
+	require.EqualValues(t, 3, mCurrentVersion)
+}
+
+func TestMigrateRepeatable(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendRepeatableMigration("R__t1_ids.sql", "create or replace view t1_ids as select id from t1;")
+
+	var started []string
+	m.OnStart = func(_ int32, name, direction, _ string) {
+		started = append(started, direction+" "+name)
+	}
+
+	pending, err := m.PendingRepeatable(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, m.RepeatableMigrations, pending)
+
+	err = m.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"up Create t1", "repeatable R__t1_ids.sql"}, started)
+
+	pending, err = m.PendingRepeatable(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, pending)
+	assert.True(t, tableExists(t, conn, "t1_ids"))
+
+	var checksum string
+	err = conn.QueryRow(context.Background(), "select checksum from "+versionTable+"_repeatable where name='R__t1_ids.sql'").Scan(&checksum)
+	require.NoError(t, err)
+	assert.Equal(t, m.RepeatableMigrations[0].Checksum(), checksum)
+
+	// Unchanged repeatable migrations are skipped
+	started = nil
+	err = m.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, started)
+
+	// Changed repeatable migrations are run again
+	m.RepeatableMigrations[0].SQL = "create or replace view t1_ids as select id, id * 2 as double_id from t1;"
+	pending, err = m.PendingRepeatable(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, m.RepeatableMigrations, pending)
+	err = m.Migrate(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, []string{"repeatable R__t1_ids.sql"}, started)
+
+	var columnCount int
+	err = conn.QueryRow(context.Background(), "select count(*) from information_schema.columns where table_name='t1_ids'").Scan(&columnCount)
+	require.NoError(t, err)
+	assert.Equal(t, 2, columnCount)
+
+	err = conn.QueryRow(context.Background(), "select checksum from "+versionTable+"_repeatable where name='R__t1_ids.sql'").Scan(&checksum)
+	require.NoError(t, err)
+	assert.Equal(t, m.RepeatableMigrations[0].Checksum(), checksum)
+}
+
+func TestMigrateRepeatableFailure(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendRepeatableMigration("R__broken.sql", "create or replace view broken as select missing from t1;")
+
+	err := m.Migrate(context.Background())
+	var mgErr migrate.MigrationPgError
+	require.ErrorAs(t, err, &mgErr)
+	assert.Equal(t, "R__broken.sql", mgErr.MigrationName)
+	assert.EqualValues(t, 1, currentVersion(t, conn))
+
+	var count int
+	err = conn.QueryRow(context.Background(), "select count(*) from "+versionTable+"_repeatable").Scan(&count)
+	require.NoError(t, err)
+	assert.Equal(t, 0, count)
+}
+
+func TestMigrateToOnFinish(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createSampleMigrator(t, conn)
+	m.AppendMigration("Fail", "select 1/0;", "")
+
+	var finished []string
+	m.OnFinish = func(sequence int32, name, direction string, duration time.Duration) {
+		finished = append(finished, fmt.Sprintf("%d %s %s", sequence, name, direction))
+		assert.Greater(t, duration, time.Duration(0))
+	}
+
+	err := m.MigrateTo(context.Background(), 4)
+	require.Error(t, err)
+	assert.Equal(t, []string{"1 Create t1 up", "2 Create t2 up", "3 Create t3 up"}, finished)
+
+	finished = nil
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"3 Create t3 down"}, finished)
+}
+
+func TestMigrateToHistory(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{HistoryTable: "migration_history"})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+	m.AppendMigration("Fail", "select 1/0;", "")
+
+	err = m.MigrateTo(context.Background(), 3)
+	require.Error(t, err)
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+
+	var currentUser, sessionUser string
+	err = conn.QueryRow(context.Background(), "select current_user, session_user").Scan(&currentUser, &sessionUser)
+	require.NoError(t, err)
+
+	history, err := m.History(context.Background(), time.Time{}, 0)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+	assert.EqualValues(t, 2, history[0].Sequence)
+	assert.Equal(t, "Create t2", history[0].Name)
+	assert.Equal(t, "down", history[0].Direction)
+	assert.Equal(t, currentUser, history[0].AppliedBy)
+	assert.Equal(t, sessionUser, history[0].SessionUser)
+	assert.Equal(t, "Create t2", history[1].Name)
+	assert.Equal(t, "up", history[1].Direction)
+	assert.Equal(t, "Create t1", history[2].Name)
+
+	history, err = m.History(context.Background(), time.Time{}, 1)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+
+	history, err = m.History(context.Background(), time.Now().Add(time.Hour), 0)
+	require.NoError(t, err)
+	require.Len(t, history, 0)
+}
+
+func TestMigrationRunsInEnvironment(t *testing.T) {
+	m := &migrate.Migration{UpSQL: "---- tern: environments dev, staging ----\ninsert into t1 values (1);", DownSQL: "delete from t1;"}
+	assert.Equal(t, []string{"dev", "staging"}, m.Environments())
+	assert.True(t, m.RunsInEnvironment("dev"))
+	assert.True(t, m.RunsInEnvironment("staging"))
+	assert.False(t, m.RunsInEnvironment("production"))
+	assert.False(t, m.RunsInEnvironment(""))
+
+	m = &migrate.Migration{UpSQL: "create table t1(id int);", DownSQL: "drop table t1;"}
+	assert.Nil(t, m.Environments())
+	assert.True(t, m.RunsInEnvironment("production"))
+	assert.True(t, m.RunsInEnvironment(""))
+}
+
+func TestMigrationRunsWithTags(t *testing.T) {
+	m := &migrate.Migration{UpSQL: "---- tern: tags experimental, billing ----\ninsert into t1 values (1);", DownSQL: "delete from t1;"}
+	assert.Equal(t, []string{"experimental", "billing"}, m.Tags())
+	assert.True(t, m.RunsWithTags(nil, nil))
+	assert.True(t, m.RunsWithTags([]string{"billing"}, nil))
+	assert.False(t, m.RunsWithTags([]string{"search"}, nil))
+	assert.False(t, m.RunsWithTags(nil, []string{"experimental"}))
+	assert.False(t, m.RunsWithTags([]string{"billing"}, []string{"experimental"}))
+
+	m = &migrate.Migration{UpSQL: "---- tern: tags experimental ----\ninsert into t1 values (1);"}
+	assert.Equal(t, []string{"experimental"}, m.Tags())
+
+	m = &migrate.Migration{UpSQL: "create table t1(id int);", DownSQL: "drop table t1;"}
+	assert.Nil(t, m.Tags())
+	assert.True(t, m.RunsWithTags([]string{"billing"}, nil))
+	assert.True(t, m.RunsWithTags(nil, []string{"billing"}))
+}
+
+func TestMigrationBatchSize(t *testing.T) {
+	m := &migrate.Migration{UpSQL: "---- tern: batch 1000 ----\nupdate t1 set b = a where id in (select id from t1 where b is null limit $1);", DownSQL: "update t1 set b = null;"}
+	assert.Equal(t, 1000, m.BatchSize("up"))
+	assert.Equal(t, 0, m.BatchSize("down"))
+}
+
+func TestMigrateToBatch(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	newMigrator := func() *migrate.Migrator {
+		m, err := migrate.NewMigrator(context.Background(), conn, versionTable)
+		require.NoError(t, err)
+		m.AppendMigration("Seed t1", "create table t1(id int primary key, a int, b int); insert into t1(id, a) select n, n * 2 from generate_series(1, 25) n;", "drop table t1;")
+		m.AppendMigration("Backfill t1", "---- tern: batch 10 ----\nupdate t1 set b = a where id in (select id from t1 where b is null order by id limit $1);", "")
+		return m
+	}
+
+	countBackfilled := func() int {
+		var n int
+		err := conn.QueryRow(context.Background(), "select count(*) from t1 where b = a").Scan(&n)
+		require.NoError(t, err)
+		return n
+	}
+
+	// Interrupt the migration after the first batch has been committed.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	m := newMigrator()
+	m.OnBatch = func(sequence int32, name string, batch int, rowsAffected int64) {
+		cancel()
+	}
+	err := m.MigrateTo(ctx, 2)
+	require.Error(t, err)
+	assert.EqualValues(t, 1, currentVersion(t, conn))
+	assert.Equal(t, 10, countBackfilled())
+
+	// Running it again resumes where it left off.
+	var batches []int64
+	m = newMigrator()
+	m.OnBatch = func(sequence int32, name string, batch int, rowsAffected int64) {
+		batches = append(batches, rowsAffected)
+	}
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, currentVersion(t, conn))
+	assert.Equal(t, 25, countBackfilled())
+	assert.Equal(t, []int64{10, 5}, batches)
+}
+
+func TestMigrateToBatchRequiresOneStatement(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigrator(context.Background(), conn, versionTable)
+	require.NoError(t, err)
+	m.AppendMigration("Backfill", "---- tern: batch 10 ----\nselect 1; select 2;", "")
+
+	err = m.MigrateTo(context.Background(), 1)
+	require.EqualError(t, err, "Backfill: batch migration must contain exactly one statement but has 2")
+}
+
+func TestMigrateToEnvironments(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	newMigrator := func(opts *migrate.MigratorOptions) *migrate.Migrator {
+		m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, opts)
+		require.NoError(t, err)
+		m.AppendMigration("Create t1", "create table t1(id int);", "drop table t1;")
+		m.AppendMigration("Seed t1", "---- tern: environments dev,staging ----\ninsert into t1 values (1);", "delete from t1;")
+		m.AppendMigration("Create t2", "create table t2(id int);", "drop table t2;")
+		return m
+	}
+
+	countT1 := func() int {
+		var n int
+		err := conn.QueryRow(context.Background(), "select count(*) from t1").Scan(&n)
+		require.NoError(t, err)
+		return n
+	}
+
+	// Excluded: the seed is skipped but the version still advances past it.
+	m := newMigrator(&migrate.MigratorOptions{Environment: "production"})
+	var skipped []string
+	m.OnSkip = func(sequence int32, name, direction string) {
+		skipped = append(skipped, fmt.Sprintf("%s %s", name, direction))
+	}
+	err := m.MigrateTo(context.Background(), 3)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, currentVersion(t, conn))
+	assert.Equal(t, 0, countT1())
+	assert.True(t, tableExists(t, conn, "t2"))
+
+	err = m.MigrateTo(context.Background(), 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, currentVersion(t, conn))
+	assert.Equal(t, []string{"Seed t1 up", "Seed t1 down"}, skipped)
+
+	// Included: the seed is run.
+	m = newMigrator(&migrate.MigratorOptions{Environment: "dev"})
+	err = m.MigrateTo(context.Background(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, 1, countT1())
+
+	err = m.MigrateTo(context.Background(), 0)
+	require.NoError(t, err)
+
+	// Excluded with FailOnExcludedEnvironment: migration stops before the seed.
+	m = newMigrator(&migrate.MigratorOptions{Environment: "production", FailOnExcludedEnvironment: true})
+	err = m.MigrateTo(context.Background(), 3)
+	var envErr migrate.ExcludedEnvironmentError
+	require.ErrorAs(t, err, &envErr)
+	assert.Equal(t, "Seed t1", envErr.MigrationName)
+	assert.EqualValues(t, 1, currentVersion(t, conn))
+}
+
+func TestMigrateToAssumedCurrentVersion(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	// t1 already exists but the version table says nothing has been migrated.
+	mustExec(t, conn, "create table t1(id int)")
+
+	assumed := int32(1)
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{AssumedCurrentVersion: &assumed})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id int);", "drop table t1;")
+	m.AppendMigration("Create t2", "create table t2(id int);", "drop table t2;")
+
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, currentVersion(t, conn))
+	assert.True(t, tableExists(t, conn, "t2"))
+
+	// The assumed version is only used once.
+	err = m.MigrateTo(context.Background(), 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, currentVersion(t, conn))
+	assert.False(t, tableExists(t, conn, "t1"))
+}
+
+func TestMigrateToPreMigrateCheck(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigrator(context.Background(), conn, versionTable)
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id int);", "drop table t1;")
+	m.AppendMigration("Create t2", "create table t2(id int);", "drop table t2;")
+	m.AppendMigration("Create t3", "create table t3(id int);", "drop table t3;")
+
+	var checks int
+	m.PreMigrateCheck = func(ctx context.Context, conn migrate.Conn) error {
+		checks++
+		return m.CheckCurrentMigration(ctx, conn)
+	}
+
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, checks)
+
+	// Nothing to migrate so the check is not run.
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, 1, checks)
+
+	// t2 was dropped outside of migrations so migration 2 cannot be migrated down.
+	mustExec(t, conn, "drop table t2")
+	err = m.MigrateTo(context.Background(), 3)
+	var driftErr migrate.StateDriftError
+	require.ErrorAs(t, err, &driftErr)
+	assert.EqualValues(t, 2, driftErr.CurrentVersion)
+	assert.Equal(t, "Create t2", driftErr.MigrationName)
+	assert.EqualValues(t, 2, currentVersion(t, conn))
+	assert.False(t, tableExists(t, conn, "t3"))
+
+	// The check runs in a transaction that is rolled back.
+	mustExec(t, conn, "create table t2(id int)")
+	err = m.MigrateTo(context.Background(), 3)
+	require.NoError(t, err)
+	assert.True(t, tableExists(t, conn, "t2"))
+	assert.True(t, tableExists(t, conn, "t3"))
+}
+
+func TestIncompleteMigrationWithVersionTable(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigrator(context.Background(), conn, versionTable)
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id int);", "drop table t1;")
+	m.AppendMigration("Index t1", "---- tern: disable-tx ----\ncreate index concurrently t1_a on t1(id);\nselect 1/0;", "")
+
+	name, err := m.IncompleteMigration(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, name)
+
+	// The migration fails after the index was created.
+	err = m.MigrateTo(context.Background(), 2)
+	require.Error(t, err)
+	assert.EqualValues(t, 1, currentVersion(t, conn))
+
+	name, err = m.IncompleteMigration(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Index t1", name)
+
+	// Setting the version repairs it.
+	err = m.SetVersion(context.Background(), 2)
+	require.NoError(t, err)
+	name, err = m.IncompleteMigration(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, name)
+}
+
+func TestIncompleteMigrationFirstStatementError(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigrator(context.Background(), conn, versionTable)
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id int);", "drop table t1;")
+	m.AppendMigration("Index t1", "---- tern: disable-tx ----\ncreate index concurrently t1_a on missing_table(id);", "")
+
+	err = m.MigrateTo(context.Background(), 2)
+	var mgErr migrate.MigrationPgError
+	require.ErrorAs(t, err, &mgErr)
+	assert.EqualValues(t, 1, currentVersion(t, conn))
+
+	name, err := m.IncompleteMigration(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, name)
+}
+
+func TestMigrateToMigrationTimeoutRollsBack(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{MigrationTimeout: 500 * time.Millisecond})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id int);", "drop table t1;")
+	m.AppendMigration("Create t2 slowly", "create table t2(id int); select pg_sleep(60);", "drop table t2;")
+
+	err = m.MigrateTo(context.Background(), 2)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.ErrorContains(t, err, "Create t2 slowly: migration did not finish within 500ms")
+
+	// The connection was closed by the timeout. connectConn cannot be used as it recreates the database.
+	checkConn, err := pgx.Connect(context.Background(), os.Getenv("MIGRATE_TEST_CONN_STRING"))
+	require.NoError(t, err)
+	defer checkConn.Close(context.Background())
+	assert.EqualValues(t, 1, currentVersion(t, checkConn))
+	assert.True(t, tableExists(t, checkConn, "t1"))
+	assert.False(t, tableExists(t, checkConn, "t2"))
+}
+
+func TestMigrateToMigrationTimeoutRestoresApplicationName(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{MigrationTimeout: 100 * time.Millisecond, AnnotateApplicationName: true})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id int);", "drop table t1;")
+
+	// The timeout expires before the SQL is sent so the connection is not closed.
+	m.OnStart = func(sequence int32, name, direction, sql string) {
+		time.Sleep(200 * time.Millisecond)
+	}
+
+	var original string
+	err = conn.QueryRow(context.Background(), "select current_setting('application_name')").Scan(&original)
+	require.NoError(t, err)
+
+	err = m.MigrateTo(context.Background(), 1)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+
+	var applicationName string
+	err = conn.QueryRow(context.Background(), "select current_setting('application_name')").Scan(&applicationName)
+	require.NoError(t, err)
+	assert.Equal(t, original, applicationName)
+}
+
+func TestMigrateToTags(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	newMigrator := func(opts *migrate.MigratorOptions) *migrate.Migrator {
+		m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, opts)
+		require.NoError(t, err)
+		m.AppendMigration("Create t1", "create table t1(id int);", "drop table t1;")
+		m.AppendMigration("Experimental", "---- tern: tags experimental ----\ninsert into t1 values (1);", "delete from t1 where id = 1;")
+		m.AppendMigration("Billing", "---- tern: tags billing ----\ninsert into t1 values (2);", "delete from t1 where id = 2;")
+		return m
+	}
+
+	ids := func() []int32 {
+		rows, _ := conn.Query(context.Background(), "select id from t1 order by id")
+		ids, err := pgx.CollectRows(rows, pgx.RowTo[int32])
+		require.NoError(t, err)
+		return ids
+	}
+
+	// Excluded: the experimental migration is skipped but the version still advances past it.
+	m := newMigrator(&migrate.MigratorOptions{ExcludeTags: []string{"experimental"}})
+	var skipped []string
+	m.OnSkip = func(sequence int32, name, direction string) {
+		skipped = append(skipped, fmt.Sprintf("%s %s", name, direction))
+	}
+	err := m.MigrateTo(context.Background(), 3)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, currentVersion(t, conn))
+	assert.Equal(t, []int32{2}, ids())
+
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Experimental up", "Experimental down"}, skipped)
+	assert.Empty(t, ids())
+
+	// Included: only migrations with a selected tag are run.
+	m = newMigrator(&migrate.MigratorOptions{IncludeTags: []string{"experimental"}})
+	err = m.MigrateTo(context.Background(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, []int32{1}, ids())
+
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+
+	// No tags selected: every migration is run.
+	m = newMigrator(&migrate.MigratorOptions{})
+	err = m.MigrateTo(context.Background(), 3)
+	require.NoError(t, err)
+	assert.Equal(t, []int32{1, 2}, ids())
+}
+
+func TestMigrateToVersionConn(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	versionConn, err := pgx.Connect(context.Background(), os.Getenv("MIGRATE_TEST_CONN_STRING"))
+	require.NoError(t, err)
+	defer versionConn.Close(context.Background())
+
+	// The version table is only visible through the search_path of versionConn.
+	mustExec(t, versionConn, "create schema catalog")
+	mustExec(t, versionConn, "set search_path = catalog")
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, "shard_version", &migrate.MigratorOptions{VersionConn: versionConn})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+
+	var versionTableSchema string
+	err = conn.QueryRow(context.Background(), "select table_schema from information_schema.tables where table_name='shard_version'").Scan(&versionTableSchema)
+	require.NoError(t, err)
+	assert.Equal(t, "catalog", versionTableSchema)
+
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	assert.True(t, tableExists(t, conn, "t1"))
+	assert.True(t, tableExists(t, conn, "t2"))
+
+	var version int32
+	err = versionConn.QueryRow(context.Background(), "select version from shard_version").Scan(&version)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, version)
+
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+	assert.False(t, tableExists(t, conn, "t2"))
+
+	version, err = m.GetCurrentVersion(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, version)
+}
+
+func TestMigrateToRetry(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	// Sequences are not transactional so the attempt count survives the rollback of the failed attempts.
+	mustExec(t, conn, "create sequence attempts")
+	failTwiceSQL := `do $$
+begin
+  if nextval('attempts') <= 2 then
+    raise exception 'injected serialization failure' using errcode = '40001';
+  end if;
+end $$;
+create table t1(id serial);`
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{MaxRetries: 2, RetryBackoff: time.Millisecond})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", failTwiceSQL, "drop table t1;")
+
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+	assert.True(t, tableExists(t, conn, "t1"))
+	assert.EqualValues(t, 1, currentVersion(t, conn))
+
+	// Not retried when the retries are exhausted.
+	mustExec(t, conn, "select setval('attempts', 1, false)")
+	m, err = migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{MaxRetries: 1, RetryBackoff: time.Millisecond})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "select 1;", "drop table t1;")
+	m.AppendMigration("Create t2", strings.Replace(failTwiceSQL, "t1", "t2", 1), "drop table t2;")
+
+	err = m.MigrateTo(context.Background(), 2)
+	var pgErr *pgconn.PgError
+	require.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "40001", pgErr.Code)
+	assert.EqualValues(t, 1, currentVersion(t, conn))
+
+	// A migration that does not run in a transaction is never retried.
+	mustExec(t, conn, "select setval('attempts', 1, false)")
+	m, err = migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{MaxRetries: 5, RetryBackoff: time.Millisecond})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "select 1;", "drop table t1;")
+	m.AppendMigration("Create t2", "---- tern: disable-tx ----\n"+strings.Replace(failTwiceSQL, "t1", "t2", 1), "drop table t2;")
+
+	err = m.MigrateTo(context.Background(), 2)
+	require.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "40001", pgErr.Code)
+
+	var attempts int64
+	err = conn.QueryRow(context.Background(), "select last_value from attempts").Scan(&attempts)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, attempts)
+}
+
+func TestMigrateToNotify(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	listenConn, err := pgx.Connect(context.Background(), os.Getenv("MIGRATE_TEST_CONN_STRING"))
+	require.NoError(t, err)
+	defer listenConn.Close(context.Background())
+	mustExec(t, listenConn, "listen tern_migrated")
+
+	waitForNotification := func() *pgconn.Notification {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		defer cancel()
+		notification, err := listenConn.WaitForNotification(ctx)
+		if errors.Is(err, context.DeadlineExceeded) {
+			return nil
+		}
+		require.NoError(t, err)
+		return notification
+	}
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{NotifyChannel: "tern_migrated"})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	notification := waitForNotification()
+	require.NotNil(t, notification)
+	assert.Equal(t, "tern_migrated", notification.Channel)
+	assert.Equal(t, "2", notification.Payload)
+
+	// Nothing to migrate.
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	assert.Nil(t, waitForNotification())
+
+	m, err = migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{NotifyChannel: "tern_migrated", NotifyWhenUnchanged: true})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	notification = waitForNotification()
+	require.NotNil(t, notification)
+	assert.Equal(t, "2", notification.Payload)
+}
+
+func TestMigrateToAnnotateApplicationName(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	mustExec(t, conn, "set application_name = 'original'")
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{AnnotateApplicationName: true})
+	require.NoError(t, err)
+	m.AppendMigration("001_create_app_names.sql", "create table app_names(name text); insert into app_names select application_name from pg_stat_activity where pid = pg_backend_pid();", "")
+	m.AppendMigration("002_reset_all.sql", "insert into app_names select application_name from pg_stat_activity where pid = pg_backend_pid(); reset all;", "")
+
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+
+	rows, _ := conn.Query(context.Background(), "select name from app_names order by name")
+	names, err := pgx.CollectRows(rows, pgx.RowTo[string])
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tern:001_create_app_names", "tern:002_reset_all"}, names)
+
+	var applicationName string
+	err = conn.QueryRow(context.Background(), "select current_setting('application_name')").Scan(&applicationName)
+	require.NoError(t, err)
+	assert.Equal(t, "original", applicationName)
+}
+
+func TestMigrateToConcurrentOnNewDatabase(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	var mux sync.Mutex
+	var started []string
+
+	var wg sync.WaitGroup
+	errs := make([]error, 2)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			// Each migrator has its own connection as if it were a separate process.
+			migratorConn, err := pgx.Connect(context.Background(), os.Getenv("MIGRATE_TEST_CONN_STRING"))
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			defer migratorConn.Close(context.Background())
+
+			m, err := migrate.NewMigrator(context.Background(), migratorConn, versionTable)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+			m.AppendMigration("Create t2", "select pg_sleep(0.1); create table t2(id serial);", "drop table t2;")
+			m.AppendMigration("Create t3", "create table t3(id serial);", "drop table t3;")
+			m.OnStart = func(sequence int32, name, direction, sql string) {
+				mux.Lock()
+				started = append(started, name)
+				mux.Unlock()
+			}
+
+			errs[i] = m.MigrateTo(context.Background(), 3)
+		}(i)
+	}
+	wg.Wait()
+
+	for _, err := range errs {
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{"Create t1", "Create t2", "Create t3"}, started)
+	assert.EqualValues(t, 3, currentVersion(t, conn))
+
+	var versionRows int
+	err := conn.QueryRow(context.Background(), "select count(*) from "+versionTable).Scan(&versionRows)
+	require.NoError(t, err)
+	assert.Equal(t, 1, versionRows)
+}
+
+func TestMigrateToReadOnly(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createSampleMigrator(t, conn)
+
+	mustExec(t, conn, "set default_transaction_read_only = on")
+
+	err := m.MigrateTo(context.Background(), 3)
+	require.ErrorIs(t, err, migrate.ErrReadOnlyDatabase)
+	assert.EqualValues(t, 0, currentVersion(t, conn))
+
+	m, err = migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{SkipReadOnlyCheck: true})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+
+	// Without the check the migration itself fails.
+	err = m.MigrateTo(context.Background(), 1)
+	var pgErr *pgconn.PgError
+	require.ErrorAs(t, err, &pgErr)
+	assert.Equal(t, "25006", pgErr.Code) // read_only_sql_transaction
+}
+
+func TestMigrateToGuard(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	mustExec(t, conn, "create table deploy_flag(active boolean not null)")
+	mustExec(t, conn, "insert into deploy_flag values (true)")
+
+	m, err := migrate.NewMigratorEx(context.Background(), conn, versionTable, &migrate.MigratorOptions{
+		GuardSQL:     "select not exists (select 1 from deploy_flag where active)",
+		GuardMessage: "a deployment is in progress",
+	})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+
+	err = m.MigrateTo(context.Background(), 1)
+	var guardErr migrate.GuardFailedError
+	require.ErrorAs(t, err, &guardErr)
+	assert.Equal(t, "guard failed: a deployment is in progress", err.Error())
+	assert.EqualValues(t, 0, currentVersion(t, conn))
+	assert.False(t, tableExists(t, conn, "t1"))
+
+	mustExec(t, conn, "update deploy_flag set active = false")
+
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, currentVersion(t, conn))
+}
+
+func TestClose(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+	m := createEmptyMigrator(t, conn)
+
+	// Simulate locks left behind by interrupted migrations.
+	mustExec(t, conn, "select pg_advisory_lock(9628173550095224)")
+	mustExec(t, conn, "select pg_advisory_lock(9628173550095224)")
+
+	err := m.Close(context.Background())
+	require.NoError(t, err)
+
+	var lockCount int
+	err = conn.QueryRow(context.Background(), "select count(*) from pg_locks where locktype='advisory' and pid=pg_backend_pid()").Scan(&lockCount)
+	require.NoError(t, err)
+	assert.Equal(t, 0, lockCount)
+
+	// The connection is not closed.
+	assert.False(t, conn.IsClosed())
+}
+
+func TestNewMigratorFromPool(t *testing.T) {
+	conn := connectConn(t)
+	defer conn.Close(context.Background())
+
+	pool, err := pgxpool.New(context.Background(), os.Getenv("MIGRATE_TEST_CONN_STRING"))
+	require.NoError(t, err)
+	defer pool.Close()
+
+	m, err := migrate.NewMigratorFromPool(context.Background(), pool, versionTable, &migrate.MigratorOptions{})
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, pool.Stat().AcquiredConns())
+
+	// Each migration records the session it runs on and whether that session holds the advisory lock.
+	recordLock := "insert into lock_checks select pg_backend_pid(), count(*) from pg_locks where locktype='advisory' and pid=pg_backend_pid();"
+	m.AppendMigration("Create lock_checks", "create table lock_checks(pid int, lock_count int);"+recordLock, "")
+	m.AppendMigration("Check lock", recordLock, "")
+	m.AppendMigration("Fail", recordLock+"syntax error;", "")
+
+	err = m.MigrateTo(context.Background(), 3)
+	require.Error(t, err)
+	assert.EqualValues(t, 2, currentVersion(t, conn))
+
+	rows, _ := conn.Query(context.Background(), "select pid, lock_count from lock_checks")
+	checks, err := pgx.CollectRows(rows, pgx.RowToStructByPos[struct {
+		PID       int32
+		LockCount int
+	}])
+	require.NoError(t, err)
+	require.Len(t, checks, 2)
+	assert.Equal(t, checks[0].PID, checks[1].PID)
+	assert.Equal(t, 1, checks[0].LockCount)
+	assert.Equal(t, 1, checks[1].LockCount)
+
+	// The lock is released even though the migration failed.
+	var lockCount int
+	err = conn.QueryRow(context.Background(), "select count(*) from pg_locks where locktype='advisory'").Scan(&lockCount)
+	require.NoError(t, err)
+	assert.Equal(t, 0, lockCount)
+
+	err = m.Close(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, pool.Stat().AcquiredConns())
+}
+
+// fakeConn is a migrate.Conn that records the SQL it is given instead of running it. The version table is simulated.
+type fakeConn struct {
+	version    int32
+	inProgress *string
+	log        []string
+	failOn     string // Exec of SQL containing failOn fails as if the run was interrupted.
+	pgErrorOn  string // Exec of SQL containing pgErrorOn fails with an SQL error.
+	lockIDs    []int64
+	lockBusy   bool // pg_try_advisory_lock fails as if another session holds the lock.
+	appName    string
+}
+
+func (c *fakeConn) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	// Like pgx, a canceled context fails without sending the statement.
+	if ctx.Err() != nil {
+		return pgconn.CommandTag{}, ctx.Err()
+	}
+	if strings.Contains(sql, "pg_sleep") {
+		// A slow statement runs until it is canceled.
+		<-ctx.Done()
+		return pgconn.CommandTag{}, ctx.Err()
+	}
+	if c.failOn != "" && strings.Contains(sql, c.failOn) {
+		return pgconn.CommandTag{}, context.Canceled
+	}
+	if c.pgErrorOn != "" && strings.Contains(sql, c.pgErrorOn) {
+		return pgconn.CommandTag{}, &pgconn.PgError{Severity: "ERROR", Code: "42P07", Message: "relation already exists"}
+	}
+	if strings.Contains(sql, "set version=$1") {
+		c.version = args[0].(int32)
+	}
+	if strings.Contains(sql, "set in_progress=$1") {
+		name := args[0].(string)
+		c.inProgress = &name
+	}
+	if strings.Contains(sql, "set in_progress=null") {
+		c.inProgress = nil
+	}
+	if strings.Contains(sql, "pg_advisory_lock(") {
+		c.lockIDs = append(c.lockIDs, args[0].(int64))
+	}
+	if strings.Contains(sql, "set_config('application_name'") {
+		c.appName = args[0].(string)
+	}
+	c.log = append(c.log, sql)
+	return pgconn.NewCommandTag(""), nil
+}
+
+func (c *fakeConn) Query(ctx context.Context, sql string, args ...any) (pgx.Rows, error) {
+	return nil, errors.New("fakeConn does not support Query")
+}
+
+func (c *fakeConn) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return fakeRow(func(dest ...any) error {
+		switch {
+		case strings.Contains(sql, "transaction_read_only"):
+			*dest[0].(*string) = "off"
+		case strings.HasPrefix(sql, "select count(*) from pg_catalog"):
+			*dest[0].(*int) = 1
+		case strings.HasPrefix(sql, "select version from"):
+			*dest[0].(*int32) = c.version
+		case strings.HasPrefix(sql, "select to_jsonb(t) ? 'in_progress'"):
+			*dest[0].(*bool) = true
+		case strings.HasPrefix(sql, "select to_jsonb(t)->>'in_progress'"):
+			*dest[0].(**string) = c.inProgress
+		case strings.HasPrefix(sql, "select current_setting('application_name')"):
+			*dest[0].(*string) = c.appName
+		case strings.HasPrefix(sql, "select pg_try_advisory_lock"):
+			*dest[0].(*bool) = !c.lockBusy
+		default:
+			return fmt.Errorf("fakeConn does not support QueryRow: %s", sql)
+		}
+		return nil
+	})
+}
+
+func (c *fakeConn) Begin(ctx context.Context) (pgx.Tx, error) {
+	c.log = append(c.log, "begin")
+	return &fakeTx{conn: c}, nil
+}
+
+type fakeRow func(dest ...any) error
+
+func (r fakeRow) Scan(dest ...any) error {
+	return r(dest...)
+}
+
+// fakeTx embeds pgx.Tx so it satisfies the interface. Only the methods used by Migrator are implemented.
+type fakeTx struct {
+	pgx.Tx
+	conn   *fakeConn
+	closed bool
+}
+
+func (tx *fakeTx) Commit(ctx context.Context) error {
+	tx.closed = true
+	tx.conn.log = append(tx.conn.log, "commit")
+	return nil
+}
+
+func (tx *fakeTx) Rollback(ctx context.Context) error {
+	if !tx.closed {
+		tx.closed = true
+		tx.conn.log = append(tx.conn.log, "rollback")
+	}
+	return nil
+}
+
+func (tx *fakeTx) Exec(ctx context.Context, sql string, args ...any) (pgconn.CommandTag, error) {
+	return tx.conn.Exec(ctx, sql, args...)
+}
+
+func (tx *fakeTx) QueryRow(ctx context.Context, sql string, args ...any) pgx.Row {
+	return tx.conn.QueryRow(ctx, sql, args...)
+}
+
+func (tx *fakeTx) Begin(ctx context.Context) (pgx.Tx, error) {
+	return tx.conn.Begin(ctx)
+}
+
+func TestMigrateToTxUsesGivenTx(t *testing.T) {
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{Environment: "production"})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Index t1 in dev", "---- tern: environments dev ----\n---- tern: disable-tx ----\ncreate index concurrently on t1(id);", "")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+	conn.log = nil
+
+	// The transaction is on its own connection so it is possible to see which connection was used.
+	txConn := &fakeConn{}
+	tx, err := txConn.Begin(context.Background())
+	require.NoError(t, err)
+
+	var versionDuringRun int32
+	m.OnStart = func(sequence int32, name, direction, sql string) {
+		versionDuringRun, err = m.GetCurrentVersion(context.Background())
+		require.NoError(t, err)
+	}
+
+	// A migration that is not transactional is skipped in this environment so it does not need to be transactional.
+	err = m.MigrateToTx(context.Background(), tx, 3)
+	require.NoError(t, err)
+	assert.EqualValues(t, 3, txConn.version)
+	assert.Contains(t, txConn.log, "create table t2(id serial);")
+	assert.NotContains(t, txConn.log, "create index concurrently on t1(id);")
+
+	// The Migrator's own connection is not used or replaced while migrating in the transaction.
+	assert.Empty(t, conn.log)
+	assert.EqualValues(t, 0, conn.version)
+	assert.EqualValues(t, 0, versionDuringRun)
+
+	// In another environment it would be run so it is refused before anything is run.
+	m, err = migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{Environment: "dev"})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Index t1 in dev", "---- tern: environments dev ----\n---- tern: disable-tx ----\ncreate index concurrently on t1(id);", "")
+	txConn = &fakeConn{}
+	tx, err = txConn.Begin(context.Background())
+	require.NoError(t, err)
+	err = m.MigrateToTx(context.Background(), tx, 2)
+	require.EqualError(t, err, "Index t1 in dev: migration cannot be run in the transaction given to MigrateToTx because it is not transactional")
+	assert.NotContains(t, txConn.log, "create table t1(id serial);")
+	assert.EqualValues(t, 0, txConn.version)
+}
+
+func TestMigrateToTxAssumedCurrentVersion(t *testing.T) {
+	assumed := int32(1)
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{AssumedCurrentVersion: &assumed})
+	require.NoError(t, err)
+	m.AppendMigration("Index t1", "---- tern: disable-tx ----\ncreate index concurrently on t1(id);", "")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+
+	// The non-transactional migration is already applied according to AssumedCurrentVersion so it is not run.
+	tx, err := conn.Begin(context.Background())
+	require.NoError(t, err)
+	err = m.MigrateToTx(context.Background(), tx, 2)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, conn.version)
+	assert.NotContains(t, conn.log, "create index concurrently on t1(id);")
+}
+
+func TestMigrateToLockCallbacks(t *testing.T) {
+	var events []string
+	conn := &fakeConn{lockBusy: true}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{
+		OnLockWait:     func(lockID int64) { events = append(events, fmt.Sprintf("wait %d", lockID)) },
+		OnLockAcquired: func(lockID int64) { events = append(events, fmt.Sprintf("acquired %d", lockID)) },
+		OnLockReleased: func(lockID int64) { events = append(events, fmt.Sprintf("released %d", lockID)) },
+	})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+
+	// Creating the version table takes the lock too.
+	assert.Equal(t, []string{"wait 9628173550095224", "acquired 9628173550095224", "released 9628173550095224"}, events)
+
+	events = nil
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"wait 9628173550095224", "acquired 9628173550095224", "released 9628173550095224"}, events)
+
+	// OnLockWait is not called when the lock is free.
+	events = nil
+	conn.lockBusy = false
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"acquired 9628173550095224", "released 9628173550095224"}, events)
+}
+
+func TestIsUpToDate(t *testing.T) {
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+
+	conn.log = nil
+	upToDate, err := m.IsUpToDate(context.Background())
+	require.NoError(t, err)
+	assert.False(t, upToDate)
+
+	conn.version = 2
+	upToDate, err = m.IsUpToDate(context.Background())
+	require.NoError(t, err)
+	assert.True(t, upToDate)
+
+	conn.version = 3
+	upToDate, err = m.IsUpToDate(context.Background())
+	require.NoError(t, err)
+	assert.False(t, upToDate)
+
+	// Nothing is written and the advisory lock is not taken.
+	assert.Empty(t, conn.log)
+}
+
+func TestMigrateToWithFakeConn(t *testing.T) {
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+
+	conn.log = nil
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, conn.version)
+	assert.Equal(t, []string{
+		"select pg_advisory_lock($1)",
+		"begin",
+		"create table t1(id serial);",
+		"reset all",
+		"update " + versionTable + " set version=$1",
+		"commit",
+		"begin",
+		"create table t2(id serial);",
+		"reset all",
+		"update " + versionTable + " set version=$1",
+		"commit",
+		"select pg_advisory_unlock($1)",
+	}, conn.log)
+
+	conn.log = nil
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, conn.version)
+	assert.Contains(t, conn.log, "drop table t2;")
+	assert.NotContains(t, conn.log, "drop table t1;")
+}
+
+// componentVersionStore is a migrate.VersionStore that keeps the version of one component in a table with a row per
+// component.
+type componentVersionStore struct {
+	component string
+}
+
+func (s componentVersionStore) EnsureExists(ctx context.Context, conn migrate.Conn) error {
+	_, err := conn.Exec(ctx, "create table if not exists component_versions(component text primary key, version int4 not null)")
+	if err != nil {
+		return err
+	}
+	_, err = conn.Exec(ctx, "insert into component_versions(component, version) values($1, 0) on conflict do nothing", s.component)
+	return err
+}
+
+func (s componentVersionStore) GetVersion(ctx context.Context, conn migrate.Conn) (v int32, err error) {
+	err = conn.QueryRow(ctx, "select version from component_versions where component=$1", s.component).Scan(&v)
+	return v, err
+}
+
+func (s componentVersionStore) SetVersion(ctx context.Context, conn migrate.Conn, version int32) error {
+	_, err := conn.Exec(ctx, "update component_versions set version=$1 where component=$2", version, s.component)
+	return err
+}
+
+func TestMigrateToWithVersionStore(t *testing.T) {
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{
+		VersionStore: componentVersionStore{component: "billing"},
+	})
+	require.NoError(t, err)
+	assert.Contains(t, conn.log, "create table if not exists component_versions(component text primary key, version int4 not null)")
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+
+	conn.log = nil
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, conn.version)
+	assert.Equal(t, []string{
+		"select pg_advisory_lock($1)",
+		"begin",
+		"create table t1(id serial);",
+		"reset all",
+		"update component_versions set version=$1 where component=$2",
+		"commit",
+		"begin",
+		"create table t2(id serial);",
+		"reset all",
+		"update component_versions set version=$1 where component=$2",
+		"commit",
+		"select pg_advisory_unlock($1)",
+	}, conn.log)
+
+	v, err := m.GetCurrentVersion(context.Background())
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, v)
+}
+
+func TestMigrateToMigrationTimeout(t *testing.T) {
+	conn := &fakeConn{appName: "deploy"}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{MigrationTimeout: 50 * time.Millisecond, AnnotateApplicationName: true})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Slow", "select pg_sleep(60);", "")
+	m.AppendMigration("Create t2", "create table t2(id serial);", "drop table t2;")
+
+	err = m.MigrateTo(context.Background(), 3)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.EqualError(t, err, "Slow: migration did not finish within 50ms: context deadline exceeded")
+	assert.EqualValues(t, 1, conn.version)
+	assert.NotContains(t, conn.log, "create table t2(id serial);")
+	assert.Contains(t, conn.log, "rollback")
+
+	// The application_name annotation is undone even though the migration's context was canceled.
+	assert.Equal(t, "deploy", conn.appName)
+}
+
+func TestVersionTableLockID(t *testing.T) {
+	assert.Equal(t, migrate.VersionTableLockID("public.schema_version"), migrate.VersionTableLockID("public.schema_version"))
+	assert.EqualValues(t, -3591653556973325118, migrate.VersionTableLockID("public.schema_version"))
+
+	tables := []string{"public.schema_version", "billing.schema_version", "shipping.schema_version", "schema_version"}
+	ids := make(map[int64]string)
+	for _, table := range tables {
+		id := migrate.VersionTableLockID(table)
+		assert.NotContains(t, ids, id, "%s has the same lock id as %s", table, ids[id])
+		ids[id] = table
+	}
+}
+
+func TestMigrateToLockIDFromVersionTable(t *testing.T) {
+	lockIDs := func(versionTable string, opts *migrate.MigratorOptions) []int64 {
+		conn := &fakeConn{}
+		m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, opts)
+		require.NoError(t, err)
+		m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+		err = m.MigrateTo(context.Background(), 1)
+		require.NoError(t, err)
+		return conn.lockIDs
+	}
+
+	billing := lockIDs("billing.schema_version", &migrate.MigratorOptions{LockIDFromVersionTable: true})
+	require.NotEmpty(t, billing)
+	for _, id := range billing {
+		assert.Equal(t, migrate.VersionTableLockID("billing.schema_version"), id)
+	}
+
+	shipping := lockIDs("shipping.schema_version", &migrate.MigratorOptions{LockIDFromVersionTable: true})
+	assert.NotEqual(t, billing[0], shipping[0])
+
+	// Without the option every version table shares the same lock.
+	assert.Equal(t, lockIDs("billing.schema_version", &migrate.MigratorOptions{})[0], lockIDs("shipping.schema_version", &migrate.MigratorOptions{})[0])
+}
+
+func TestMigrateToIncompleteMigration(t *testing.T) {
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create indexes", "---- tern: disable-tx ----\ncreate index concurrently on t1(id);\ncreate index concurrently on t1(id, id);", "")
+
+	var incomplete []string
+	m.OnIncompleteMigration = func(name string) {
+		incomplete = append(incomplete, name)
+	}
+
+	// The run is interrupted after the first index of the non-transactional migration was created.
+	conn.failOn = "t1(id, id)"
+	err = m.MigrateTo(context.Background(), 2)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.EqualValues(t, 1, conn.version)
+
+	name, err := m.IncompleteMigration(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Create indexes", name)
+
+	// The migration is not idempotent so it is not run again.
+	conn.failOn = ""
+	conn.log = nil
+	err = m.MigrateTo(context.Background(), 2)
+	var incompleteErr migrate.IncompleteMigrationError
+	require.ErrorAs(t, err, &incompleteErr)
+	assert.Equal(t, "Create indexes", incompleteErr.MigrationName)
+	assert.NotContains(t, conn.log, "create index concurrently on t1(id);")
+	assert.EqualValues(t, 1, conn.version)
+	assert.Empty(t, incomplete)
+
+	// Steps that neither run the migration nor migrate past it only report the record.
+	var warnings []string
+	m.OnIncompleteMigrationWarning = func(name string) {
+		warnings = append(warnings, name)
+	}
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+	err = m.MigrateTo(context.Background(), 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, conn.version)
+	assert.Equal(t, []string{"Create indexes", "Create indexes"}, warnings)
+
+	name, err = m.IncompleteMigration(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Create indexes", name)
+
+	// Migrating past it is refused.
+	err = m.MigrateTo(context.Background(), 2)
+	require.ErrorAs(t, err, &incompleteErr)
+	assert.EqualValues(t, 0, conn.version)
+
+	// Setting the version after repairing the database by hand clears the record.
+	err = m.SetVersion(context.Background(), 1)
+	require.NoError(t, err)
+	name, err = m.IncompleteMigration(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, name)
+}
+
+func TestMigrateToIncompleteIdempotentMigration(t *testing.T) {
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create indexes", "---- tern: disable-tx ----\n---- tern: idempotent ----\ncreate index concurrently if not exists t1_a on t1(id);\ncreate index concurrently if not exists t1_b on t1(id, id);", "drop index t1_a; drop index t1_b;")
+	assert.True(t, m.Migrations[1].Idempotent("up"))
+	assert.False(t, m.Migrations[1].Idempotent("down"))
+	assert.False(t, m.Migrations[0].Idempotent("up"))
+
+	var incomplete []string
+	m.OnIncompleteMigration = func(name string) {
+		incomplete = append(incomplete, name)
+	}
+
+	conn.failOn = "t1_b"
+	err = m.MigrateTo(context.Background(), 2)
+	require.ErrorIs(t, err, context.Canceled)
+	assert.EqualValues(t, 1, conn.version)
+	assert.Empty(t, incomplete)
+
+	// The idempotent migration is resumed by running it again from the start.
+	conn.failOn = ""
+	conn.log = nil
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+	assert.EqualValues(t, 2, conn.version)
+	assert.Equal(t, []string{"Create indexes"}, incomplete)
+	assert.Contains(t, conn.log, "create index concurrently if not exists t1_a on t1(id);")
+
+	name, err := m.IncompleteMigration(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, name)
+
+	// Only the interrupted migration may be resumed. Migrating down away from it keeps the record.
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+	conn.failOn = "t1_b"
+	err = m.MigrateTo(context.Background(), 2)
+	require.ErrorIs(t, err, context.Canceled)
+	conn.failOn = ""
+	var warnings []string
+	m.OnIncompleteMigrationWarning = func(name string) {
+		warnings = append(warnings, name)
+	}
+	err = m.MigrateTo(context.Background(), 0)
+	require.NoError(t, err)
+	assert.EqualValues(t, 0, conn.version)
+	assert.Equal(t, []string{"Create indexes"}, warnings)
+	assert.Equal(t, []string{"Create indexes"}, incomplete)
+
+	// Resuming requires it to be the first step.
+	err = m.MigrateTo(context.Background(), 2)
+	var incompleteErr migrate.IncompleteMigrationError
+	require.ErrorAs(t, err, &incompleteErr)
+	assert.EqualValues(t, 0, conn.version)
+}
+
+func TestMigrateToIncompleteMigrationOtherNonTransactionalStep(t *testing.T) {
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "---- tern: disable-tx ----\ndrop table t1;")
+	m.AppendMigration("Create indexes", "---- tern: disable-tx ----\ncreate index concurrently t1_a on t1(id);\ncreate index concurrently t1_b on t1(id, id);", "")
+
+	conn.failOn = "t1_b"
+	err = m.MigrateTo(context.Background(), 2)
+	require.ErrorIs(t, err, context.Canceled)
+	conn.failOn = ""
+
+	// Migrating down does not pass the incomplete migration but the step would replace its record.
+	conn.log = nil
+	err = m.MigrateTo(context.Background(), 0)
+	var incompleteErr migrate.IncompleteMigrationError
+	require.ErrorAs(t, err, &incompleteErr)
+	assert.Equal(t, "Create indexes", incompleteErr.MigrationName)
+	assert.NotContains(t, conn.log, "drop table t1;")
+	assert.EqualValues(t, 1, conn.version)
+}
+
+func TestMigrateToContinueOnErrorStopsAtIncompleteMigration(t *testing.T) {
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{ContinueOnError: true})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1 indexes", "---- tern: disable-tx ----\ncreate index concurrently t1_a on t1(id);\ncreate index concurrently t1_b on t1(id, id);", "")
+	m.AppendMigration("Create t2 indexes", "---- tern: disable-tx ----\ncreate index concurrently t2_a on t2(id);", "")
+
+	conn.pgErrorOn = "t1_b"
+	err = m.MigrateTo(context.Background(), 2)
+	var mgErr migrate.MigrationPgError
+	require.ErrorAs(t, err, &mgErr)
+	assert.NotContains(t, conn.log, "create index concurrently t2_a on t2(id);")
+	assert.EqualValues(t, 0, conn.version)
+
+	name, err := m.IncompleteMigration(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Create t1 indexes", name)
+}
+
+func TestMigrateToNonTransactionalFirstStatementError(t *testing.T) {
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create indexes", "---- tern: disable-tx ----\ncreate index concurrently t1_a on t1(id);\ncreate index concurrently t1_b on t1(id, id);", "drop index t1_a; drop index t1_b;")
+
+	// Nothing was applied so the record is cleared and the migration can be run again.
+	conn.pgErrorOn = "t1_a"
+	err = m.MigrateTo(context.Background(), 2)
+	var mgErr migrate.MigrationPgError
+	require.ErrorAs(t, err, &mgErr)
+	assert.EqualValues(t, 1, conn.version)
+	name, err := m.IncompleteMigration(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, name)
+
+	// The first statement was applied so the record is kept.
+	conn.pgErrorOn = "t1_b"
+	err = m.MigrateTo(context.Background(), 2)
+	require.ErrorAs(t, err, &mgErr)
+	name, err = m.IncompleteMigration(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "Create indexes", name)
 }
 
-func Example_OnStartMigrationProgressLogging() {
+func Example_onStartMigrationProgressLogging() {
 	conn, err := pgx.Connect(context.Background(), os.Getenv("MIGRATE_TEST_CONN_STRING"))
 	if err != nil {
 		fmt.Printf("Unable to establish connection: %v", err)
@@ -0,0 +1 @@
+create view {{.schema}}.a as select 1 as n;
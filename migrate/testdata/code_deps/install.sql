@@ -0,0 +1,2 @@
+drop schema if exists {{.schema}} cascade;
+create schema {{.schema}};
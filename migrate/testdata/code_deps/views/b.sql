@@ -0,0 +1 @@
+create view {{.schema}}.b as select n from {{.schema}}.a;
@@ -0,0 +1 @@
+create view {{.schema}}.c as select n from {{.schema}}.b;
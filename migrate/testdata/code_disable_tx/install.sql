@@ -0,0 +1,3 @@
+create table things(id int);
+
+create index concurrently things_id_idx on things(id);
@@ -0,0 +1,3 @@
+create function add(int, int) returns int language sql as $$ select $1 + $2 $$;
+
+create table counters(id serial primary key, n int not null);
@@ -0,0 +1,5 @@
+create table widgets(id serial primary key, name text not null);
+
+create table gadgets(id serial primary key, name text not null);
+
+create or replace function widget_count() returns bigint language sql as $$ select count(*) from widgets $$;
@@ -0,0 +1,5 @@
+create table << .prefix >>settings(data jsonb not null default '{"template": "{{ name }}"}');
+
+---- create above / drop below ----
+
+drop table << .prefix >>settings;
@@ -0,0 +1 @@
+create table t2(id serial primary key);
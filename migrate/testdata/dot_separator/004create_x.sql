@@ -0,0 +1 @@
+create table x(id serial primary key);
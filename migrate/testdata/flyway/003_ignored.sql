@@ -0,0 +1 @@
+create table ignored(id int);
@@ -0,0 +1,5 @@
+{{ include "shared/create_table.sql" . | trim }}
+
+---- create above / drop below ----
+
+drop table {{.prefix}}_included;
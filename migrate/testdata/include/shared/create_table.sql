@@ -0,0 +1 @@
+create table {{.prefix}}_included(id serial primary key);
@@ -0,0 +1 @@
+create index on t3(id);
@@ -0,0 +1,5 @@
+create table t2(id serial primary key);
+
+---- create above / drop below ----
+
+drop table t2;
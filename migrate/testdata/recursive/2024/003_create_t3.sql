@@ -0,0 +1,7 @@
+create table t3(
+  {{ template "shared/t3_columns.sql" }}
+);
+
+---- create above / drop below ----
+
+drop table t3;
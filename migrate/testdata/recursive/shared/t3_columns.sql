@@ -0,0 +1 @@
+id serial primary key
\ No newline at end of file
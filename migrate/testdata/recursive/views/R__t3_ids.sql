@@ -0,0 +1 @@
+create or replace view t3_ids as select id from t3;
@@ -0,0 +1 @@
+create or replace view {{.prefix}}t1_ids as select id from t1;
@@ -0,0 +1,4 @@
+---- tern: require-data prefix, region ----
+create table {{.prefix}}_orders(id int, region text default '{{.region}}');
+---- create above / drop below ----
+drop table {{.prefix}}_orders;
@@ -0,0 +1,6 @@
+---- tern: require-env TERN_TEST_SCHEMA TERN_TEST_OWNER ----
+create schema {{ env "TERN_TEST_SCHEMA" }} authorization {{ env "TERN_TEST_OWNER" }};
+
+---- create above / drop below ----
+
+drop schema {{ env "TERN_TEST_SCHEMA" }};
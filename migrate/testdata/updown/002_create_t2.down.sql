@@ -0,0 +1 @@
+drop table {{.prefix}}_t2;
@@ -0,0 +1 @@
+create table {{.prefix}}_t2(id serial primary key);
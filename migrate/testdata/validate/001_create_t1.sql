@@ -0,0 +1,3 @@
+create table t1(id int);
+---- create above / drop below ----
+drop table t1;
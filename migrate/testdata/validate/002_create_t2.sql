@@ -0,0 +1 @@
+create table t2(region text default '{{ upper .region }}');
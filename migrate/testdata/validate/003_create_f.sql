@@ -0,0 +1,5 @@
+create function f() returns int as $$
+  select 1;
+language sql;
+---- create above / drop below ----
+drop function f();
@@ -0,0 +1,3 @@
+create view v as select 1;
+---- create above / drop below ----
+drop view v;
@@ -0,0 +1 @@
+create or replace view rv as select 'abc;
@@ -0,0 +1,39 @@
+package migrate
+
+import (
+	"context"
+)
+
+// Tracer starts spans for tracing migrations. It is set with MigratorOptions.Tracer. tern does not depend on any
+// tracing library. An adapter for a library such as OpenTelemetry only needs to wrap its tracer and span types.
+//
+// MigrateTo starts a "tern.migrate" span around the whole run and a "tern.migration" child span for each migration
+// with the attributes tern.migration.sequence, tern.migration.name, tern.migration.direction,
+// tern.migration.disable_tx, and tern.migration.duration_seconds.
+type Tracer interface {
+	// Start starts a span named name as a child of any span in ctx. The returned context contains the new span.
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer.
+type Span interface {
+	// SetAttribute sets an attribute of the span. value is a string, bool, int32, or float64.
+	SetAttribute(key string, value any)
+
+	// End ends the span. err is the error the traced operation failed with or nil if it succeeded.
+	End(err error)
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value any) {}
+func (noopSpan) End(err error)                      {}
+
+// startSpan starts a span with MigratorOptions.Tracer. It returns ctx and a span that does nothing if there is no
+// Tracer.
+func (m *Migrator) startSpan(ctx context.Context, name string) (context.Context, Span) {
+	if m.options.Tracer == nil {
+		return ctx, noopSpan{}
+	}
+	return m.options.Tracer.Start(ctx, name)
+}
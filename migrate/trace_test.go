@@ -0,0 +1,141 @@
+package migrate_test
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/jackc/tern/v2/migrate"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type spanContextKey struct{}
+
+// recordingTracer is a migrate.Tracer that records the spans it starts.
+type recordingTracer struct {
+	spans []*recordingSpan
+}
+
+type recordingSpan struct {
+	name       string
+	parent     *recordingSpan
+	attributes map[string]any
+	ended      bool
+	err        error
+}
+
+func (tr *recordingTracer) Start(ctx context.Context, name string) (context.Context, migrate.Span) {
+	parent, _ := ctx.Value(spanContextKey{}).(*recordingSpan)
+	span := &recordingSpan{name: name, parent: parent, attributes: make(map[string]any)}
+	tr.spans = append(tr.spans, span)
+	return context.WithValue(ctx, spanContextKey{}, span), span
+}
+
+func (s *recordingSpan) SetAttribute(key string, value any) {
+	s.attributes[key] = value
+}
+
+func (s *recordingSpan) End(err error) {
+	s.ended = true
+	s.err = err
+}
+
+func TestMigrateToWithTracer(t *testing.T) {
+	conn := &fakeConn{}
+	tracer := &recordingTracer{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{Tracer: tracer})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+	m.AppendMigration("Create index", "---- tern: disable-tx ----\ncreate index concurrently on t1(id);", "drop index t1_id_idx;")
+
+	err = m.MigrateTo(context.Background(), 2)
+	require.NoError(t, err)
+
+	require.Len(t, tracer.spans, 3)
+	run := tracer.spans[0]
+	assert.Equal(t, "tern.migrate", run.name)
+	assert.Nil(t, run.parent)
+	assert.True(t, run.ended)
+	assert.NoError(t, run.err)
+	assert.EqualValues(t, 0, run.attributes["tern.current_version"])
+	assert.EqualValues(t, 2, run.attributes["tern.target_version"])
+
+	for i, span := range tracer.spans[1:] {
+		assert.Equal(t, "tern.migration", span.name)
+		assert.Same(t, run, span.parent)
+		assert.True(t, span.ended)
+		assert.EqualValues(t, i+1, span.attributes["tern.migration.sequence"])
+		assert.Equal(t, "up", span.attributes["tern.migration.direction"])
+		assert.Equal(t, i == 1, span.attributes["tern.migration.disable_tx"])
+		assert.IsType(t, float64(0), span.attributes["tern.migration.duration_seconds"])
+	}
+	assert.Equal(t, "Create t1", tracer.spans[1].attributes["tern.migration.name"])
+	assert.Equal(t, "Create index", tracer.spans[2].attributes["tern.migration.name"])
+}
+
+// noopTracer is a migrate.Tracer that does nothing, like the no-op tracer of a tracing library.
+type noopTracer struct{}
+
+func (noopTracer) Start(ctx context.Context, name string) (context.Context, migrate.Span) {
+	return ctx, noopSpan{}
+}
+
+type noopSpan struct{}
+
+func (noopSpan) SetAttribute(key string, value any) {}
+func (noopSpan) End(err error)                      {}
+
+func TestMigrateToWithNoopTracer(t *testing.T) {
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, versionTable, &migrate.MigratorOptions{Tracer: noopTracer{}})
+	require.NoError(t, err)
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+
+	err = m.MigrateTo(context.Background(), 1)
+	require.NoError(t, err)
+	assert.EqualValues(t, 1, conn.version)
+}
+
+// printTracer is a migrate.Tracer that prints spans as they end. An adapter for a tracing library such as
+// OpenTelemetry is similar. Start calls the Start method of the library's tracer and the span wraps the library's span.
+type printTracer struct{}
+
+type printSpan struct {
+	name  string
+	attrs []string
+}
+
+func (printTracer) Start(ctx context.Context, name string) (context.Context, migrate.Span) {
+	return ctx, &printSpan{name: name}
+}
+
+func (s *printSpan) SetAttribute(key string, value any) {
+	if key != "tern.migration.duration_seconds" {
+		s.attrs = append(s.attrs, fmt.Sprintf("%s=%v", key, value))
+	}
+}
+
+func (s *printSpan) End(err error) {
+	fmt.Println(s.name, s.attrs, err)
+}
+
+func ExampleTracer() {
+	conn := &fakeConn{}
+	m, err := migrate.NewMigratorWithConn(context.Background(), conn, "schema_version", &migrate.MigratorOptions{Tracer: printTracer{}})
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	m.AppendMigration("Create t1", "create table t1(id serial);", "drop table t1;")
+
+	err = m.MigrateTo(context.Background(), 1)
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+
+	// Output:
+	// tern.migration [tern.migration.sequence=1 tern.migration.name=Create t1 tern.migration.direction=up tern.migration.disable_tx=false] <nil>
+	// tern.migrate [tern.target_version=1 tern.current_version=0] <nil>
+}
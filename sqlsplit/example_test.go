@@ -0,0 +1,30 @@
+package sqlsplit_test
+
+import (
+	"fmt"
+
+	"github.com/jackc/tern/v2/sqlsplit"
+)
+
+func ExampleSplit() {
+	sql := `create table t(s text); -- semicolons in comments; are ignored
+insert into t values ('a;b'), (E'c\';d');
+create function f() returns text language sql as $$ select 'x;y'; $$;`
+
+	for _, statement := range sqlsplit.Split(sql) {
+		fmt.Printf("%q\n", statement)
+	}
+
+	// Output:
+	// "create table t(s text);"
+	// "-- semicolons in comments; are ignored\ninsert into t values ('a;b'), (E'c\\';d');"
+	// "create function f() returns text language sql as $$ select 'x;y'; $$;"
+}
+
+func ExampleCheck() {
+	err := sqlsplit.Check("select 'missing closing quote;\nselect 1;")
+	fmt.Println(err)
+
+	// Output:
+	// unterminated quoted string starting at line 1
+}
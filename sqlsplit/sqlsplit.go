@@ -0,0 +1,342 @@
+// Package sqlsplit splits a string of PostgreSQL SQL into statements. It is the splitter tern uses to run migrations
+// that do not run in a transaction one statement at a time.
+//
+// Statements end at a semicolon that is not inside one of the following, which are otherwise passed through unchanged:
+//
+//   - single-quoted strings, where two quotes in a row are a literal quote, and escape strings (E'...'), where a
+//     backslash escapes the next character
+//   - double-quoted identifiers ("a;b")
+//   - dollar-quoted strings ($$...$$ and $tag$...$tag$) such as function bodies. Positional parameters like $1 are not
+//     mistaken for dollar quotes.
+//   - line comments (-- ...) and block comments (/* ... */), which may be nested
+//
+// Each statement includes its terminating semicolon and any comments before it, with leading and trailing whitespace
+// removed. Text after the last semicolon, including a trailing comment, is returned as a final statement. The SQL is
+// not otherwise parsed or validated, and psql meta-commands such as \connect are not supported.
+package sqlsplit
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// Split splits sql into into a slice of strings each containing one SQL statement.
+func Split(sql string) []string {
+	var statements []string
+	SplitFunc(sql, func(statement string) error {
+		statements = append(statements, statement)
+		return nil
+	})
+
+	return statements
+}
+
+// SplitFunc splits sql into statements and calls yield with each statement as it is found. This avoids building a
+// slice of all statements when sql is very large. If sql does not contain any statements yield is called once with
+// sql. If yield returns an error splitting stops and the error is returned.
+func SplitFunc(sql string, yield func(statement string) error) error {
+	l := &sqlLexer{
+		src:     sql,
+		stateFn: rawState,
+		yield:   yield,
+	}
+
+	for l.stateFn != nil {
+		l.stateFn = l.stateFn(l)
+	}
+
+	if l.err != nil {
+		return l.err
+	}
+
+	if l.statementCount == 0 {
+		return yield(sql)
+	}
+
+	return nil
+}
+
+// Check returns an error if sql ends inside a quoted string, quoted identifier, dollar-quoted string, or block
+// comment. These usually mean a closing quote or comment terminator is missing and the rest of sql would be run as part
+// of the quoted string or ignored.
+func Check(sql string) error {
+	l := &sqlLexer{
+		src:     sql,
+		stateFn: rawState,
+		yield:   func(string) error { return nil },
+	}
+
+	for l.stateFn != nil {
+		l.stateFn = l.stateFn(l)
+	}
+
+	if l.unterminated != "" {
+		line := strings.Count(sql[:l.openPos], "\n") + 1
+		return fmt.Errorf("unterminated %s starting at line %d", l.unterminated, line)
+	}
+
+	return nil
+}
+
+type sqlLexer struct {
+	src     string
+	start   int
+	pos     int
+	nested  int // multiline comment nesting level.
+	stateFn stateFn
+
+	yield          func(string) error
+	statementCount int
+	err            error
+
+	unterminated string // kind of quoted string or comment that sql ends inside of.
+	openPos      int    // position the unterminated quoted string or comment starts at.
+}
+
+func (l *sqlLexer) addStatement(s string) {
+	s = strings.TrimSpace(s)
+	if len(s) > 0 {
+		l.statementCount++
+		l.err = l.yield(s)
+	}
+}
+
+type stateFn func(*sqlLexer) stateFn
+
+func rawState(l *sqlLexer) stateFn {
+	for {
+		runeStart := l.pos
+		r, width := utf8.DecodeRuneInString(l.src[l.pos:])
+		l.pos += width
+
+		switch r {
+		case 'e', 'E':
+			nextRune, width := utf8.DecodeRuneInString(l.src[l.pos:])
+			if nextRune == '\'' {
+				l.pos += width
+				l.openPos = runeStart
+				return escapeStringState
+			}
+		case '\'':
+			l.openPos = runeStart
+			return singleQuoteState
+		case '"':
+			l.openPos = runeStart
+			return doubleQuoteState
+		case '$':
+			tag, ok := readDollarTag(l.src[l.pos:])
+			if ok {
+				l.pos += len(tag) + 1 // tag + "$"
+				l.openPos = runeStart
+				return dollarQuoteState(tag)
+			}
+		case ';':
+			l.addStatement(l.src[l.start:l.pos])
+			l.start = l.pos
+			if l.err != nil {
+				return nil
+			}
+			return rawState
+		case '-':
+			nextRune, width := utf8.DecodeRuneInString(l.src[l.pos:])
+			if nextRune == '-' {
+				l.pos += width
+				return oneLineCommentState
+			}
+		case '/':
+			nextRune, width := utf8.DecodeRuneInString(l.src[l.pos:])
+			if nextRune == '*' {
+				l.pos += width
+				l.openPos = runeStart
+				return multilineCommentState
+			}
+		case utf8.RuneError:
+			if l.pos-l.start > 0 {
+				l.addStatement(l.src[l.start:l.pos])
+				l.start = l.pos
+			}
+			return nil
+		}
+	}
+}
+
+func singleQuoteState(l *sqlLexer) stateFn {
+	for {
+		r, width := utf8.DecodeRuneInString(l.src[l.pos:])
+		l.pos += width
+
+		switch r {
+		case '\'':
+			nextRune, width := utf8.DecodeRuneInString(l.src[l.pos:])
+			if nextRune != '\'' {
+				return rawState
+			}
+			l.pos += width
+		case utf8.RuneError:
+			l.unterminated = "quoted string"
+			if l.pos-l.start > 0 {
+				l.addStatement(l.src[l.start:l.pos])
+				l.start = l.pos
+			}
+			return nil
+		}
+	}
+}
+
+func doubleQuoteState(l *sqlLexer) stateFn {
+	for {
+		r, width := utf8.DecodeRuneInString(l.src[l.pos:])
+		l.pos += width
+
+		switch r {
+		case '"':
+			nextRune, width := utf8.DecodeRuneInString(l.src[l.pos:])
+			if nextRune != '"' {
+				return rawState
+			}
+			l.pos += width
+		case utf8.RuneError:
+			l.unterminated = "quoted identifier"
+			if l.pos-l.start > 0 {
+				l.addStatement(l.src[l.start:l.pos])
+				l.start = l.pos
+			}
+			return nil
+		}
+	}
+}
+
+func dollarQuoteState(openingTag string) func(l *sqlLexer) stateFn {
+	return func(l *sqlLexer) stateFn {
+		for {
+			r, width := utf8.DecodeRuneInString(l.src[l.pos:])
+			l.pos += width
+
+			switch r {
+			case '$':
+				tag, ok := readDollarTag(l.src[l.pos:])
+				if ok && tag == openingTag {
+					l.pos += len(tag) + 1 // tag + "$"
+					return rawState
+				}
+				l.pos += width
+			case utf8.RuneError:
+				l.unterminated = "dollar-quoted string"
+				if l.pos-l.start > 0 {
+					l.addStatement(l.src[l.start:l.pos])
+					l.start = l.pos
+				}
+				return nil
+			}
+		}
+	}
+}
+
+func readDollarTag(src string) (tag string, ok bool) {
+	nextRune, width := utf8.DecodeRuneInString(src)
+	if nextRune == '$' {
+		return "", true
+	}
+
+	if !unicode.IsLetter(nextRune) && nextRune != '_' {
+		// Not a valid identifier. Perhaps it's a positional parameter like $1.
+		return "", false
+	}
+
+	tagWidth := width
+	for {
+		nextRune, width := utf8.DecodeRuneInString(src[tagWidth:])
+		if nextRune == '$' {
+			return src[:tagWidth], true
+		} else if unicode.IsLetter(nextRune) || nextRune == '_' || ('0' <= nextRune && nextRune <= '9') {
+			tagWidth += width
+		} else {
+			// Unexpected rune or end of string. This is not a valid identifier, bail out.
+			return "", false
+		}
+	}
+}
+
+func escapeStringState(l *sqlLexer) stateFn {
+	for {
+		r, width := utf8.DecodeRuneInString(l.src[l.pos:])
+		l.pos += width
+
+		switch r {
+		case '\\':
+			_, width = utf8.DecodeRuneInString(l.src[l.pos:])
+			l.pos += width
+		case '\'':
+			nextRune, width := utf8.DecodeRuneInString(l.src[l.pos:])
+			if nextRune != '\'' {
+				return rawState
+			}
+			l.pos += width
+		case utf8.RuneError:
+			l.unterminated = "escape string"
+			if l.pos-l.start > 0 {
+				l.addStatement(l.src[l.start:l.pos])
+				l.start = l.pos
+			}
+			return nil
+		}
+	}
+}
+
+func oneLineCommentState(l *sqlLexer) stateFn {
+	for {
+		r, width := utf8.DecodeRuneInString(l.src[l.pos:])
+		l.pos += width
+
+		switch r {
+		case '\\':
+			_, width = utf8.DecodeRuneInString(l.src[l.pos:])
+			l.pos += width
+		case '\n', '\r':
+			return rawState
+		case utf8.RuneError:
+			if l.pos-l.start > 0 {
+				l.addStatement(l.src[l.start:l.pos])
+				l.start = l.pos
+			}
+			return nil
+		}
+	}
+}
+
+func multilineCommentState(l *sqlLexer) stateFn {
+	for {
+		r, width := utf8.DecodeRuneInString(l.src[l.pos:])
+		l.pos += width
+
+		switch r {
+		case '/':
+			nextRune, width := utf8.DecodeRuneInString(l.src[l.pos:])
+			if nextRune == '*' {
+				l.pos += width
+				l.nested++
+			}
+		case '*':
+			nextRune, width := utf8.DecodeRuneInString(l.src[l.pos:])
+			if nextRune != '/' {
+				continue
+			}
+
+			l.pos += width
+			if l.nested == 0 {
+				return rawState
+			}
+			l.nested--
+
+		case utf8.RuneError:
+			l.unterminated = "block comment"
+			if l.pos-l.start > 0 {
+				l.addStatement(l.src[l.start:l.pos])
+				l.start = l.pos
+			}
+			return nil
+		}
+	}
+}
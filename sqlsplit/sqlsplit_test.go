@@ -1,9 +1,11 @@
 package sqlsplit_test
 
 import (
+	"errors"
+	"strings"
 	"testing"
 
-	"github.com/jackc/tern/v2/migrate/internal/sqlsplit"
+	"github.com/jackc/tern/v2/sqlsplit"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -128,3 +130,84 @@ select 2;`,
 		assert.Equalf(t, tt.expected, actual, "%d", i)
 	}
 }
+
+func TestSplitFunc(t *testing.T) {
+	var statements []string
+	err := sqlsplit.SplitFunc(`select 1; select 2; select 3;`, func(statement string) error {
+		statements = append(statements, statement)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{`select 1;`, `select 2;`, `select 3;`}, statements)
+}
+
+func TestSplitFuncEmpty(t *testing.T) {
+	var statements []string
+	err := sqlsplit.SplitFunc(``, func(statement string) error {
+		statements = append(statements, statement)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{``}, statements)
+}
+
+func TestSplitFuncStopsOnError(t *testing.T) {
+	var statements []string
+	err := sqlsplit.SplitFunc(`select 1; select 2; select 3;`, func(statement string) error {
+		statements = append(statements, statement)
+		if len(statements) == 2 {
+			return errors.New("stop")
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "stop")
+	assert.Equal(t, []string{`select 1;`, `select 2;`}, statements)
+}
+
+func TestCheck(t *testing.T) {
+	for i, tt := range []struct {
+		sql      string
+		expected string
+	}{
+		{sql: ``},
+		{sql: `select 'a;b', "c;d", $$e;f$$, $tag$g$tag$, e'h\'i'; /* j */ -- k`},
+		{sql: "select 1;\nselect 'abc;\nselect 2;", expected: "unterminated quoted string starting at line 2"},
+		{sql: `select "abc;`, expected: "unterminated quoted identifier starting at line 1"},
+		{sql: "create function f() returns int as $body$\nselect 1;\n$$ language sql;", expected: "unterminated dollar-quoted string starting at line 1"},
+		{sql: `select e'abc\';`, expected: "unterminated escape string starting at line 1"},
+		{sql: "select 1;\n\n/* /* nested */ comment", expected: "unterminated block comment starting at line 3"},
+	} {
+		err := sqlsplit.Check(tt.sql)
+		if tt.expected == "" {
+			assert.NoErrorf(t, err, "%d", i)
+		} else {
+			assert.EqualErrorf(t, err, tt.expected, "%d", i)
+		}
+	}
+}
+
+func largeSQL() string {
+	statement := `insert into widgets(name, description) values ('widget', $$a description with a ; semicolon$$); -- comment ;
+`
+	return strings.Repeat(statement, 10*1024*1024/len(statement))
+}
+
+func BenchmarkSplit10MB(b *testing.B) {
+	sql := largeSQL()
+	b.SetBytes(int64(len(sql)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		sqlsplit.Split(sql)
+	}
+}
+
+func BenchmarkSplitFunc10MB(b *testing.B) {
+	sql := largeSQL()
+	b.SetBytes(int64(len(sql)))
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		sqlsplit.SplitFunc(sql, func(statement string) error { return nil })
+	}
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
@@ -18,6 +20,12 @@ type SSHConnConfig struct {
 	Password   string
 	KeyFile    string
 	Passphrase string
+
+	// NoAgent disables authentication with an SSH agent. e.g. to force key file authentication.
+	NoAgent bool
+
+	// AgentSock is the path of the SSH agent socket. If empty, SSH_AUTH_SOCK is used.
+	AgentSock string
 }
 
 var sshKeyFiles = [...]string{
@@ -32,13 +40,7 @@ func NewSSHClient(config *SSHConnConfig) (*ssh.Client, error) {
 		User: config.User,
 	}
 
-	if auth := SSHAgent(); auth != nil {
-		sshConfig.Auth = append(sshConfig.Auth, auth)
-	}
-
-	if auth := WindowsSSHAgent(); auth != nil {
-		sshConfig.Auth = append(sshConfig.Auth, auth)
-	}
+	sshConfig.Auth = append(sshConfig.Auth, sshAgentAuthMethods(config)...)
 
 	if config.Password != "" {
 		sshConfig.Auth = append(sshConfig.Auth, ssh.Password(config.Password))
@@ -72,13 +74,41 @@ func NewSSHClient(config *SSHConnConfig) (*ssh.Client, error) {
 	return ssh.Dial("tcp", net.JoinHostPort(config.Host, config.Port), sshConfig)
 }
 
-func SSHAgent() ssh.AuthMethod {
-	if sshAgent, err := net.Dial("unix", os.Getenv("SSH_AUTH_SOCK")); err == nil {
+// sshAgentAuthMethods returns the auth methods for the SSH agents allowed by config that can be reached.
+func sshAgentAuthMethods(config *SSHConnConfig) []ssh.AuthMethod {
+	if config.NoAgent {
+		return nil
+	}
+
+	var methods []ssh.AuthMethod
+	if auth := SSHAgent(config.AgentSock); auth != nil {
+		methods = append(methods, auth)
+	}
+
+	// The Windows agent pipe is only used when no socket was given explicitly.
+	if config.AgentSock == "" {
+		if auth := WindowsSSHAgent(); auth != nil {
+			methods = append(methods, auth)
+		}
+	}
+
+	return methods
+}
+
+// SSHAgent returns an auth method that uses the SSH agent listening on the unix socket at socket. If socket is empty
+// SSH_AUTH_SOCK is used. It returns nil if the agent cannot be reached.
+func SSHAgent(socket string) ssh.AuthMethod {
+	if socket == "" {
+		socket = os.Getenv("SSH_AUTH_SOCK")
+	}
+	if sshAgent, err := net.Dial("unix", socket); err == nil {
 		return ssh.PublicKeysCallback(agent.NewClient(sshAgent).Signers)
 	}
 	return nil
 }
 
+// PrivateKey returns an auth method for the private key in keyFile. It returns nil and no error if keyFile does not
+// exist. passphrase is used if the key is encrypted.
 func PrivateKey(keyFile string, passphrase string) (ssh.AuthMethod, error) {
 	key, err := os.ReadFile(keyFile)
 	if os.IsNotExist(err) {
@@ -87,14 +117,47 @@ func PrivateKey(keyFile string, passphrase string) (ssh.AuthMethod, error) {
 	if err != nil {
 		return nil, err
 	}
-	signer, err := ssh.ParsePrivateKey(key)
-	var pkErr *ssh.PassphraseMissingError
-	if err != nil && errors.As(err, &pkErr) && passphrase != "" {
-		// If the key is encrypted and we have a passphrase, we try to parse it using the passphrase
-		signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
-	}
+	signer, err := parsePrivateKey(key, passphrase)
 	if err != nil {
 		return nil, err
 	}
 	return ssh.PublicKeys(signer), nil
 }
+
+// parsePrivateKey parses an RSA, ECDSA, Ed25519, or DSA private key in OpenSSH, PKCS#1, PKCS#8, or SEC1 PEM format.
+// The key may be encrypted with passphrase.
+func parsePrivateKey(key []byte, passphrase string) (ssh.Signer, error) {
+	if bytes.HasPrefix(key, []byte("PuTTY-User-Key-File")) {
+		return nil, errors.New("PuTTY keys are not supported (export the key in OpenSSH format with PuTTYgen)")
+	}
+
+	signer, err := ssh.ParsePrivateKey(key)
+	if err == nil {
+		return signer, nil
+	}
+
+	var pkErr *ssh.PassphraseMissingError
+	encrypted := errors.As(err, &pkErr)
+	if encrypted && passphrase == "" {
+		return nil, errors.New("key is encrypted but no passphrase was given (set passphrase in the ssh-tunnel section of the config or use --ssh-passphrase)")
+	}
+
+	// The passphrase is tried whenever one is given. Not every encrypted key format is reported as encrypted.
+	if passphrase != "" {
+		signer, passphraseErr := ssh.ParsePrivateKeyWithPassphrase(key, []byte(passphrase))
+		if passphraseErr == nil {
+			return signer, nil
+		}
+		if errors.Is(passphraseErr, x509.IncorrectPasswordError) {
+			return nil, errors.New("incorrect passphrase")
+		}
+		if encrypted {
+			err = passphraseErr
+		}
+	}
+
+	if !encrypted {
+		return nil, fmt.Errorf("unsupported private key format: %w (the key must be in OpenSSH, PKCS#1, PKCS#8, or SEC1 PEM format; ssh-keygen -p -f FILE rewrites a key in OpenSSH format)", err)
+	}
+	return nil, err
+}
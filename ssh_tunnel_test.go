@@ -0,0 +1,172 @@
+//go:build !windows
+
+package main
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+// startSSHAgent serves an in-memory SSH agent holding one key on a unix socket and returns the socket path.
+func startSSHAgent(t *testing.T) string {
+	t.Helper()
+
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	keyring := agent.NewKeyring()
+	err = keyring.Add(agent.AddedKey{PrivateKey: key})
+	require.NoError(t, err)
+
+	socket := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				agent.ServeAgent(keyring, conn)
+			}()
+		}
+	}()
+
+	return socket
+}
+
+func TestSSHAgentAuthMethods(t *testing.T) {
+	socket := startSSHAgent(t)
+
+	t.Run("SSH_AUTH_SOCK", func(t *testing.T) {
+		t.Setenv("SSH_AUTH_SOCK", socket)
+		assert.Len(t, sshAgentAuthMethods(&SSHConnConfig{}), 1)
+	})
+
+	t.Run("AgentSock", func(t *testing.T) {
+		t.Setenv("SSH_AUTH_SOCK", "")
+		assert.Len(t, sshAgentAuthMethods(&SSHConnConfig{AgentSock: socket}), 1)
+	})
+
+	t.Run("AgentSock overrides SSH_AUTH_SOCK", func(t *testing.T) {
+		t.Setenv("SSH_AUTH_SOCK", socket)
+		missing := filepath.Join(t.TempDir(), "missing.sock")
+		assert.Empty(t, sshAgentAuthMethods(&SSHConnConfig{AgentSock: missing}))
+	})
+
+	t.Run("NoAgent", func(t *testing.T) {
+		t.Setenv("SSH_AUTH_SOCK", socket)
+		assert.Empty(t, sshAgentAuthMethods(&SSHConnConfig{NoAgent: true}))
+		assert.Empty(t, sshAgentAuthMethods(&SSHConnConfig{NoAgent: true, AgentSock: socket}))
+	})
+}
+
+func TestPrivateKey(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	ecdsaKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	_, ed25519Key, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+
+	encode := func(block *pem.Block, err error) []byte {
+		require.NoError(t, err)
+		return pem.EncodeToMemory(block)
+	}
+	openSSH := func(key crypto.PrivateKey) []byte {
+		return encode(ssh.MarshalPrivateKey(key, ""))
+	}
+	openSSHEncrypted := func(key crypto.PrivateKey) []byte {
+		return encode(ssh.MarshalPrivateKeyWithPassphrase(key, "", []byte("secret")))
+	}
+	pkcs8 := func(key crypto.PrivateKey) []byte {
+		der, err := x509.MarshalPKCS8PrivateKey(key)
+		return encode(&pem.Block{Type: "PRIVATE KEY", Bytes: der}, err)
+	}
+	sec1, err := x509.MarshalECPrivateKey(ecdsaKey)
+	require.NoError(t, err)
+
+	for _, tt := range []struct {
+		name      string
+		key       crypto.Signer
+		pem       []byte
+		encrypted bool
+	}{
+		{"rsa openssh", rsaKey, openSSH(rsaKey), false},
+		{"rsa openssh encrypted", rsaKey, openSSHEncrypted(rsaKey), true},
+		{"rsa pkcs1", rsaKey, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}), false},
+		{"rsa pkcs8", rsaKey, pkcs8(rsaKey), false},
+		{"ecdsa openssh", ecdsaKey, openSSH(ecdsaKey), false},
+		{"ecdsa openssh encrypted", ecdsaKey, openSSHEncrypted(ecdsaKey), true},
+		{"ecdsa sec1", ecdsaKey, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: sec1}), false},
+		{"ecdsa pkcs8", ecdsaKey, pkcs8(ecdsaKey), false},
+		{"ed25519 openssh", ed25519Key, openSSH(ed25519Key), false},
+		{"ed25519 openssh encrypted", ed25519Key, openSSHEncrypted(ed25519Key), true},
+		{"ed25519 pkcs8", ed25519Key, pkcs8(ed25519Key), false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			expected, err := ssh.NewPublicKey(tt.key.Public())
+			require.NoError(t, err)
+
+			signer, err := parsePrivateKey(tt.pem, "secret")
+			require.NoError(t, err)
+			assert.Equal(t, expected.Marshal(), signer.PublicKey().Marshal())
+
+			if tt.encrypted {
+				_, err = parsePrivateKey(tt.pem, "")
+				assert.ErrorContains(t, err, "key is encrypted but no passphrase was given")
+
+				_, err = parsePrivateKey(tt.pem, "wrong")
+				assert.EqualError(t, err, "incorrect passphrase")
+			} else {
+				signer, err = parsePrivateKey(tt.pem, "")
+				require.NoError(t, err)
+				assert.Equal(t, expected.Marshal(), signer.PublicKey().Marshal())
+			}
+		})
+	}
+
+	t.Run("unsupported", func(t *testing.T) {
+		_, err := parsePrivateKey([]byte("PuTTY-User-Key-File-3: ssh-ed25519\n"), "")
+		assert.ErrorContains(t, err, "PuTTY keys are not supported")
+
+		_, err = parsePrivateKey([]byte("not a key"), "secret")
+		assert.ErrorContains(t, err, "unsupported private key format")
+
+		_, err = parsePrivateKey(pem.EncodeToMemory(&pem.Block{Type: "FOO PRIVATE KEY", Bytes: []byte("foo")}), "")
+		assert.ErrorContains(t, err, "unsupported private key format")
+	})
+
+	t.Run("file", func(t *testing.T) {
+		dir := t.TempDir()
+
+		auth, err := PrivateKey(filepath.Join(dir, "missing"), "")
+		require.NoError(t, err)
+		assert.Nil(t, auth)
+
+		keyFile := filepath.Join(dir, "id_ed25519")
+		err = os.WriteFile(keyFile, openSSHEncrypted(ed25519Key), 0o600)
+		require.NoError(t, err)
+		auth, err = PrivateKey(keyFile, "secret")
+		require.NoError(t, err)
+		assert.NotNil(t, auth)
+	})
+}